@@ -0,0 +1,48 @@
+package main
+
+// This file contains what our AWS clients share.  The shuffler uses KMS and
+// DynamoDB to protect its snapshots, and talks to both via the AWS SDK.
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// awsCredentials represents AWS credentials.  The session token is only set
+// for temporary credentials.
+type awsCredentials struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token,omitempty"`
+}
+
+// envAWSCredentials returns the AWS credentials in the environment variables
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN.  The host
+// controls the environment, so these credentials must not be able to do
+// anything that the host isn't allowed to do.
+func envAWSCredentials() *awsCredentials {
+	return &awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// provider returns the credentials as a credentials provider for the AWS SDK.
+func (c *awsCredentials) provider() aws.CredentialsProvider {
+	return credentials.NewStaticCredentialsProvider(c.AccessKeyID, c.SecretAccessKey, c.SessionToken)
+}
+
+// awsConfig returns the configuration of an AWS SDK client for the given
+// region, which obtains its credentials from the given provider and sends its
+// requests via the given HTTP client.
+func awsConfig(region string, creds aws.CredentialsProvider, client *http.Client) aws.Config {
+	return aws.Config{
+		Region:      region,
+		Credentials: aws.NewCredentialsCache(creds),
+		HTTPClient:  client,
+	}
+}
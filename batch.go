@@ -0,0 +1,303 @@
+package main
+
+// This file implements the wire format of the batches that the forwarder sends
+// to the analyzer.  A batch is split into chunks, each of which is POSTed as a
+// single object that's encoded as either JSON (Content-Type:
+// application/json) or CBOR (Content-Type: application/cbor), and has the
+// following fields:
+//
+//   schema_version    Integer.  The version of this format, currently 3.
+//   batch_id          String.  A random, hex-encoded 16-byte ID.
+//   chunk_index       Integer.  The chunk's index in [0, chunk_count).
+//   chunk_count       Integer.  The number of chunks of the batch.
+//   period_start      RFC 3339 timestamp.  The start of the batch period.
+//   period_end        RFC 3339 timestamp.  The end of the batch period.
+//   threshold         Integer.  The k-anonymity threshold that was enforced
+//                     on reports that no rule of threshold_policy covers.
+//   crowd_id_method   String.  The name of the crowd ID strategy of reports
+//                     that no rule of threshold_policy covers.
+//   aggregation       String.  The aggregation mode, either "crowd" (crowds
+//                     below the threshold were dumped) or "nested" (the
+//                     attributes of measurements were redacted).
+//   threshold_policy  Optional list of objects with the fields pattern,
+//                     threshold, and crowd_id_method.  The threshold and
+//                     crowd ID strategy that were used for the P3A metrics
+//                     whose name matches the pattern.  The first matching
+//                     rule applies.
+//   noise             Optional object with the fields mechanism, epsilon,
+//                     delta, and drop_fraction.  The parameters of noisy
+//                     thresholding, if it was used, with the batch's
+//                     per-batch delta (see noise.go).
+//   payloads          List of byte strings (Base64-encoded in JSON).  The
+//                     shuffled reports' payloads, i.e. JSON-encoded P3A
+//                     measurements, JSON-encoded partial measurements, or
+//                     opaque payloads of encrypted reports.
+//   partial           Optional list of integers.  The indices of the
+//                     payloads that are partial measurements.
+//
+// If the analyzer doesn't support our content type, it responds with HTTP
+// status code 415 and an Accept header that lists the content types that it
+// supports, and the forwarder switches to one of them.
+//
+// The analyzer acknowledges a chunk by responding with HTTP status code 200
+// and a JSON object that contains the chunk's batch_id and chunk_index, e.g.
+// {"batch_id":"...","chunk_index":3}.  Only acknowledged chunks count as
+// forwarded; all others are retried.  Retries of a chunk contain the same
+// reports, and every request carries the Idempotency-Key header
+// "<batch_id>-<chunk_index>", so the analyzer can deduplicate retries and use
+// chunk_count to detect missing chunks.
+//
+// The batch's reports are shuffled before they're split into chunks, so every
+// chunk is a uniformly random subset of the batch and chunk indices reveal
+// nothing about the order in which reports arrived.  We additionally send
+// chunks in random order.
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	batchSchemaVersion = 3
+	batchIDLen         = 16
+	contentTypeJSON    = "application/json"
+	contentTypeCBOR    = "application/cbor"
+	// maxAckBytes is the maximum size of a chunk acknowledgement.
+	maxAckBytes = 4096
+)
+
+var (
+	// supportedContentTypes contains the content types that we can encode
+	// batches in, in the order of our preference.
+	supportedContentTypes = []string{contentTypeCBOR, contentTypeJSON}
+	// cborEncMode encodes timestamps like encoding/json does.
+	cborEncMode = mustCBOREncMode()
+)
+
+func mustCBOREncMode() cbor.EncMode {
+	em, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return em
+}
+
+// Batch represents a batch of shuffled reports, along with the metadata that
+// the analyzer needs to interpret it.  A Batch is also used to represent a
+// chunk of a batch, in which case ChunkCount is larger than 1.
+type Batch struct {
+	ID            string
+	ChunkIndex    int
+	ChunkCount    int
+	PeriodStart   time.Time
+	PeriodEnd     time.Time
+	Threshold     int
+	CrowdIDMethod string
+	Aggregation   string
+	Policy        []batchRule
+	Noise         *batchNoise
+	Reports       []Report
+}
+
+// batchRule represents a rule of a threshold policy, as it applied to a batch.
+type batchRule struct {
+	Pattern       string `json:"pattern"`
+	Threshold     int    `json:"threshold"`
+	CrowdIDMethod string `json:"crowd_id_method"`
+}
+
+// batchNoise represents the parameters of the noisy thresholding that we
+// applied to a batch.  Without a mechanism, we only dropped reports.
+type batchNoise struct {
+	Mechanism    string  `json:"mechanism,omitempty"`
+	Epsilon      float64 `json:"epsilon,omitempty"`
+	Delta        float64 `json:"delta,omitempty"`
+	DropFraction float64 `json:"drop_fraction,omitempty"`
+}
+
+// chunks splits the batch into chunks of at most the given number of reports.
+// If size isn't positive, the batch consists of a single chunk.
+func (b *Batch) chunks(size int) []*Batch {
+	if size <= 0 || size > len(b.Reports) {
+		size = len(b.Reports)
+	}
+	count := 1
+	if size > 0 {
+		count = (len(b.Reports) + size - 1) / size
+	}
+	chunks := make([]*Batch, count)
+	for i := range chunks {
+		c := *b
+		c.ChunkIndex, c.ChunkCount = i, count
+		if size > 0 {
+			end := (i + 1) * size
+			if end > len(b.Reports) {
+				end = len(b.Reports)
+			}
+			c.Reports = b.Reports[i*size : end]
+		}
+		chunks[i] = &c
+	}
+	return chunks
+}
+
+// idempotencyKey returns the key that lets the analyzer recognize retries of
+// the chunk.
+func (b *Batch) idempotencyKey() string {
+	return fmt.Sprintf("%s-%d", b.ID, b.ChunkIndex)
+}
+
+// String returns a description of the chunk for our logs.
+func (b *Batch) String() string {
+	return fmt.Sprintf("chunk %d/%d of batch %s (%d reports)", b.ChunkIndex+1, b.ChunkCount, b.ID, len(b.Reports))
+}
+
+// chunkAck represents the analyzer's acknowledgement of a chunk.
+type chunkAck struct {
+	BatchID    string `json:"batch_id"`
+	ChunkIndex *int   `json:"chunk_index"`
+}
+
+// verifyAck returns an error if the given response body doesn't acknowledge
+// the chunk.
+func (b *Batch) verifyAck(body []byte) error {
+	var ack chunkAck
+	if err := json.Unmarshal(body, &ack); err != nil {
+		return fmt.Errorf("failed to decode acknowledgement: %w", err)
+	}
+	if ack.BatchID != b.ID || ack.ChunkIndex == nil || *ack.ChunkIndex != b.ChunkIndex {
+		return fmt.Errorf("server didn't acknowledge %s", b)
+	}
+	return nil
+}
+
+// newBatchID returns a new, random batch ID.
+func newBatchID() (string, error) {
+	id := make([]byte, batchIDLen)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", id), nil
+}
+
+// batchMessage represents a batch in our wire format.  The CBOR encoding uses
+// the same field names as the JSON encoding.
+type batchMessage struct {
+	SchemaVersion int         `json:"schema_version"`
+	BatchID       string      `json:"batch_id"`
+	ChunkIndex    int         `json:"chunk_index"`
+	ChunkCount    int         `json:"chunk_count"`
+	PeriodStart   time.Time   `json:"period_start"`
+	PeriodEnd     time.Time   `json:"period_end"`
+	Threshold     int         `json:"threshold"`
+	CrowdIDMethod string      `json:"crowd_id_method"`
+	Aggregation   string      `json:"aggregation"`
+	Policy        []batchRule `json:"threshold_policy,omitempty"`
+	Noise         *batchNoise `json:"noise,omitempty"`
+	Payloads      [][]byte    `json:"payloads"`
+	Partial       []int       `json:"partial,omitempty"`
+}
+
+// message turns the batch into its wire format.  It fails if a report's
+// payload cannot be encoded.
+func (b *Batch) message() (*batchMessage, error) {
+	m := &batchMessage{
+		SchemaVersion: batchSchemaVersion,
+		BatchID:       b.ID,
+		ChunkIndex:    b.ChunkIndex,
+		ChunkCount:    b.ChunkCount,
+		PeriodStart:   b.PeriodStart.UTC(),
+		PeriodEnd:     b.PeriodEnd.UTC(),
+		Threshold:     b.Threshold,
+		CrowdIDMethod: b.CrowdIDMethod,
+		Aggregation:   b.Aggregation,
+		Policy:        b.Policy,
+		Noise:         b.Noise,
+		Payloads:      make([][]byte, len(b.Reports)),
+	}
+	for i, r := range b.Reports {
+		payload, err := r.Payload()
+		if err != nil {
+			return nil, err
+		}
+		m.Payloads[i] = payload
+		if _, ok := r.(*PartialMeasurement); ok {
+			m.Partial = append(m.Partial, i)
+		}
+	}
+	return m, nil
+}
+
+// Marshal encodes the batch in our wire format, using the given content type.
+func (b *Batch) Marshal(contentType string) ([]byte, error) {
+	m, err := b.message()
+	if err != nil {
+		return nil, err
+	}
+	switch contentType {
+	case contentTypeJSON:
+		return json.Marshal(m)
+	case contentTypeCBOR:
+		return cborEncMode.Marshal(m)
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+}
+
+// unmarshalBatchMessage decodes the given batch, which is encoded using the
+// given content type.
+func unmarshalBatchMessage(contentType string, data []byte) (*batchMessage, error) {
+	m := &batchMessage{}
+	var err error
+	switch contentType {
+	case contentTypeJSON:
+		err = json.Unmarshal(data, m)
+	case contentTypeCBOR:
+		err = cbor.Unmarshal(data, m)
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.SchemaVersion != batchSchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d", m.SchemaVersion)
+	}
+	return m, nil
+}
+
+// isSupportedContentType returns true if we can encode batches using the
+// given content type.
+func isSupportedContentType(contentType string) bool {
+	for _, t := range supportedContentTypes {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateContentType returns our most preferred content type that the
+// given Accept header lists, or false if the header lists none of them.
+// Parameters like "q" are ignored.
+func negotiateContentType(accept string) (string, bool) {
+	accepted := make(map[string]bool)
+	for _, elem := range strings.Split(accept, ",") {
+		t, _, err := mime.ParseMediaType(strings.TrimSpace(elem))
+		if err == nil {
+			accepted[t] = true
+		}
+	}
+	for _, t := range supportedContentTypes {
+		if accepted[t] {
+			return t, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingReport is a report whose payload cannot be encoded.
+type failingReport struct{ DummyReport }
+
+func (failingReport) Payload() ([]byte, error) {
+	return nil, errors.New("cannot encode payload")
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	m := P3AMeasurement{MetricName: "Brave.Core.Foo", MetricValue: 3, CountryCode: "US"}
+	now := time.Now()
+	batch := &Batch{
+		ID:            "foo",
+		PeriodStart:   now.Add(-time.Hour),
+		PeriodEnd:     now,
+		Threshold:     10,
+		CrowdIDMethod: "All",
+		Aggregation:   aggregationNested,
+		Policy:        []batchRule{{Pattern: "Brave.Core.*", Threshold: 20, CrowdIDMethod: "Minimal"}},
+		Noise:         &batchNoise{DropFraction: 0.1},
+		Reports: []Report{
+			m,
+			&ShufflerReport{Data: []byte("bar")},
+			NewPartialMeasurement(m, strategyAll, 1),
+		},
+	}
+
+	for _, contentType := range supportedContentTypes {
+		data, err := batch.Marshal(contentType)
+		if err != nil {
+			t.Fatalf("Failed to marshal batch as %s: %s", contentType, err)
+		}
+		msg, err := unmarshalBatchMessage(contentType, data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal batch as %s: %s", contentType, err)
+		}
+		if msg.SchemaVersion != batchSchemaVersion || msg.BatchID != "foo" ||
+			msg.Threshold != 10 || msg.CrowdIDMethod != "All" || msg.Aggregation != aggregationNested ||
+			len(msg.Policy) != 1 || msg.Policy[0] != batch.Policy[0] || *msg.Noise != *batch.Noise {
+			t.Fatalf("Unexpected batch metadata for %s: %+v", contentType, msg)
+		}
+		if !msg.PeriodEnd.Equal(now) || !msg.PeriodStart.Equal(now.Add(-time.Hour)) {
+			t.Fatalf("Unexpected batch period for %s: %s to %s", contentType, msg.PeriodStart, msg.PeriodEnd)
+		}
+		if len(msg.Payloads) != 3 || string(msg.Payloads[1]) != "bar" {
+			t.Fatalf("Unexpected payloads for %s: %q", contentType, msg.Payloads)
+		}
+		// Only the partial measurement must be marked as partial.
+		if len(msg.Partial) != 1 || msg.Partial[0] != 2 {
+			t.Fatalf("Expected partial payload indices [2] for %s but got %v.", contentType, msg.Partial)
+		}
+		// P3A measurements are forwarded as JSON.
+		var decoded P3AMeasurement
+		if err := json.Unmarshal(msg.Payloads[0], &decoded); err != nil {
+			t.Fatalf("Failed to unmarshal P3A payload: %s", err)
+		}
+		if decoded != m {
+			t.Fatalf("Expected P3A payload %v but got %v.", m, decoded)
+		}
+	}
+
+	if _, err := batch.Marshal("text/plain"); err == nil {
+		t.Fatal("Marshalled batch using unsupported content type.")
+	}
+	batch.Reports = append(batch.Reports, failingReport{})
+	if _, err := batch.Marshal(contentTypeJSON); err == nil {
+		t.Fatal("Marshalled batch with a report whose payload cannot be encoded.")
+	}
+	if _, err := unmarshalBatchMessage(contentTypeJSON, []byte(`{"schema_version": 1}`)); err == nil {
+		t.Fatal("Accepted batch with unsupported schema version.")
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"application/json":                   contentTypeJSON,
+		"application/json, application/cbor": contentTypeCBOR,
+		"text/plain, application/cbor;q=0.5": contentTypeCBOR,
+		" application/json ; charset=utf-8 ": contentTypeJSON,
+		"text/plain":                         "",
+		"":                                   "",
+	} {
+		contentType, ok := negotiateContentType(accept)
+		if contentType != expected || ok != (expected != "") {
+			t.Fatalf("Expected %q for Accept header %q but got %q.", expected, accept, contentType)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	batch := &Batch{ID: "foo", Threshold: 10}
+	for i := 0; i < 25; i++ {
+		batch.Reports = append(batch.Reports, &DummyReport{crowdID: CrowdID("foo")})
+	}
+
+	for size, expected := range map[int][]int{
+		10:  {10, 10, 5},
+		25:  {25},
+		100: {25},
+		0:   {25},
+	} {
+		chunks := batch.chunks(size)
+		if len(chunks) != len(expected) {
+			t.Fatalf("Expected %d chunks of size %d but got %d.", len(expected), size, len(chunks))
+		}
+		for i, c := range chunks {
+			if c.ID != "foo" || c.Threshold != 10 || c.ChunkIndex != i || c.ChunkCount != len(expected) {
+				t.Fatalf("Unexpected metadata of chunk %d: %s", i, c)
+			}
+			if len(c.Reports) != expected[i] {
+				t.Fatalf("Expected %d reports in chunk %d but got %d.", expected[i], i, len(c.Reports))
+			}
+		}
+	}
+
+	chunk := batch.chunks(10)[1]
+	zero := 0
+	for _, ack := range []chunkAck{{BatchID: "foo"}, {BatchID: "bar", ChunkIndex: &zero}, {BatchID: "foo", ChunkIndex: &zero}} {
+		body, _ := json.Marshal(ack)
+		if err := chunk.verifyAck(body); err == nil {
+			t.Fatalf("Accepted bad acknowledgement %s.", body)
+		}
+	}
+	if err := chunk.verifyAck([]byte(`{"batch_id":"foo","chunk_index":1}`)); err != nil {
+		t.Fatalf("Rejected valid acknowledgement: %s", err)
+	}
+}
@@ -0,0 +1,239 @@
+// Package batchverify lets the analyzer verify that a batch was forwarded by
+// an attested p3a-shuffler enclave.
+//
+// Inside the enclave, the shuffler generates an Ed25519 key pair whose private
+// key never leaves the enclave.  The forwarder signs the body of every batch
+// that it POSTs and sends the signature along in the X-Batch-Signature header.
+// The shuffler's attestation endpoint returns the signing key alongside a
+// Nitro attestation document whose user_data field contains the SHA-256 hash
+// of the signing key.  A batch is authentic if the attestation document is
+// signed by AWS's Nitro PKI, the document's PCRs match the expected enclave
+// image, the document contains the nonce that the analyzer sent to the
+// attestation endpoint, the signing key's hash matches the document's
+// user_data, and the batch's signature is valid.
+package batchverify
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	// SignatureHeader is the HTTP header that contains the Base64-encoded
+	// signature over a batch's body.
+	SignatureHeader = "X-Batch-Signature"
+	// KeyHeader is the HTTP header that contains the Base64-encoded public
+	// key that a batch was signed with.
+	KeyHeader = "X-Batch-Key"
+	// signatureContext separates batch signatures from any other signatures
+	// that the signing key may ever make.
+	signatureContext = "p3a-shuffler batch signature v1"
+	// coseAlgES384 is COSE's identifier for ECDSA with P-384 and SHA-384,
+	// which is what Nitro attestation documents are signed with.
+	coseAlgES384  = -35
+	coseHeaderAlg = 1
+)
+
+var (
+	// ErrBadSignature means that a batch's signature is invalid.
+	ErrBadSignature = errors.New("batch has invalid signature")
+	// ErrKeyMismatch means that the attestation document doesn't vouch for
+	// the key that a batch was signed with.
+	ErrKeyMismatch = errors.New("signing key doesn't match attestation document")
+	// ErrBadAttestation means that an attestation document's signature is
+	// invalid.
+	ErrBadAttestation = errors.New("attestation document has invalid signature")
+	// ErrPCRMismatch means that an attestation document was created by an
+	// unexpected enclave image.
+	ErrPCRMismatch = errors.New("attestation document has unexpected PCR")
+	// ErrNonceMismatch means that an attestation document doesn't contain
+	// the expected nonce, i.e. it may have been replayed.
+	ErrNonceMismatch = errors.New("attestation document has unexpected nonce")
+)
+
+// AttestationResponse is the JSON-encoded response of the shuffler's batch
+// attestation endpoint.
+type AttestationResponse struct {
+	PublicKey   []byte `json:"public_key"`
+	Attestation []byte `json:"attestation"`
+}
+
+// Document represents the payload of a Nitro attestation document.
+type Document struct {
+	ModuleID    string          `cbor:"module_id"`
+	Timestamp   uint64          `cbor:"timestamp"`
+	Digest      string          `cbor:"digest"`
+	PCRs        map[uint][]byte `cbor:"pcrs"`
+	Certificate []byte          `cbor:"certificate"`
+	CABundle    [][]byte        `cbor:"cabundle"`
+	PublicKey   []byte          `cbor:"public_key"`
+	UserData    []byte          `cbor:"user_data"`
+	Nonce       []byte          `cbor:"nonce"`
+}
+
+// Time returns the time at which the attestation document was created.
+func (d *Document) Time() time.Time {
+	return time.Unix(0, int64(d.Timestamp)*int64(time.Millisecond))
+}
+
+// coseSign1 represents a COSE_Sign1 structure, as defined in RFC 8152.
+type coseSign1 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected cbor.RawMessage
+	Payload     []byte
+	Signature   []byte
+}
+
+// SigningInput returns the message that the shuffler signs for the given
+// batch body.
+func SigningInput(body []byte) []byte {
+	return append([]byte(signatureContext+"\x00"), body...)
+}
+
+// KeyHash returns the SHA-256 hash of the given public key, which is what the
+// attestation document's user_data field contains.
+func KeyHash(pub ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(pub)
+	return sum[:]
+}
+
+// VerifySignature returns an error if the given signature over the given batch
+// body isn't valid for the given public key.
+func VerifySignature(pub ed25519.PublicKey, body, sig []byte) error {
+	if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key must be %d bytes but is %d", ed25519.PublicKeySize, len(pub))
+	}
+	if !ed25519.Verify(pub, SigningInput(body), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// VerifyAttestation verifies the given raw attestation document and returns
+// its payload.  The document's certificate chain must lead to one of the
+// given roots, i.e. AWS's Nitro Enclaves root certificate, which is available
+// at https://aws-nitro-enclaves.amazonaws.com/AWS_NitroEnclaves_Root-G1.zip.
+// The chain is verified at the time at which the document was created, so
+// callers must establish the document's freshness via its nonce.
+func VerifyAttestation(raw []byte, roots *x509.CertPool) (*Document, error) {
+	var msg coseSign1
+	if err := cbor.Unmarshal(raw, &msg); err != nil {
+		return nil, fmt.Errorf("failed to decode COSE_Sign1 structure: %w", err)
+	}
+	var hdr map[int]interface{}
+	if err := cbor.Unmarshal(msg.Protected, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to decode protected header: %w", err)
+	}
+	if alg, ok := hdr[coseHeaderAlg].(int64); !ok || alg != coseAlgES384 {
+		return nil, fmt.Errorf("unsupported signature algorithm %v", hdr[coseHeaderAlg])
+	}
+
+	doc := &Document{}
+	if err := cbor.Unmarshal(msg.Payload, doc); err != nil {
+		return nil, fmt.Errorf("failed to decode attestation document: %w", err)
+	}
+	if doc.Digest != "SHA384" {
+		return nil, fmt.Errorf("unsupported digest %q", doc.Digest)
+	}
+	if len(doc.CABundle) == 0 {
+		return nil, errors.New("attestation document has no CA bundle")
+	}
+
+	// Verify the document's certificate chain.  The first certificate of the
+	// CA bundle is the root, which we ignore in favor of the given roots.
+	cert, err := x509.ParseCertificate(doc.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range doc.CABundle[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA bundle: %w", err)
+		}
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   doc.Time(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to verify certificate chain: %w", err)
+	}
+
+	// Verify the document's signature.
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P384() {
+		return nil, errors.New("certificate has no P-384 public key")
+	}
+	sigStructure, err := cbor.Marshal([]interface{}{"Signature1", msg.Protected, []byte{}, msg.Payload})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha512.Sum384(sigStructure)
+	// The signature is the concatenation of r and s, 48 bytes each.
+	if len(msg.Signature) != 96 {
+		return nil, ErrBadAttestation
+	}
+	r := new(big.Int).SetBytes(msg.Signature[:48])
+	s := new(big.Int).SetBytes(msg.Signature[48:])
+	if !ecdsa.Verify(pub, digest[:], r, s) {
+		return nil, ErrBadAttestation
+	}
+	return doc, nil
+}
+
+// VerifyPCRs returns an error if the attestation document's PCRs don't match
+// the given PCRs.  PCRs that aren't given are ignored.
+func (d *Document) VerifyPCRs(pcrs map[uint][]byte) error {
+	for i, expected := range pcrs {
+		if !bytes.Equal(d.PCRs[i], expected) {
+			return fmt.Errorf("%w: PCR%d is %x", ErrPCRMismatch, i, d.PCRs[i])
+		}
+	}
+	return nil
+}
+
+// Verify verifies the given batch body and its signature, given the response
+// of the shuffler's attestation endpoint, and returns the attestation
+// document.  The document must contain the given PCRs, which must include
+// PCR0 (the enclave image's hash), and the given nonce, which the caller sent
+// to the attestation endpoint.
+func Verify(body, sig []byte, resp *AttestationResponse, roots *x509.CertPool, pcrs map[uint][]byte, nonce []byte) (*Document, error) {
+	if len(pcrs[0]) == 0 {
+		return nil, errors.New("expected PCRs must include PCR0")
+	}
+	if len(nonce) == 0 {
+		return nil, errors.New("expected nonce must not be empty")
+	}
+	doc, err := VerifyAttestation(resp.Attestation, roots)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.VerifyPCRs(pcrs); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(doc.Nonce, nonce) {
+		return nil, ErrNonceMismatch
+	}
+	if !bytes.Equal(doc.UserData, KeyHash(resp.PublicKey)) {
+		return nil, ErrKeyMismatch
+	}
+	if err := VerifySignature(resp.PublicKey, body, sig); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,156 @@
+package batchverify
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// testPKI imitates AWS's Nitro PKI with a root certificate and an enclave
+// certificate that the root signed.
+type testPKI struct {
+	roots    *x509.CertPool
+	rootDER  []byte
+	leafDER  []byte
+	leafPriv *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	newCert := func(serial int64, tmpl, parent *x509.Certificate, pub, priv interface{}) []byte {
+		tmpl.SerialNumber = big.NewInt(serial)
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+		if parent == nil {
+			parent = tmpl
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+		if err != nil {
+			t.Fatalf("Failed to create certificate: %s", err)
+		}
+		return der
+	}
+
+	rootPriv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	leafPriv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rootTmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER := newCert(1, rootTmpl, nil, &rootPriv.PublicKey, rootPriv)
+	root, _ := x509.ParseCertificate(rootDER)
+	leafDER := newCert(2, &x509.Certificate{Subject: pkix.Name{CommonName: "enclave"}},
+		root, &leafPriv.PublicKey, rootPriv)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &testPKI{roots: roots, rootDER: rootDER, leafDER: leafDER, leafPriv: leafPriv}
+}
+
+// attest returns a COSE_Sign1-encoded attestation document that contains the
+// given user data.
+func (p *testPKI) attest(t *testing.T, userData []byte) []byte {
+	payload, err := cbor.Marshal(&Document{
+		ModuleID:    "i-foo-enc-bar",
+		Timestamp:   uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		Digest:      "SHA384",
+		PCRs:        map[uint][]byte{0: make([]byte, 48)},
+		Certificate: p.leafDER,
+		CABundle:    [][]byte{p.rootDER},
+		UserData:    userData,
+		Nonce:       []byte("nonce"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal attestation document: %s", err)
+	}
+	protected, _ := cbor.Marshal(map[int]int{coseHeaderAlg: coseAlgES384})
+	sigStructure, _ := cbor.Marshal([]interface{}{"Signature1", protected, []byte{}, payload})
+	digest := sha512.Sum384(sigStructure)
+	r, s, err := ecdsa.Sign(rand.Reader, p.leafPriv, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign attestation document: %s", err)
+	}
+	sig := make([]byte, 96)
+	r.FillBytes(sig[:48])
+	s.FillBytes(sig[48:])
+
+	raw, err := cbor.Marshal(&coseSign1{
+		Protected:   protected,
+		Unprotected: cbor.RawMessage{0xa0}, // An empty map.
+		Payload:     payload,
+		Signature:   sig,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal COSE_Sign1 structure: %s", err)
+	}
+	return raw
+}
+
+func TestVerify(t *testing.T) {
+	pki := newTestPKI(t)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	resp := &AttestationResponse{PublicKey: pub, Attestation: pki.attest(t, KeyHash(pub))}
+	body := []byte(`{"schema_version":1}`)
+	sig := ed25519.Sign(priv, SigningInput(body))
+
+	pcrs, nonce := map[uint][]byte{0: make([]byte, 48)}, []byte("nonce")
+	doc, err := Verify(body, sig, resp, pki.roots, pcrs, nonce)
+	if err != nil {
+		t.Fatalf("Failed to verify valid batch: %s", err)
+	}
+	if string(doc.Nonce) != "nonce" {
+		t.Fatalf("Expected nonce %q but got %q.", "nonce", doc.Nonce)
+	}
+
+	// Verify must check the PCRs and the nonce, and insist on both.
+	if _, err := Verify(body, sig, resp, pki.roots, map[uint][]byte{0: []byte("foo")}, nonce); !errors.Is(err, ErrPCRMismatch) {
+		t.Fatalf("Expected PCR mismatch but got: %v", err)
+	}
+	if _, err := Verify(body, sig, resp, pki.roots, map[uint][]byte{0: pcrs[0], 1: []byte("foo")}, nonce); !errors.Is(err, ErrPCRMismatch) {
+		t.Fatalf("Expected PCR1 mismatch but got: %v", err)
+	}
+	if _, err := Verify(body, sig, resp, pki.roots, pcrs, []byte("other nonce")); err != ErrNonceMismatch {
+		t.Fatalf("Expected %v but got: %v", ErrNonceMismatch, err)
+	}
+	if _, err := Verify(body, sig, resp, pki.roots, map[uint][]byte{1: pcrs[0]}, nonce); err == nil {
+		t.Fatal("Verified batch without expected PCR0.")
+	}
+	if _, err := Verify(body, sig, resp, pki.roots, pcrs, nil); err == nil {
+		t.Fatal("Verified batch without expected nonce.")
+	}
+
+	// A modified batch must not verify.
+	if _, err := Verify([]byte(`{"schema_version":2}`), sig, resp, pki.roots, pcrs, nonce); err != ErrBadSignature {
+		t.Fatalf("Expected %v but got: %v", ErrBadSignature, err)
+	}
+
+	// A key that the attestation document doesn't vouch for must not verify.
+	otherPub, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other := &AttestationResponse{PublicKey: otherPub, Attestation: resp.Attestation}
+	if _, err := Verify(body, ed25519.Sign(otherPriv, SigningInput(body)), other, pki.roots, pcrs, nonce); err != ErrKeyMismatch {
+		t.Fatalf("Expected %v but got: %v", ErrKeyMismatch, err)
+	}
+
+	// An attestation document from another PKI must not verify.
+	if _, err := Verify(body, sig, resp, newTestPKI(t).roots, pcrs, nonce); err == nil {
+		t.Fatal("Verified attestation document of untrusted PKI.")
+	}
+
+	// A tampered attestation document must not verify.
+	tampered := append([]byte{}, resp.Attestation...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := VerifyAttestation(tampered, pki.roots); err != ErrBadAttestation {
+		t.Fatalf("Expected %v but got: %v", ErrBadAttestation, err)
+	}
+}
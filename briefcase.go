@@ -9,16 +9,30 @@ import (
 // Briefcase contains reports.  Obviously!
 type Briefcase struct {
 	sync.Mutex
-	crowdIDMethod int
-	Reports       map[CrowdID][]Report
+	strategy CrowdIDStrategy
+	policy   *thresholdPolicy
+	noise    *noisyThreshold
+	key      crowdIDKey
+	Reports  map[CrowdID][]Report
 }
 
 // NewBriefcase creates and returns a new briefcase.
-func NewBriefcase(crowdIDMethod int) *Briefcase {
-	return &Briefcase{
-		Reports:       make(map[CrowdID][]Report),
-		crowdIDMethod: crowdIDMethod,
+func NewBriefcase(strategy CrowdIDStrategy) *Briefcase {
+	b := &Briefcase{strategy: strategy}
+	b.reset()
+	return b
+}
+
+// reset empties the briefcase and generates a new crowd ID key, so that crowd
+// IDs cannot be linked across batch periods.  The caller must hold the
+// briefcase's lock.
+func (b *Briefcase) reset() {
+	key, err := newCrowdIDKey()
+	if err != nil {
+		elog.Fatalf("Failed to generate crowd ID key: %s", err)
 	}
+	b.key = key
+	b.Reports = make(map[CrowdID][]Report)
 }
 
 // Empty empties the briefcase.
@@ -26,7 +40,7 @@ func (b *Briefcase) Empty() {
 	b.Lock()
 	defer b.Unlock()
 
-	b.Reports = make(map[CrowdID][]Report)
+	b.reset()
 }
 
 // NumCrowdIDs returns the number of crowd IDs that the briefcase currently
@@ -51,8 +65,9 @@ func (b *Briefcase) NumReports() int {
 	return num
 }
 
-// ShuffleAndEmpty gives the briefcase a good shuffle and subsequently empties it.
-func (b *Briefcase) ShuffleAndEmpty() ([]Report, error) {
+// AllReports returns a copy of all reports that the briefcase currently
+// contains.
+func (b *Briefcase) AllReports() []Report {
 	b.Lock()
 	defer b.Unlock()
 
@@ -60,39 +75,139 @@ func (b *Briefcase) ShuffleAndEmpty() ([]Report, error) {
 	for _, reports := range b.Reports {
 		result = append(result, reports...)
 	}
+	return result
+}
 
-	for i := len(result) - 1; i > 0; i-- {
+// shuffle permutes n elements uniformly at random using the Fisher-Yates
+// shuffle and crypto/rand.  The given function swaps the elements with the
+// given indices.
+func shuffle(n int, swap func(i, j int)) error {
+	for i := n - 1; i > 0; i-- {
 		index, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
 		if err != nil {
-			return nil, err
+			return err
 		}
+		swap(i, int(index.Int64()))
+	}
+	return nil
+}
+
+// ShuffleAndEmpty gives the briefcase a good shuffle and subsequently empties it.
+func (b *Briefcase) ShuffleAndEmpty() ([]Report, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	result := []Report{}
+	for _, reports := range b.Reports {
+		result = append(result, reports...)
+	}
 
-		j := int(index.Int64())
+	if err := shuffle(len(result), func(i, j int) {
 		result[i], result[j] = result[j], result[i]
+	}); err != nil {
+		return nil, err
 	}
 	elog.Printf("Shuffled briefcase containing %d crowd IDs.", len(b.Reports))
-	b.Reports = make(map[CrowdID][]Report)
+	b.reset()
 
 	return result, nil
 }
 
 // DumpFewerThan dumps all reports (as identified by CrowdID) fewer than the
 // given minimum amount, e.g., if min equals 5, we remove all reports whose
-// total number of CrowdID is fewer than 5.
+// total number of CrowdID is fewer than 5.  If the briefcase has a threshold
+// policy, the policy's threshold takes precedence over the given minimum for
+// the metrics that it covers.  If the briefcase uses noisy thresholding, we
+// first drop a random fraction of reports and then add noise to the number of
+// reports of every crowd ID before we compare it to the minimum.
 func (b *Briefcase) DumpFewerThan(min int) {
 	b.Lock()
 	defer b.Unlock()
 
-	numDumped := 0
+	numCrowdIDs := len(b.Reports)
+	numDumped, numReportsDumped := 0, 0
 	for crowdID, reports := range b.Reports {
+		if kept := b.noise.subsample(reports); len(kept) < len(reports) {
+			numReportsDumped += len(reports) - len(kept)
+			reports = kept
+			b.Reports[crowdID] = kept
+		}
 		// We don't have the minimum number of reports for the given crowd ID.
-		// Discard all the reports.
-		if len(reports) < min {
+		// Discard all the reports.  All reports of a crowd share the same
+		// metric name, so the crowd's first report determines its threshold.
+		if len(reports) == 0 || !b.noise.meets(len(reports), b.policy.threshold(reports[0], min)) {
 			delete(b.Reports, crowdID)
 			numDumped++
+			numReportsDumped += len(reports)
 		}
 	}
+	metrics.crowdIDsDropped.Add(numDumped)
+	metrics.reportsDropped.Add(numReportsDumped)
 	elog.Printf("Dumped %d crowd IDs for which we had fewer than %d reports.", numDumped, min)
+	b.noise.account(numCrowdIDs, numDumped, min)
+}
+
+// RedactFewerThan applies Nested STAR-style thresholding to all P3A
+// measurements in the briefcase: attributes are considered in the order of our
+// crowd ID strategy, and every measurement keeps the longest prefix of
+// attributes that at least 'min' measurements share.  Measurements whose
+// prefix is complete are kept as they are, measurements whose prefix is
+// incomplete are replaced with a PartialMeasurement, and measurements whose
+// metric name doesn't meet the minimum are dumped.  All other reports are
+// dumped if their crowd ID doesn't meet the minimum, as in DumpFewerThan.
+func (b *Briefcase) RedactFewerThan(min int) {
+	b.Lock()
+	defer b.Unlock()
+
+	// The metric name is the first attribute of every strategy, so each
+	// metric (and thus threshold and strategy) has its own subtree.
+	root := &Node{ValueToInfo: make(map[string]*NodeInfo)}
+	for _, reports := range b.Reports {
+		for _, r := range reports {
+			if m, ok := r.(P3AMeasurement); ok {
+				root.Add(m.OrderHighEntropyFirst(b.strategyFor(r)))
+			}
+		}
+	}
+
+	remaining := make(map[CrowdID][]Report)
+	numDumped, numRedacted := 0, 0
+	for crowdID, reports := range b.Reports {
+		for _, r := range reports {
+			m, ok := r.(P3AMeasurement)
+			if !ok {
+				if len(reports) < b.policy.threshold(r, min) {
+					numDumped++
+				} else {
+					remaining[crowdID] = append(remaining[crowdID], r)
+				}
+				continue
+			}
+			strategy := b.strategyFor(r)
+			attrs := m.OrderHighEntropyFirst(strategy)
+			switch length := root.PrefixLen(attrs, b.policy.threshold(r, min)); length {
+			case 0:
+				numDumped++
+			case len(attrs):
+				remaining[crowdID] = append(remaining[crowdID], r)
+			default:
+				p := NewPartialMeasurement(m, strategy, length)
+				id := p.CrowdID(strategy, b.key)
+				remaining[id] = append(remaining[id], p)
+				numRedacted++
+			}
+		}
+	}
+	b.Reports = remaining
+	metrics.reportsDropped.Add(numDumped)
+	metrics.reportsRedacted.Add(numRedacted)
+	elog.Printf("Dumped %d and redacted %d reports that didn't meet our threshold of %d.",
+		numDumped, numRedacted, min)
+}
+
+// strategyFor returns the crowd ID strategy for the given report.
+func (b *Briefcase) strategyFor(r Report) CrowdIDStrategy {
+	return b.policy.strategy(r, b.strategy)
 }
 
 // Add adds new reports to the briefcase.
@@ -101,11 +216,12 @@ func (b *Briefcase) Add(rs []Report) {
 	defer b.Unlock()
 
 	for _, r := range rs {
-		reports, exists := b.Reports[r.CrowdID(b.crowdIDMethod)]
+		crowdID := r.CrowdID(b.strategyFor(r), b.key)
+		reports, exists := b.Reports[crowdID]
 		if !exists {
-			b.Reports[r.CrowdID(b.crowdIDMethod)] = []Report{r}
+			b.Reports[crowdID] = []Report{r}
 		} else {
-			b.Reports[r.CrowdID(b.crowdIDMethod)] = append(reports, r)
+			b.Reports[crowdID] = append(reports, r)
 		}
 	}
 }
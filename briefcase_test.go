@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -13,11 +14,11 @@ type DummyReport struct {
 	payload []byte
 }
 
-func (d DummyReport) CrowdID(method int) CrowdID {
+func (d DummyReport) CrowdID(strategy CrowdIDStrategy, key crowdIDKey) CrowdID {
 	return d.crowdID
 }
-func (d DummyReport) Payload() []byte {
-	return d.payload
+func (d DummyReport) Payload() ([]byte, error) {
+	return d.payload, nil
 }
 
 func TestMain(m *testing.M) {
@@ -26,7 +27,7 @@ func TestMain(m *testing.M) {
 }
 
 func getFullBriefcase(reports, crowdIDs int) *Briefcase {
-	b := NewBriefcase(defaultCrowdIDMethod)
+	b := NewBriefcase(defaultCrowdIDStrategy)
 
 	for i := 0; i < reports; i++ {
 		b.Add([]Report{
@@ -114,3 +115,49 @@ func TestShuffleAndEmpty(t *testing.T) {
 		}
 	}
 }
+
+func TestRedactFewerThan(t *testing.T) {
+	var m P3AMeasurement
+	if err := json.Unmarshal([]byte(testMeasurement), &m); err != nil {
+		t.Fatalf("Failed to unmarshal measurement: %s", err)
+	}
+	other := m
+	other.CountryCode = "CA"
+	another := other
+	another.WeekOfInstall = 4
+	different := m
+	different.MetricValue = 1
+	b := NewBriefcase(strategyMinimal)
+	b.Add([]Report{m, m, m, other, another, different, &DummyReport{crowdID: CrowdID("foo")}})
+
+	b.RedactFewerThan(3)
+	// The dummy report is dumped because its crowd is too small, and the
+	// remaining measurements all share the metric name.
+	reports := b.AllReports()
+	if len(reports) != 6 {
+		t.Fatalf("Expected 6 reports but got %d.", len(reports))
+	}
+	numFull, lengths := 0, make(map[int]int)
+	for _, r := range reports {
+		switch r := r.(type) {
+		case P3AMeasurement:
+			numFull++
+		case *PartialMeasurement:
+			lengths[len(r.Attributes)]++
+			if len(r.Attributes)+len(r.Redacted) != len(strategyMinimal.AttributeNames()) {
+				t.Fatalf("Partial measurement lacks attributes: %v", r)
+			}
+			if _, exists := r.Attributes["country_code"]; exists {
+				t.Fatalf("Partial measurement reveals its country: %v", r)
+			}
+		default:
+			t.Fatalf("Unexpected report: %v", r)
+		}
+	}
+	// Four measurements share the metric name, value, and week of install but
+	// only three share the country.  "another" has a different week of
+	// install, and "different" has a different metric value.
+	if numFull != 3 || lengths[3] != 1 || lengths[2] != 1 || lengths[1] != 1 {
+		t.Fatalf("Unexpected redaction: %d full, partial lengths %v", numFull, lengths)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+// This file builds the HTTP client that our HTTP-based sinks share.
+// Inside the enclave, all egress traffic must go through the SOCKS proxy that
+// nitriding sets up, so the client can dial all connections via that proxy.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// defaultForwardTimeout is the time limit for a single request to a sink,
+	// including reading the response body.
+	defaultForwardTimeout = time.Minute * 2
+	// defaultIdleConnTimeout determines how long idle keep-alive connections
+	// to sinks stay open.
+	defaultIdleConnTimeout = time.Second * 90
+)
+
+// ClientOption configures optional aspects of the HTTP client that our sinks
+// share.  The forwarder builds the client from the options that NewForwarder
+// is given, and hands it to the sinks' factories.
+type ClientOption func(*clientConfig)
+
+// clientConfig holds the settings of our sinks' HTTP client.
+type clientConfig struct {
+	client      *http.Client
+	timeout     time.Duration
+	rootCAs     *x509.CertPool
+	socksProxy  string
+	idleTimeout time.Duration
+	// overrides contains the names of the options that configure our own
+	// client, which a custom client would ignore.
+	overrides []string
+}
+
+// WithHTTPClient makes our sinks use the given HTTP client instead of our own.
+// It cannot be combined with the other client options.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *clientConfig) {
+		c.client = client
+	}
+}
+
+// WithTimeout sets the time limit for a single request to a sink.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.timeout = timeout
+		c.overrides = append(c.overrides, "WithTimeout")
+	}
+}
+
+// WithRootCAs makes our sinks only trust servers whose certificates chain to
+// the given roots, instead of the system's roots.
+func WithRootCAs(roots *x509.CertPool) ClientOption {
+	return func(c *clientConfig) {
+		c.rootCAs = roots
+		c.overrides = append(c.overrides, "WithRootCAs")
+	}
+}
+
+// WithSOCKSProxy makes our sinks dial all connections via the SOCKS proxy at
+// the given URL, e.g. socks5://127.0.0.1:1080.  Host names are resolved by
+// the proxy.
+func WithSOCKSProxy(proxyURL string) ClientOption {
+	return func(c *clientConfig) {
+		c.socksProxy = proxyURL
+		c.overrides = append(c.overrides, "WithSOCKSProxy")
+	}
+}
+
+// WithKeepAlive sets how long idle connections to sinks are kept open.  A
+// non-positive timeout disables keep-alives.
+func WithKeepAlive(idleTimeout time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.idleTimeout = idleTimeout
+		c.overrides = append(c.overrides, "WithKeepAlive")
+	}
+}
+
+// newHTTPClient returns the HTTP client that the given options describe,
+// which our sinks share.  Combining WithHTTPClient with other options is an
+// error because the custom client would silently ignore them.
+func newHTTPClient(opts ...ClientOption) (*http.Client, error) {
+	c := &clientConfig{
+		timeout:     defaultForwardTimeout,
+		idleTimeout: defaultIdleConnTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.client == nil {
+		return c.httpClient(), nil
+	}
+	if len(c.overrides) > 0 {
+		return nil, fmt.Errorf("custom HTTP client cannot be combined with %s", strings.Join(c.overrides, ", "))
+	}
+	return c.client, nil
+}
+
+// httpClient returns a new HTTP client with the configuration's settings.
+func (c *clientConfig) httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: c.rootCAs}
+	}
+	if c.idleTimeout > 0 {
+		transport.IdleConnTimeout = c.idleTimeout
+	} else {
+		transport.DisableKeepAlives = true
+	}
+	if c.socksProxy != "" {
+		// Our dialer already takes care of the proxy, so we must not pick up
+		// another one from the environment.
+		transport.Proxy = nil
+		transport.DialContext = socksDialer(c.socksProxy)
+	}
+	return &http.Client{Transport: transport, Timeout: c.timeout}
+}
+
+// socksDialer returns a dial function that connects via the SOCKS proxy at the
+// given URL.  If the proxy URL is unusable, the dial function fails, so that
+// we never fall back to connecting directly.
+func socksDialer(proxyURL string) func(context.Context, string, string) (net.Conn, error) {
+	dialer, err := newSOCKSDialer(proxyURL)
+	if err != nil {
+		elog.Printf("Failed to configure SOCKS proxy: %v", err)
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS proxy is unusable: %w", err)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// newSOCKSDialer returns a dialer that connects via the SOCKS proxy at the
+// given URL.
+func newSOCKSDialer(proxyURL string) (proxy.ContextDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("dialer for %q doesn't support contexts", u.Scheme)
+	}
+	return cd, nil
+}
+
+// loadCertPool returns a pool that contains the PEM-encoded certificates in the
+// given file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("found no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// truncate shortens the given response body, so that we can include it in
+// our logs.
+func truncate(body []byte) string {
+	const maxLen = 256
+	if len(body) > maxLen {
+		return string(body[:maxLen]) + "..."
+	}
+	return string(body)
+}
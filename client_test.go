@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socksServer runs a minimal SOCKS5 proxy that supports unauthenticated
+// CONNECT requests, and sends the target address of each request to the
+// returned channel.
+func socksServer(t *testing.T) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, err := socksHandshake(conn)
+				if err != nil {
+					return
+				}
+				targets <- target
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l, targets
+}
+
+// socksHandshake performs the server side of a SOCKS5 handshake and returns
+// the client's target address.
+func socksHandshake(conn net.Conn) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", err
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[0]]); err != nil {
+			return "", err
+		}
+		host = string(buf[:buf[0]])
+	default:
+		return "", fmt.Errorf("unsupported address type %d", buf[3])
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port)), nil
+}
+
+func TestClientOptions(t *testing.T) {
+	roots := x509.NewCertPool()
+	client, err := newHTTPClient(
+		WithTimeout(time.Second),
+		WithRootCAs(roots),
+		WithKeepAlive(0),
+		WithSOCKSProxy("socks5://127.0.0.1:1080"))
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %s", err)
+	}
+	transport := client.Transport.(*http.Transport)
+
+	if client.Timeout != time.Second {
+		t.Fatalf("Expected timeout of 1s but got %s.", client.Timeout)
+	}
+	if transport.TLSClientConfig.RootCAs != roots {
+		t.Fatal("Client doesn't use our root certificates.")
+	}
+	if !transport.DisableKeepAlives {
+		t.Fatal("Expected keep-alives to be disabled.")
+	}
+	if transport.Proxy != nil || transport.DialContext == nil {
+		t.Fatal("Client doesn't dial via our SOCKS proxy.")
+	}
+
+	custom := &http.Client{}
+	if client, err := newHTTPClient(WithHTTPClient(custom)); err != nil || client != custom {
+		t.Fatalf("Expected our custom HTTP client but got %v (%v).", client, err)
+	}
+	// A custom client would ignore all other options.
+	if _, err := newHTTPClient(WithHTTPClient(custom), WithTimeout(time.Second)); err == nil {
+		t.Fatal("Accepted custom HTTP client along with other client options.")
+	}
+}
+
+func TestSOCKSProxy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(ackHandler))
+	defer srv.Close()
+	l, targets := socksServer(t)
+	defer l.Close()
+
+	client, err := newHTTPClient(WithSOCKSProxy("socks5://" + l.Addr().String()))
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %s", err)
+	}
+	sink := newHTTPSink(srv.URL, contentTypeJSON, client)
+	defer sink.Close()
+	chunk := &Batch{ID: "foo", ChunkCount: 1, Reports: []Report{P3AMeasurement{}}}
+	if err := sink.Send(chunk); err != nil {
+		t.Fatalf("Failed to send chunk via SOCKS proxy: %s", err)
+	}
+	select {
+	case target := <-targets:
+		if target != srv.Listener.Addr().String() {
+			t.Fatalf("Expected proxy target %s but got %s.", srv.Listener.Addr(), target)
+		}
+	default:
+		t.Fatal("Chunk wasn't sent via SOCKS proxy.")
+	}
+
+	// An unusable proxy must not make us connect directly.
+	client, _ = newHTTPClient(WithSOCKSProxy("foo://bar"))
+	sink = newHTTPSink(srv.URL, contentTypeJSON, client)
+	if err := sink.Send(chunk); err == nil {
+		t.Fatal("Expected sending via unusable SOCKS proxy to fail.")
+	}
+}
+
+func TestServerErrorBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "database unavailable"+strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+
+	sink := newHTTPSink(srv.URL, contentTypeJSON, http.DefaultClient)
+	err := sink.Send(&Batch{ID: "foo", ChunkCount: 1, Reports: []Report{P3AMeasurement{}}})
+	if err == nil {
+		t.Fatal("Expected error for HTTP 500.")
+	}
+	if !strings.Contains(err.Error(), "database unavailable") || len(err.Error()) > 512 {
+		t.Fatalf("Expected error to contain truncated response body but got: %s", err)
+	}
+}
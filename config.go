@@ -0,0 +1,759 @@
+package main
+
+// This file implements the configuration of deployment mode.  Settings are
+// taken from (in increasing order of precedence) our defaults, an optional
+// JSON- or YAML-encoded configuration file, environment variables, and command
+// line flags.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brave-experiments/nitriding"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// envPrefix is prepended to the (upper-cased) name of a setting to obtain
+	// the environment variable that overrides the setting, e.g.
+	// P3A_SHUFFLER_ANALYZER_URL overrides analyzer-url.
+	envPrefix = "P3A_SHUFFLER_"
+	// Our aggregation modes: "crowd" dumps crowds that don't meet our
+	// anonymity threshold and "nested" redacts the attributes of measurements
+	// that don't meet it.
+	aggregationCrowd  = "crowd"
+	aggregationNested = "nested"
+	// defaultDrainTimeout determines how long we try to forward remaining
+	// reports when we're asked to shut down.
+	defaultDrainTimeout = time.Minute * 2
+)
+
+// duration wraps time.Duration, so we can use strings like "24h" in our JSON
+// configuration file.
+type duration time.Duration
+
+// UnmarshalJSON parses the given JSON string as a Go duration.
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"24h\": %w", err)
+	}
+	return d.set(s)
+}
+
+// set parses the given string as a Go duration.
+func (d *duration) set(value string) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// MarshalJSON returns the duration as JSON string.
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// deploymentConfig represents the configuration of deployment mode.
+type deploymentConfig struct {
+	AnalyzerURL              string                   `json:"analyzer_url"`
+	BatchContentType         string                   `json:"batch_content_type"`
+	ChunkSize                int                      `json:"chunk_size"`
+	Sinks                    []*sinkConfig            `json:"sinks"`
+	ForwardTimeout           duration                 `json:"forward_timeout"`
+	ForwardCAFile            string                   `json:"forward_ca_file"`
+	BatchPeriod              duration                 `json:"batch_period"`
+	AnonymityThreshold       int                      `json:"anonymity_threshold"`
+	CrowdIDMethod            string                   `json:"crowd_id_method"`
+	CrowdIDStrategies        []*crowdIDStrategyConfig `json:"crowd_id_strategies"`
+	Aggregation              string                   `json:"aggregation"`
+	ThresholdPolicy          []*thresholdRuleConfig   `json:"threshold_policy"`
+	NoiseMechanism           string                   `json:"noise_mechanism"`
+	NoiseEpsilon             float64                  `json:"noise_epsilon"`
+	NoiseDelta               float64                  `json:"noise_delta"`
+	DropFraction             float64                  `json:"drop_fraction"`
+	LatestVersions           map[string]string        `json:"latest_versions"`
+	ReleaseManifest          string                   `json:"release_manifest"`
+	ReleaseManifestKey       string                   `json:"release_manifest_key"`
+	ManifestInterval         duration                 `json:"release_manifest_interval"`
+	ManifestMinIssued        string                   `json:"release_manifest_min_issued"`
+	SOCKSProxy               string                   `json:"socks_proxy"`
+	FQDN                     string                   `json:"fqdn"`
+	Port                     int                      `json:"port"`
+	Debug                    bool                     `json:"debug"`
+	UseACME                  bool                     `json:"use_acme"`
+	MaxBodyBytes             int64                    `json:"max_body_bytes"`
+	MaxMeasurements          int                      `json:"max_measurements"`
+	InboxSize                int                      `json:"inbox_size"`
+	InboxTimeout             duration                 `json:"inbox_timeout"`
+	RetryAfter               duration                 `json:"retry_after"`
+	SnapshotPath             string                   `json:"snapshot_path"`
+	SnapshotKeyFile          string                   `json:"snapshot_key_file"`
+	AllowInsecureSnapshotKey bool                     `json:"allow_insecure_snapshot_key"`
+	SnapshotKMSKeyFile       string                   `json:"snapshot_kms_key_file"`
+	SnapshotCounter          string                   `json:"snapshot_counter_table"`
+	SnapshotCounterCredsFile string                   `json:"snapshot_counter_credentials_file"`
+	AWSRegion                string                   `json:"aws_region"`
+	SnapshotInterval         duration                 `json:"snapshot_interval"`
+	DrainTimeout             duration                 `json:"drain_timeout"`
+
+	// registry contains our built-in crowd ID strategies and the ones that
+	// are defined in CrowdIDStrategies.  It's set by loadDeploymentConfig.
+	registry *strategyRegistry
+}
+
+// deploymentFlags contains the names and descriptions of all command line
+// flags that override settings in deploymentConfig.
+var deploymentFlags = []struct {
+	name  string
+	usage string
+}{
+	{"analyzer-url", "URL of the analyzer that shuffled reports are forwarded to."},
+	{"batch-content-type", "Content type that batches are forwarded in: \"application/json\" or \"application/cbor\"."},
+	{"chunk-size", "Maximum number of reports per chunk that is forwarded to the analyzer."},
+	{"forward-timeout", "Time limit for a single request to a sink, e.g. \"2m\"."},
+	{"forward-ca-file", "File containing the PEM-encoded root certificates that sinks' certificates must chain to.  The system's roots are used if empty."},
+	{"batch-period", "Duration of a batch period, e.g. \"24h\"."},
+	{"threshold", "k-anonymity threshold that crowds must meet.  In simulation mode, the single threshold to simulate."},
+	{"crowdid", "Crowd ID strategy, e.g. \"all\", \"refactored\", \"minimal\", or a strategy from the configuration file.  In simulation mode, a comma-separated list of strategies to simulate."},
+	{"aggregation", "Aggregation mode: \"crowd\" dumps crowds that don't meet the threshold and \"nested\" forwards the longest attribute prefix that does."},
+	{"noise-mechanism", "Noise that is added to crowd sizes before thresholding: \"laplace\", \"gaussian\", or empty for none."},
+	{"noise-epsilon", "Privacy parameter epsilon of the noise mechanism, per batch period."},
+	{"noise-delta", "Privacy parameter delta of the Gaussian noise mechanism, per batch period."},
+	{"drop-fraction", "Fraction of reports that are randomly dropped before thresholding, in [0, 1)."},
+	{"release-manifest", "File containing the signed release manifest.  Versions are learned from measurements if empty."},
+	{"release-manifest-key", "Hex-encoded Ed25519 public key that release manifests must be signed with."},
+	{"release-manifest-interval", "How often the release manifest is re-read, e.g. \"1h\"."},
+	{"release-manifest-min-issued", "Earliest issue time of release manifests that are accepted, in RFC 3339 format, e.g. \"2022-04-01T00:00:00Z\".  Required if a release manifest is used."},
+	{"socks-proxy", "URL of the SOCKS proxy that the enclave uses for egress traffic."},
+	{"fqdn", "Fully qualified domain name of the enclave."},
+	{"port", "TCP port that the enclave's Web server listens on."},
+	{"debug", "Enable debug mode (\"true\" or \"false\")."},
+	{"use-acme", "Obtain an HTTPS certificate via ACME (\"true\" or \"false\")."},
+	{"max-body-bytes", "Maximum size of a request body, in bytes."},
+	{"max-measurements", "Maximum number of P3A measurements per request."},
+	{"inbox-size", "Number of requests that the shuffler's inbox buffers."},
+	{"inbox-timeout", "How long requests wait for a full inbox before they fail with HTTP 503, e.g. \"1s\"."},
+	{"retry-after", "Delay that clients are asked to wait when the inbox is full, e.g. \"1m\"."},
+	{"snapshot-path", "File to which encrypted briefcase snapshots are written.  Snapshots are disabled if empty."},
+	{"snapshot-key-file", "File containing the hex-encoded 32-byte key that encrypts snapshots.  Requires allow-insecure-snapshot-key."},
+	{"allow-insecure-snapshot-key", "Allow a snapshot key file that the host can read, for testing only (\"true\" or \"false\")."},
+	{"snapshot-kms-key-file", "File containing the Base64-encoded KMS ciphertext of the key that encrypts snapshots."},
+	{"snapshot-counter-table", "DynamoDB table that holds the counter that protects snapshots from being rolled back."},
+	{"snapshot-counter-credentials-file", "File containing the Base64-encoded KMS ciphertext of the AWS credentials that may write to the snapshot counter table."},
+	{"aws-region", "AWS region of KMS and DynamoDB, e.g. \"us-west-2\"."},
+	{"snapshot-interval", "How often a briefcase snapshot is written, e.g. \"5m\"."},
+	{"drain-timeout", "How long we try to forward remaining reports upon SIGTERM, e.g. \"2m\"."},
+}
+
+// defaultDeploymentConfig returns the configuration that we use in the
+// absence of any other settings.
+func defaultDeploymentConfig() *deploymentConfig {
+	return &deploymentConfig{
+		AnalyzerURL:        "https://example.com",
+		BatchContentType:   contentTypeJSON,
+		ChunkSize:          defaultChunkSize,
+		ForwardTimeout:     duration(defaultForwardTimeout),
+		BatchPeriod:        duration(batchPeriod),
+		AnonymityThreshold: anonymityThreshold,
+		CrowdIDMethod:      strings.ToLower(defaultCrowdIDStrategy.Name()),
+		Aggregation:        aggregationCrowd,
+		ManifestInterval:   duration(defaultManifestInterval),
+		SOCKSProxy:         "socks5://127.0.0.1:1080",
+		FQDN:               "nitro.nymity.ch",
+		Port:               8080,
+		Debug:              true,
+		UseACME:            false,
+		MaxBodyBytes:       defaultMaxBodyBytes,
+		MaxMeasurements:    defaultMaxMeasurements,
+		InboxSize:          defaultInboxSize,
+		InboxTimeout:       duration(defaultInboxTimeout),
+		RetryAfter:         duration(defaultRetryAfter),
+		SnapshotInterval:   duration(defaultSnapshotInterval),
+		DrainTimeout:       duration(defaultDrainTimeout),
+	}
+}
+
+// registerDeploymentFlags registers the command line flags that override the
+// settings of our deployment configuration.  All flags are parsed as strings
+// and only take effect if they are set explicitly.
+func registerDeploymentFlags(fs *flag.FlagSet) {
+	for _, f := range deploymentFlags {
+		fs.String(f.name, "", f.usage)
+	}
+}
+
+// loadDeploymentConfig returns our deployment configuration.  It starts with
+// our defaults, then applies the given configuration file (if any),
+// environment variables, and finally the flags that were set in the given flag
+// set.  The resulting configuration is validated.
+func loadDeploymentConfig(filename string, fs *flag.FlagSet) (*deploymentConfig, error) {
+	cfg := defaultDeploymentConfig()
+
+	if filename != "" {
+		if err := decodeConfigFile(filename, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range deploymentFlags {
+		envName := envPrefix + strings.ToUpper(strings.ReplaceAll(f.name, "-", "_"))
+		if value, exists := os.LookupEnv(envName); exists {
+			if err := cfg.set(f.name, value); err != nil {
+				return nil, fmt.Errorf("bad environment variable %s: %w", envName, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil || !isDeploymentFlag(f.Name) {
+			return
+		}
+		if e := cfg.set(f.Name, f.Value.String()); e != nil {
+			err = fmt.Errorf("bad flag -%s: %w", f.Name, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.registry, err = cfg.strategyRegistry(); err != nil {
+		return nil, err
+	}
+	for channel, v := range cfg.LatestVersions {
+		if err := versions.Seed(channel, v); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// loadSimulationConfig returns the crowd ID strategies and the threshold
+// policy that the given configuration file defines.  Simulation mode ignores
+// all other settings, so unlike loadDeploymentConfig, we neither apply
+// environment variables and flags nor validate the other settings.  The
+// returned policy is nil if the file defines no threshold policy.
+func loadSimulationConfig(filename string) (*strategyRegistry, *thresholdPolicy, error) {
+	cfg := defaultDeploymentConfig()
+	if err := decodeConfigFile(filename, cfg); err != nil {
+		return nil, nil, err
+	}
+	if problems := cfg.strategyProblems(); len(problems) > 0 {
+		return nil, nil, fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	registry, err := cfg.strategyRegistry()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cfg.ThresholdPolicy) == 0 {
+		return registry, nil, nil
+	}
+	policy, err := newThresholdPolicy(cfg.ThresholdPolicy, registry)
+	if err != nil {
+		return nil, nil, err
+	}
+	return registry, policy, nil
+}
+
+// decodeConfigFile decodes the given configuration file into the given
+// configuration.  Files whose name ends in .yaml or .yml are parsed as YAML and
+// all others as JSON.  YAML is converted to JSON first, so both formats use the
+// same field names and the same rules.
+func decodeConfigFile(filename string, cfg *deploymentConfig) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open configuration file: %w", err)
+	}
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return fmt.Errorf("failed to parse configuration file %s: %w", filename, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse configuration file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// yamlToJSON converts the given YAML document to JSON.  Mappings must only
+// have string keys.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		// An empty document doesn't change any settings.
+		return []byte("{}"), nil
+	}
+	return json.Marshal(v)
+}
+
+// isDeploymentFlag returns true if the given flag name overrides a setting of
+// our deployment configuration.
+func isDeploymentFlag(name string) bool {
+	for _, f := range deploymentFlags {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// set sets the setting of the given name to the given (string-encoded) value.
+func (c *deploymentConfig) set(name, value string) error {
+	var err error
+	switch name {
+	case "analyzer-url":
+		c.AnalyzerURL = value
+	case "batch-content-type":
+		c.BatchContentType = value
+	case "chunk-size":
+		c.ChunkSize, err = strconv.Atoi(value)
+	case "forward-timeout":
+		err = c.ForwardTimeout.set(value)
+	case "forward-ca-file":
+		c.ForwardCAFile = value
+	case "batch-period":
+		err = c.BatchPeriod.set(value)
+	case "threshold":
+		c.AnonymityThreshold, err = strconv.Atoi(value)
+	case "crowdid":
+		c.CrowdIDMethod = value
+	case "aggregation":
+		c.Aggregation = value
+	case "noise-mechanism":
+		c.NoiseMechanism = value
+	case "noise-epsilon":
+		c.NoiseEpsilon, err = strconv.ParseFloat(value, 64)
+	case "noise-delta":
+		c.NoiseDelta, err = strconv.ParseFloat(value, 64)
+	case "drop-fraction":
+		c.DropFraction, err = strconv.ParseFloat(value, 64)
+	case "release-manifest":
+		c.ReleaseManifest = value
+	case "release-manifest-key":
+		c.ReleaseManifestKey = value
+	case "release-manifest-interval":
+		err = c.ManifestInterval.set(value)
+	case "release-manifest-min-issued":
+		c.ManifestMinIssued = value
+	case "socks-proxy":
+		c.SOCKSProxy = value
+	case "fqdn":
+		c.FQDN = value
+	case "port":
+		c.Port, err = strconv.Atoi(value)
+	case "debug":
+		c.Debug, err = strconv.ParseBool(value)
+	case "use-acme":
+		c.UseACME, err = strconv.ParseBool(value)
+	case "max-body-bytes":
+		c.MaxBodyBytes, err = strconv.ParseInt(value, 10, 64)
+	case "max-measurements":
+		c.MaxMeasurements, err = strconv.Atoi(value)
+	case "inbox-size":
+		c.InboxSize, err = strconv.Atoi(value)
+	case "inbox-timeout":
+		err = c.InboxTimeout.set(value)
+	case "retry-after":
+		err = c.RetryAfter.set(value)
+	case "snapshot-path":
+		c.SnapshotPath = value
+	case "snapshot-key-file":
+		c.SnapshotKeyFile = value
+	case "allow-insecure-snapshot-key":
+		c.AllowInsecureSnapshotKey, err = strconv.ParseBool(value)
+	case "snapshot-kms-key-file":
+		c.SnapshotKMSKeyFile = value
+	case "snapshot-counter-table":
+		c.SnapshotCounter = value
+	case "snapshot-counter-credentials-file":
+		c.SnapshotCounterCredsFile = value
+	case "aws-region":
+		c.AWSRegion = value
+	case "snapshot-interval":
+		err = c.SnapshotInterval.set(value)
+	case "drain-timeout":
+		err = c.DrainTimeout.set(value)
+	default:
+		err = fmt.Errorf("unknown setting %q", name)
+	}
+	return err
+}
+
+// validate returns an error that lists every problem with the configuration,
+// or nil if the configuration is valid.
+func (c *deploymentConfig) validate() error {
+	var problems []string
+	addProblem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if u, err := url.Parse(c.AnalyzerURL); err != nil {
+		addProblem("analyzer URL %q is not a URL: %s", c.AnalyzerURL, err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		addProblem("analyzer URL %q must be an absolute http(s) URL", c.AnalyzerURL)
+	}
+	if c.BatchPeriod <= 0 {
+		addProblem("batch period must be positive but is %s", time.Duration(c.BatchPeriod))
+	}
+	if c.AnonymityThreshold < 1 {
+		addProblem("anonymity threshold must be at least 1 but is %d", c.AnonymityThreshold)
+	}
+	problems = append(problems, c.strategyProblems()...)
+	for _, rc := range c.ThresholdPolicy {
+		if rc.Threshold < c.AnonymityThreshold {
+			addProblem("threshold of pattern %q must not be below the anonymity threshold %d but is %d",
+				rc.Pattern, c.AnonymityThreshold, rc.Threshold)
+		}
+	}
+	if !isSupportedContentType(c.BatchContentType) {
+		addProblem("batch content type must be %q or %q but is %q", contentTypeJSON, contentTypeCBOR, c.BatchContentType)
+	}
+	sinkNames := make(map[string]bool)
+	for _, sc := range c.Sinks {
+		if err := sc.validate(); err != nil {
+			addProblem("%s", err)
+		}
+		if sinkNames[sc.name()] {
+			addProblem("sink name %q is not unique", sc.name())
+		}
+		sinkNames[sc.name()] = true
+	}
+	if c.ChunkSize < 1 {
+		addProblem("chunk size must be at least 1 but is %d", c.ChunkSize)
+	}
+	if c.ForwardTimeout <= 0 {
+		addProblem("forward timeout must be positive but is %s", time.Duration(c.ForwardTimeout))
+	}
+	if c.Aggregation != aggregationCrowd && c.Aggregation != aggregationNested {
+		addProblem("aggregation mode must be %q or %q but is %q", aggregationCrowd, aggregationNested, c.Aggregation)
+	}
+	if noise := c.noiseConfig(); noise.enabled() {
+		if err := noise.validate(); err != nil {
+			addProblem("%s", err)
+		}
+		if c.Aggregation != aggregationCrowd {
+			addProblem("noisy thresholding requires aggregation mode %q", aggregationCrowd)
+		}
+	}
+	for channel, v := range c.LatestVersions {
+		if _, err := parseVersion(v); err != nil {
+			addProblem("latest version of channel %q is invalid: %s", channel, err)
+		}
+	}
+	if c.ReleaseManifest != "" {
+		if _, err := parseReleaseManifestKey(c.ReleaseManifestKey); err != nil {
+			addProblem("%s", err)
+		}
+		if c.ManifestInterval <= 0 {
+			addProblem("release manifest interval must be positive but is %s", time.Duration(c.ManifestInterval))
+		}
+		// Without a minimum, a restarted shuffler would accept any validly
+		// signed manifest, no matter how old.
+		if c.ManifestMinIssued == "" {
+			addProblem("release manifest requires a minimum issue time")
+		} else if _, err := time.Parse(time.RFC3339, c.ManifestMinIssued); err != nil {
+			addProblem("minimum issue time of release manifest is invalid: %s", err)
+		}
+	}
+	if c.SOCKSProxy != "" {
+		if u, err := url.Parse(c.SOCKSProxy); err != nil || u.Scheme != "socks5" || u.Host == "" {
+			addProblem("SOCKS proxy %q must be of the form socks5://host:port", c.SOCKSProxy)
+		}
+	}
+	if c.FQDN == "" {
+		addProblem("FQDN must not be empty")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		addProblem("port must be in [1, 65535] but is %d", c.Port)
+	}
+	if c.MaxBodyBytes < 1 {
+		addProblem("maximum body size must be positive but is %d", c.MaxBodyBytes)
+	}
+	if c.MaxMeasurements < 1 {
+		addProblem("maximum number of measurements must be positive but is %d", c.MaxMeasurements)
+	}
+	if c.InboxSize < 0 {
+		addProblem("inbox size must not be negative but is %d", c.InboxSize)
+	}
+	if c.InboxTimeout <= 0 {
+		addProblem("inbox timeout must be positive but is %s", time.Duration(c.InboxTimeout))
+	}
+	if c.RetryAfter < duration(time.Second) {
+		addProblem("retry-after must be at least 1s but is %s", time.Duration(c.RetryAfter))
+	}
+	if c.SnapshotPath != "" {
+		switch {
+		case c.SnapshotKMSKeyFile != "" && c.SnapshotKeyFile != "":
+			addProblem("snapshot KMS key file and snapshot key file are mutually exclusive")
+		case c.SnapshotKMSKeyFile != "":
+			if _, err := readKMSCiphertext(c.SnapshotKMSKeyFile); err != nil {
+				addProblem("failed to read snapshot KMS key: %s", err)
+			}
+			if c.SnapshotCounter == "" {
+				addProblem("snapshots require a snapshot counter table")
+			}
+			// The host controls our environment, so the credentials that can
+			// write to the counter must come from KMS.
+			if c.SnapshotCounterCredsFile == "" {
+				addProblem("snapshots require a snapshot counter credentials file")
+			} else if _, err := readKMSCiphertext(c.SnapshotCounterCredsFile); err != nil {
+				addProblem("failed to read snapshot counter credentials: %s", err)
+			}
+			if c.AWSRegion == "" {
+				addProblem("snapshots require an AWS region")
+			}
+		case c.SnapshotKeyFile != "":
+			// The host can read the key file and roll back the counter file, so
+			// they only protect snapshots from accidents.  Unlike debug mode,
+			// which is on by default, this must be enabled explicitly.
+			if !c.AllowInsecureSnapshotKey {
+				addProblem("snapshot key file requires allow_insecure_snapshot_key; use a snapshot KMS key file")
+			}
+			if key, err := readSnapshotKey(c.SnapshotKeyFile); err != nil {
+				addProblem("failed to read snapshot key: %s", err)
+			} else if len(key) != snapshotKeyLen {
+				addProblem("snapshot key must be %d bytes but is %d", snapshotKeyLen, len(key))
+			}
+		default:
+			addProblem("snapshots require a snapshot KMS key file")
+		}
+		if c.SnapshotInterval <= 0 {
+			addProblem("snapshot interval must be positive but is %s", time.Duration(c.SnapshotInterval))
+		}
+	}
+	if c.DrainTimeout <= 0 {
+		addProblem("drain timeout must be positive but is %s", time.Duration(c.DrainTimeout))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// strategyProblems returns the problems with our crowd ID strategies, our
+// crowd ID method, and our threshold policy.  Simulation mode only uses these
+// settings, so they are validated separately.
+func (c *deploymentConfig) strategyProblems() []string {
+	var problems []string
+	addProblem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	names := make(map[string]bool)
+	for _, sc := range c.CrowdIDStrategies {
+		if _, err := newAttributeStrategy(sc); err != nil {
+			addProblem("%s", err)
+		} else if strategies.IsBuiltin(sc.Name) {
+			addProblem("crowd ID strategy %q shadows built-in strategy", sc.Name)
+		} else if names[strings.ToLower(sc.Name)] {
+			addProblem("crowd ID strategy %q is defined more than once", sc.Name)
+		}
+		names[strings.ToLower(sc.Name)] = true
+	}
+	if _, err := strategies.Lookup(c.CrowdIDMethod); err != nil && !names[strings.ToLower(c.CrowdIDMethod)] {
+		addProblem("%s", err)
+	}
+	for _, rc := range c.ThresholdPolicy {
+		if err := rc.validate(); err != nil {
+			addProblem("%s", err)
+		} else if rc.Strategy != "" {
+			if _, err := strategies.Lookup(rc.Strategy); err != nil && !names[strings.ToLower(rc.Strategy)] {
+				addProblem("threshold policy for pattern %q: %s", rc.Pattern, err)
+			}
+		}
+	}
+	return problems
+}
+
+// strategyRegistry returns a registry that contains our built-in crowd ID
+// strategies and the ones that our configuration defines.
+func (c *deploymentConfig) strategyRegistry() (*strategyRegistry, error) {
+	registry := newStrategyRegistry()
+	for _, sc := range c.CrowdIDStrategies {
+		s, err := newAttributeStrategy(sc)
+		if err != nil {
+			return nil, err
+		}
+		if err := registry.Register(s); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// crowdIDStrategy returns the configured crowd ID strategy.  The
+// configuration must have been loaded via loadDeploymentConfig.
+func (c *deploymentConfig) crowdIDStrategy() CrowdIDStrategy {
+	s, err := c.registry.Lookup(c.CrowdIDMethod)
+	if err != nil {
+		elog.Fatalf("Configuration refers to unknown crowd ID strategy: %s", err)
+	}
+	return s
+}
+
+// shufflerOptions returns the options for our shuffler.
+func (c *deploymentConfig) shufflerOptions() ([]ShufflerOption, error) {
+	opts := []ShufflerOption{WithInboxSize(c.InboxSize)}
+	if c.Aggregation == aggregationNested {
+		opts = append(opts, WithNestedAggregation())
+	}
+	if len(c.ThresholdPolicy) > 0 {
+		policy, err := c.thresholdPolicy()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithThresholdPolicy(policy))
+	}
+	if noise := c.noiseConfig(); noise.enabled() {
+		n, err := newNoisyThreshold(noise)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithNoisyThreshold(n))
+	}
+	if c.ReleaseManifest != "" {
+		// Our manifest loader stages new manifests in our global version
+		// tracker, and the shuffler applies them between batch periods.
+		opts = append(opts, WithVersionTracker(versions))
+	}
+	if c.SnapshotPath == "" {
+		return opts, nil
+	}
+
+	// A snapshot that's older than a batch period belongs to a batch period
+	// that should have ended long ago.
+	maxAge := time.Duration(c.BatchPeriod)
+	var snapshots *snapshotter
+	if c.SnapshotKMSKeyFile == "" {
+		key := func() ([]byte, error) { return readSnapshotKey(c.SnapshotKeyFile) }
+		counter := &fileCounter{path: c.SnapshotPath + ".counter"}
+		snapshots = newSnapshotter(c.SnapshotPath, key, counter, maxAge)
+	} else {
+		keyCiphertext, err := readKMSCiphertext(c.SnapshotKMSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		credsCiphertext, err := readKMSCiphertext(c.SnapshotCounterCredsFile)
+		if err != nil {
+			return nil, err
+		}
+		// Like the forwarder, we reach AWS via the enclave's SOCKS proxy.
+		client := (&clientConfig{
+			timeout:     defaultForwardTimeout,
+			idleTimeout: defaultIdleConnTimeout,
+			socksProxy:  c.SOCKSProxy,
+		}).httpClient()
+		// The host's credentials only get us to KMS, whose key policy only
+		// decrypts for our enclave.  The counter's credentials are among the
+		// things that KMS decrypts for us.
+		decrypter := newKMSDecrypter(awsConfig(c.AWSRegion, envAWSCredentials().provider(), client), nsmAttestKey)
+		counterCfg := awsConfig(c.AWSRegion, decrypter.credentials(credsCiphertext), client)
+		counter := newDynamoCounter(counterCfg, c.SnapshotCounter, c.FQDN)
+		snapshots = newSnapshotter(c.SnapshotPath, decrypter.key(keyCiphertext), counter, maxAge)
+	}
+	return append(opts, WithSnapshots(snapshots, time.Duration(c.SnapshotInterval))), nil
+}
+
+// sinks returns the factories of the sinks that the forwarder forwards to,
+// which derive their HTTP clients from the forwarder's client.  If no sinks
+// are configured, we only forward to the analyzer.
+func (c *deploymentConfig) sinks(signer *batchSigner) []SinkFactory {
+	cfgs := c.Sinks
+	if len(cfgs) == 0 {
+		cfgs = []*sinkConfig{{Type: sinkHTTP, URL: c.AnalyzerURL, Timeout: c.ForwardTimeout}}
+	}
+	var factories []SinkFactory
+	for _, sc := range cfgs {
+		factories = append(factories, sc.factory(c.BatchContentType, signer))
+	}
+	return factories
+}
+
+// clientOptions returns the options of the HTTP client that our sinks share.
+// Unless we're configured without a SOCKS proxy, the client dials all
+// connections via the proxy, like the rest of the enclave's egress traffic.
+func (c *deploymentConfig) clientOptions() ([]ClientOption, error) {
+	opts := []ClientOption{WithTimeout(time.Duration(c.ForwardTimeout))}
+	if c.SOCKSProxy != "" {
+		opts = append(opts, WithSOCKSProxy(c.SOCKSProxy))
+	}
+	if c.ForwardCAFile != "" {
+		roots, err := loadCertPool(c.ForwardCAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithRootCAs(roots))
+	}
+	return opts, nil
+}
+
+// thresholdPolicy returns our threshold policy.  The configuration must have
+// been loaded via loadDeploymentConfig, so that the policy's strategies are in
+// our registry.
+func (c *deploymentConfig) thresholdPolicy() (*thresholdPolicy, error) {
+	return newThresholdPolicy(c.ThresholdPolicy, c.registry)
+}
+
+// noiseConfig returns the configuration of noisy thresholding.
+func (c *deploymentConfig) noiseConfig() *noiseConfig {
+	return &noiseConfig{
+		Mechanism:    c.NoiseMechanism,
+		Epsilon:      c.NoiseEpsilon,
+		Delta:        c.NoiseDelta,
+		DropFraction: c.DropFraction,
+	}
+}
+
+// manifestLoader returns a loader for our release manifest, or nil if we
+// don't use a release manifest.
+func (c *deploymentConfig) manifestLoader() *manifestLoader {
+	if c.ReleaseManifest == "" {
+		return nil
+	}
+	// The key and the minimum issue time were already checked when the
+	// configuration was validated.
+	pubKey, _ := parseReleaseManifestKey(c.ReleaseManifestKey)
+	minIssued, _ := time.Parse(time.RFC3339, c.ManifestMinIssued)
+	return newManifestLoader(c.ReleaseManifest, pubKey, versions, time.Duration(c.ManifestInterval), minIssued)
+}
+
+// handlerConfig returns the configuration for our Web API handlers.
+func (c *deploymentConfig) handlerConfig() *handlerConfig {
+	return &handlerConfig{
+		MaxBodyBytes:    c.MaxBodyBytes,
+		MaxMeasurements: c.MaxMeasurements,
+		InboxTimeout:    time.Duration(c.InboxTimeout),
+		RetryAfter:      time.Duration(c.RetryAfter),
+	}
+}
+
+// enclaveConfig returns the configuration for our nitriding enclave.
+func (c *deploymentConfig) enclaveConfig() *nitriding.Config {
+	return &nitriding.Config{
+		SOCKSProxy: c.SOCKSProxy,
+		FQDN:       c.FQDN,
+		Port:       c.Port,
+		Debug:      c.Debug,
+		UseACME:    c.UseACME,
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write configuration file: %s", err)
+	}
+	return filename
+}
+
+func TestYAMLConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	content := "analyzer_url: https://analyzer.example.com\nbatch_period: 1h\nsinks:\n  - type: stdout\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write configuration file: %s", err)
+	}
+	cfg, err := loadDeploymentConfig(filename, flag.NewFlagSet("test", flag.ContinueOnError))
+	if err != nil {
+		t.Fatalf("Failed to load YAML configuration: %s", err)
+	}
+	if cfg.AnalyzerURL != "https://analyzer.example.com" || time.Duration(cfg.BatchPeriod) != time.Hour || len(cfg.Sinks) != 1 {
+		t.Fatalf("Unexpected YAML configuration: %+v", cfg)
+	}
+
+	if err := os.WriteFile(filename, []byte("foo: bar\n"), 0600); err != nil {
+		t.Fatalf("Failed to write configuration file: %s", err)
+	}
+	if _, err := loadDeploymentConfig(filename, flag.NewFlagSet("test", flag.ContinueOnError)); err == nil {
+		t.Fatal("Accepted YAML configuration with unknown setting.")
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := defaultDeploymentConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Default configuration is invalid: %s", err)
+	}
+	// Without configured sinks, we forward to the analyzer with our forward
+	// timeout.
+	factories := cfg.sinks(nil)
+	if len(factories) != 1 {
+		t.Fatalf("Expected 1 default sink but got %d.", len(factories))
+	}
+	sink, err := factories[0](http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create default sink: %s", err)
+	}
+	if s, ok := sink.(*httpSink); !ok || s.client.Timeout != time.Duration(cfg.ForwardTimeout) {
+		t.Fatalf("Expected HTTP sink with timeout %s but got %+v.", time.Duration(cfg.ForwardTimeout), sink)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	filename := writeConfigFile(t, `{
+		"analyzer_url": "https://analyzer.example.com",
+		"batch_period": "1h",
+		"anonymity_threshold": 20,
+		"crowd_id_method": "minimal",
+		"port": 8443
+	}`)
+	t.Setenv("P3A_SHUFFLER_THRESHOLD", "30")
+	t.Setenv("P3A_SHUFFLER_PORT", "9000")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerDeploymentFlags(fs)
+	if err := fs.Parse([]string{"-port", "9090", "-crowdid", "1"}); err != nil {
+		t.Fatalf("Failed to parse flags: %s", err)
+	}
+
+	cfg, err := loadDeploymentConfig(filename, fs)
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %s", err)
+	}
+	// Set in file.
+	if cfg.AnalyzerURL != "https://analyzer.example.com" {
+		t.Fatalf("Unexpected analyzer URL %q.", cfg.AnalyzerURL)
+	}
+	if time.Duration(cfg.BatchPeriod) != time.Hour {
+		t.Fatalf("Unexpected batch period %s.", time.Duration(cfg.BatchPeriod))
+	}
+	// Set in file and overridden by environment variable.
+	if cfg.AnonymityThreshold != 30 {
+		t.Fatalf("Unexpected anonymity threshold %d.", cfg.AnonymityThreshold)
+	}
+	// Set in file and environment variable, and overridden by flag.
+	if cfg.Port != 9090 {
+		t.Fatalf("Unexpected port %d.", cfg.Port)
+	}
+	if cfg.crowdIDStrategy() != strategyRefactored {
+		t.Fatalf("Unexpected crowd ID method %q.", cfg.CrowdIDMethod)
+	}
+	// Not set at all.
+	if cfg.FQDN != defaultDeploymentConfig().FQDN {
+		t.Fatalf("Unexpected FQDN %q.", cfg.FQDN)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerDeploymentFlags(fs)
+
+	_, err := loadDeploymentConfig(writeConfigFile(t, `{"unknown_setting": 1}`), fs)
+	if err == nil {
+		t.Fatal("Accepted configuration file with unknown setting.")
+	}
+	_, err = loadDeploymentConfig(writeConfigFile(t, `{"batch_period": 10}`), fs)
+	if err == nil {
+		t.Fatal("Accepted batch period that isn't a duration string.")
+	}
+
+	_, err = loadDeploymentConfig(writeConfigFile(t, `{
+		"analyzer_url": "example.com",
+		"batch_content_type": "text/plain",
+		"chunk_size": 0,
+		"sinks": [{"type": "foo"}],
+		"forward_timeout": "0s",
+		"anonymity_threshold": 0,
+		"crowd_id_method": "foo",
+		"aggregation": "foo",
+		"threshold_policy": [{"pattern": "Brave.*", "threshold": 0}],
+		"latest_versions": {"release": "1.36"},
+		"port": 0
+	}`), fs)
+	if err == nil {
+		t.Fatal("Accepted invalid configuration.")
+	}
+	for _, problem := range []string{"analyzer URL", "batch content type", "chunk size", "unknown type", "forward timeout", "anonymity threshold", "crowd ID strategy", "aggregation mode", "threshold of pattern", "latest version", "port"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Expected error to mention %q but got: %s", problem, err)
+		}
+	}
+	// Threshold policies must not lower the anonymity threshold.
+	_, err = loadDeploymentConfig(writeConfigFile(t, `{
+		"anonymity_threshold": 10,
+		"threshold_policy": [{"pattern": "Brave.*", "threshold": 5}]
+	}`), fs)
+	if err == nil || !strings.Contains(err.Error(), "must not be below the anonymity threshold") {
+		t.Fatalf("Expected threshold rule below anonymity threshold to be rejected but got: %v", err)
+	}
+
+	// Host-readable snapshot keys must be allowed explicitly, even in debug
+	// mode, and KMS keys require a rollback counter that only the enclave can
+	// write to.
+	keyFile := writeConfigFile(t, strings.Repeat("ab", snapshotKeyLen))
+	snapshotCfg := `{"snapshot_path": "/tmp/snapshot", "snapshot_key_file": "` + keyFile + `", "debug": true, "allow_insecure_snapshot_key": %t}`
+	_, err = loadDeploymentConfig(writeConfigFile(t, fmt.Sprintf(snapshotCfg, false)), fs)
+	if err == nil || !strings.Contains(err.Error(), "requires allow_insecure_snapshot_key") {
+		t.Fatalf("Expected snapshot key file to be rejected by default but got: %v", err)
+	}
+	if _, err = loadDeploymentConfig(writeConfigFile(t, fmt.Sprintf(snapshotCfg, true)), fs); err != nil {
+		t.Fatalf("Rejected explicitly allowed snapshot key file: %s", err)
+	}
+	_, err = loadDeploymentConfig(writeConfigFile(t, `{
+		"release_manifest": "/tmp/releases.json",
+		"release_manifest_key": "`+strings.Repeat("ab", 32)+`"
+	}`), fs)
+	if err == nil || !strings.Contains(err.Error(), "minimum issue time") {
+		t.Fatalf("Expected release manifest without minimum issue time to be rejected but got: %v", err)
+	}
+
+	kmsKeyFile := writeConfigFile(t, "Zm9v")
+	_, err = loadDeploymentConfig(writeConfigFile(t, `{"snapshot_path": "/tmp/snapshot", "snapshot_kms_key_file": "`+kmsKeyFile+`"}`), fs)
+	if err == nil || !strings.Contains(err.Error(), "counter table") ||
+		!strings.Contains(err.Error(), "counter credentials") || !strings.Contains(err.Error(), "AWS region") {
+		t.Fatalf("Expected KMS snapshot key without counter, counter credentials, and region to be rejected but got: %v", err)
+	}
+}
+
+func TestSimulationConfig(t *testing.T) {
+	// Simulation mode ignores deployment settings, so an invalid analyzer URL
+	// doesn't matter.
+	registry, policy, err := loadSimulationConfig(writeConfigFile(t, `{
+		"analyzer_url": "foo",
+		"crowd_id_strategies": [{"name": "coarse", "attributes": [{"name": "metric_name"}, {"name": "metric_value"}]}],
+		"threshold_policy": [{"pattern": "Brave.*", "threshold": 20, "crowd_id_strategy": "coarse"}]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to load simulation configuration: %s", err)
+	}
+	if _, err := registry.Lookup("coarse"); err != nil {
+		t.Fatalf("Configured strategy is missing from registry: %s", err)
+	}
+	if policy == nil || policy.match("Brave.Foo") == nil {
+		t.Fatal("Configured threshold policy is missing.")
+	}
+	// Loading a configuration must not register its strategies globally.
+	if _, err := strategies.Lookup("coarse"); err == nil {
+		t.Fatal("Configured strategy leaked into global registry.")
+	}
+
+	_, _, err = loadSimulationConfig(writeConfigFile(t, `{
+		"threshold_policy": [{"pattern": "Brave.*", "threshold": 20, "crowd_id_strategy": "foo"}]
+	}`))
+	if err == nil {
+		t.Fatal("Accepted threshold policy with unknown strategy.")
+	}
+}
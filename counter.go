@@ -0,0 +1,174 @@
+package main
+
+// This file implements the monotonic counter that protects our snapshots from
+// being rolled back.  Every snapshot is bound to the number of the batch
+// period that it belongs to and to its own sequence number within that batch
+// period.  The counter stores the position of the latest snapshot outside of
+// the host's control, and the shuffler refuses to restore any snapshot but
+// the latest one.  Once a batch period ends, the counter moves on to the next
+// batch period, so the snapshots of a batch period that we already forwarded
+// can never be restored.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var errCounterConflict = errors.New("snapshot counter was changed by someone else")
+
+// snapshotSeq is the position of a snapshot: the number of its batch period
+// and its sequence number within the batch period.
+type snapshotSeq struct {
+	Batch    uint64
+	Snapshot uint64
+}
+
+func (s snapshotSeq) String() string {
+	return fmt.Sprintf("%d.%d", s.Batch, s.Snapshot)
+}
+
+// counterStore stores the position of our latest snapshot.
+type counterStore interface {
+	// load returns the stored position, or the zero position if nothing was
+	// stored yet.
+	load() (snapshotSeq, error)
+	// swap replaces the stored position with next, but only if the stored
+	// position is still old.  Otherwise, it returns errCounterConflict.
+	swap(old, next snapshotSeq) error
+}
+
+// fileCounter stores the counter in a file.  The host can roll back the file,
+// so fileCounter provides no protection and must only be used for testing.
+type fileCounter struct {
+	path string
+}
+
+func (c *fileCounter) load() (snapshotSeq, error) {
+	var seq snapshotSeq
+	content, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return seq, nil
+	}
+	if err != nil {
+		return seq, err
+	}
+	if _, err := fmt.Sscanf(string(content), "%d %d", &seq.Batch, &seq.Snapshot); err != nil {
+		return seq, fmt.Errorf("malformed counter file: %w", err)
+	}
+	return seq, nil
+}
+
+func (c *fileCounter) swap(old, next snapshotSeq) error {
+	cur, err := c.load()
+	if err != nil {
+		return err
+	}
+	if cur != old {
+		return errCounterConflict
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := fmt.Fprintf(tmp, "%d %d\n", next.Batch, next.Snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// dynamoCounter stores the counter in an item of a DynamoDB table, whose
+// partition key is the string attribute "id".  Conditional writes make sure
+// that the counter only moves in lockstep with the shuffler.  The counter is
+// only as trustworthy as the credentials that can write to the table, which is
+// why the shuffler obtains them from KMS rather than from the host (see
+// kms.go).
+type dynamoCounter struct {
+	api   *dynamodb.Client
+	table string
+	id    string
+}
+
+// newDynamoCounter returns a counter that is stored in the item with the given
+// ID in the given DynamoDB table, and that uses the DynamoDB client with the
+// given configuration.
+func newDynamoCounter(cfg aws.Config, table, id string) *dynamoCounter {
+	return &dynamoCounter{api: dynamodb.NewFromConfig(cfg), table: table, id: id}
+}
+
+func dynamoNumber(n uint64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatUint(n, 10)}
+}
+
+// parseDynamoNumber returns the unsigned integer in the given attribute of the
+// given item.
+func parseDynamoNumber(item map[string]types.AttributeValue, name string) (uint64, error) {
+	n, ok := item[name].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("malformed counter item: attribute %q is not a number", name)
+	}
+	v, err := strconv.ParseUint(n.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed counter item: %w", err)
+	}
+	return v, nil
+}
+
+func (c *dynamoCounter) load() (snapshotSeq, error) {
+	var seq snapshotSeq
+	out, err := c.api.GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName:      aws.String(c.table),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: c.id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return seq, err
+	}
+	if out.Item == nil {
+		return seq, nil
+	}
+	if seq.Batch, err = parseDynamoNumber(out.Item, "batch_seq"); err != nil {
+		return seq, err
+	}
+	if seq.Snapshot, err = parseDynamoNumber(out.Item, "snapshot_seq"); err != nil {
+		return seq, err
+	}
+	return seq, nil
+}
+
+func (c *dynamoCounter) swap(old, next snapshotSeq) error {
+	cond := "batch_seq = :old_batch AND snapshot_seq = :old_snapshot"
+	if old == (snapshotSeq{}) {
+		cond = "attribute_not_exists(id) OR (" + cond + ")"
+	}
+	_, err := c.api.PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName: aws.String(c.table),
+		Item: map[string]types.AttributeValue{
+			"id":           &types.AttributeValueMemberS{Value: c.id},
+			"batch_seq":    dynamoNumber(next.Batch),
+			"snapshot_seq": dynamoNumber(next.Snapshot),
+		},
+		ConditionExpression: aws.String(cond),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":old_batch":    dynamoNumber(old.Batch),
+			":old_snapshot": dynamoNumber(old.Snapshot),
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return errCounterConflict
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// dynamoValue represents a DynamoDB attribute value in the JSON encoding of
+// DynamoDB's API.  We only use strings and numbers.
+type dynamoValue struct {
+	S string `json:",omitempty"`
+	N string `json:",omitempty"`
+}
+
+// fakeDynamoDB implements just enough of DynamoDB's GetItem and PutItem
+// actions for dynamoCounter.  It only accepts requests that are signed with
+// the given access key ID.
+type fakeDynamoDB struct {
+	sync.Mutex
+	accessKeyID string
+	items       map[string]map[string]dynamoValue
+}
+
+func (d *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+d.accessKeyID+"/") {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"__type":"AccessDeniedException"}`))
+		return
+	}
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "DynamoDB_20120810.GetItem":
+		var in struct {
+			Key            map[string]dynamoValue
+			ConsistentRead bool
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || !in.ConsistentRead {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		out := map[string]interface{}{}
+		if item, exists := d.items[in.Key["id"].S]; exists {
+			out["Item"] = item
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	case "DynamoDB_20120810.PutItem":
+		var in struct {
+			Item                      map[string]dynamoValue
+			ConditionExpression       string
+			ExpressionAttributeValues map[string]dynamoValue
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cur, exists := d.items[in.Item["id"].S]
+		vals := in.ExpressionAttributeValues
+		ok := exists && cur["batch_seq"] == vals[":old_batch"] && cur["snapshot_seq"] == vals[":old_snapshot"]
+		if !exists && strings.HasPrefix(in.ConditionExpression, "attribute_not_exists(id)") {
+			ok = true
+		}
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException"}`))
+			return
+		}
+		d.items[in.Item["id"].S] = in.Item
+		_, _ = w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func testCounter(t *testing.T, c counterStore) {
+	seq, err := c.load()
+	if err != nil {
+		t.Fatalf("Failed to load fresh counter: %s", err)
+	}
+	if seq != (snapshotSeq{}) {
+		t.Fatalf("Expected fresh counter to be zero but got %s.", seq)
+	}
+
+	first := snapshotSeq{Batch: 1, Snapshot: 0}
+	if err := c.swap(snapshotSeq{}, first); err != nil {
+		t.Fatalf("Failed to advance counter: %s", err)
+	}
+	if seq, _ = c.load(); seq != first {
+		t.Fatalf("Expected counter %s but got %s.", first, seq)
+	}
+
+	// Swapping from a stale position must fail.
+	if err := c.swap(snapshotSeq{}, snapshotSeq{Batch: 5}); !errors.Is(err, errCounterConflict) {
+		t.Fatalf("Expected error %v but got %v.", errCounterConflict, err)
+	}
+	second := snapshotSeq{Batch: 1, Snapshot: 1}
+	if err := c.swap(first, second); err != nil {
+		t.Fatalf("Failed to advance counter: %s", err)
+	}
+	if seq, _ = c.load(); seq != second {
+		t.Fatalf("Expected counter %s but got %s.", second, seq)
+	}
+}
+
+func TestFileCounter(t *testing.T) {
+	testCounter(t, &fileCounter{path: filepath.Join(t.TempDir(), "counter")})
+}
+
+func TestDynamoCounter(t *testing.T) {
+	srv := httptest.NewServer(&fakeDynamoDB{accessKeyID: "AKID", items: make(map[string]map[string]dynamoValue)})
+	defer srv.Close()
+	kmsSrv := httptest.NewServer(&fakeKMS{t: t, plaintexts: map[string][]byte{
+		"creds": []byte(`{"access_key_id": "AKID", "secret_access_key": "secret"}`),
+	}})
+	defer kmsSrv.Close()
+
+	// The host's credentials must not get us anywhere.
+	host := &awsCredentials{AccessKeyID: "host", SecretAccessKey: "secret"}
+	cfg := awsConfig("us-west-2", host.provider(), srv.Client())
+	cfg.BaseEndpoint = aws.String(srv.URL)
+	if _, err := newDynamoCounter(cfg, "snapshots", "shuffler.example.com").load(); err == nil {
+		t.Fatal("Loaded counter with the host's credentials.")
+	}
+
+	// The counter's credentials come from KMS.
+	k := newTestKMSDecrypter(kmsSrv.URL, kmsSrv.Client())
+	cfg = awsConfig("us-west-2", k.credentials([]byte("creds")), srv.Client())
+	cfg.BaseEndpoint = aws.String(srv.URL)
+	testCounter(t, newDynamoCounter(cfg, "snapshots", "shuffler.example.com"))
+}
@@ -0,0 +1,366 @@
+package main
+
+// This file implements crowd ID strategies, which determine what attributes of
+// a P3A measurement make up its crowd ID.  Besides our built-in strategies,
+// strategies can be defined in our configuration file as an ordered list of
+// attribute names, each with an optional transform, e.g.:
+//
+//   {
+//     "name": "coarse",
+//     "attributes": [
+//       {"name": "metric_name"},
+//       {"name": "metric_value"},
+//       {"name": "woi", "transform": "bucket:4"},
+//       {"name": "version", "transform": "coarsen:2"},
+//       {"name": "refcode", "transform": "hash"}
+//     ]
+//   }
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// attributeGetters maps attribute names to functions that extract the
+	// respective attribute from a P3A measurement.
+	attributeGetters = map[string]func(m P3AMeasurement) string{
+		"yos":            func(m P3AMeasurement) string { return strconv.Itoa(m.YearOfSurvey) },
+		"yoi":            func(m P3AMeasurement) string { return strconv.Itoa(m.YearOfInstall) },
+		"wos":            func(m P3AMeasurement) string { return strconv.Itoa(m.WeekOfSurvey) },
+		"woi":            func(m P3AMeasurement) string { return strconv.Itoa(m.WeekOfInstall) },
+		"metric_value":   func(m P3AMeasurement) string { return strconv.Itoa(m.MetricValue) },
+		"metric_name":    func(m P3AMeasurement) string { return m.MetricName },
+		"country_code":   func(m P3AMeasurement) string { return m.CountryCode },
+		"platform":       func(m P3AMeasurement) string { return m.Platform },
+		"version":        func(m P3AMeasurement) string { return m.Version },
+		"channel":        func(m P3AMeasurement) string { return m.Channel },
+		"refcode":        func(m P3AMeasurement) string { return m.RefCode },
+		"recent_version": recentVersion,
+	}
+
+	// Our built-in crowd ID strategies.
+	strategyAll = mustNewAttributeStrategy(&crowdIDStrategyConfig{
+		Name: "All", // All attributes are used for k-anonymity.
+		Attributes: attributeConfigs(
+			// The following entropy numbers came from running:
+			// p3a-shuffler -simulate -datadir 2022-03-27 -entropy
+			"metric_name",  // 0.90
+			"metric_value", // 0.66
+			"woi",          // 0.93
+			"country_code", // 0.72
+			"platform",     // 0.57
+			"yoi",          // 0.40
+			"version",      // 0.25
+			"refcode",      // 0.17
+			"wos",          // 0.15
+			"channel",      // 0.03
+			"yos",          // 0.00
+		),
+	})
+	strategyRefactored = mustNewAttributeStrategy(&crowdIDStrategyConfig{
+		Name: "Refactored", // Our current set of attributes.
+		Attributes: attributeConfigs("metric_name", "metric_value", "woi", "country_code",
+			"platform", "channel", "yoi", "wos", "yos", "recent_version"),
+	})
+	strategyMinimal = mustNewAttributeStrategy(&crowdIDStrategyConfig{
+		Name: "Minimal", // A minimal set of attributes.
+		Attributes: attributeConfigs("metric_name", "metric_value", "woi", "country_code",
+			"platform", "channel", "recent_version"),
+	})
+	// legacyStrategies maps the integers that we used to identify crowd ID
+	// methods with to their respective strategy.
+	legacyStrategies = []CrowdIDStrategy{strategyAll, strategyRefactored, strategyMinimal}
+
+	// strategies contains our built-in strategies.  Configurations that
+	// define additional strategies get their own registry.
+	strategies = newStrategyRegistry()
+)
+
+const (
+	crowdIDKeyLen = 32
+)
+
+// recentVersion returns "true" if the measurement's version is recent for its
+// channel.  Malformed versions and unknown channels are not recent.
+func recentVersion(m P3AMeasurement) string {
+	recent, err := versions.IsRecent(m.Channel, m.Version)
+	return strconv.FormatBool(err == nil && recent)
+}
+
+// crowdIDKey is the secret key that we derive crowd IDs with.  The key is
+// generated inside the enclave and never leaves it, so nobody outside the
+// enclave can predict crowd IDs.  We use a fresh key for every batch period.
+type crowdIDKey []byte
+
+// newCrowdIDKey returns a new, random crowd ID key.
+func newCrowdIDKey() (crowdIDKey, error) {
+	key := make(crowdIDKey, crowdIDKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// crowdID derives a crowd ID from the given attributes by computing an
+// HMAC-SHA-256 over the attributes' length-prefixed encoding.  The length
+// prefix makes the encoding unambiguous, i.e., distinct attribute tuples like
+// ("1", "23") and ("12", "3") never result in the same crowd ID.
+func (k crowdIDKey) crowdID(attrs []string) CrowdID {
+	mac := hmac.New(sha256.New, k)
+	var length [8]byte
+	for _, attr := range attrs {
+		binary.BigEndian.PutUint64(length[:], uint64(len(attr)))
+		mac.Write(length[:])
+		mac.Write([]byte(attr))
+	}
+	return CrowdID(fmt.Sprintf("%x", mac.Sum(nil)))
+}
+
+// CrowdIDStrategy determines what attributes of a P3A measurement are used to
+// determine its crowd ID.
+type CrowdIDStrategy interface {
+	// Name returns the strategy's unique name.
+	Name() string
+	// Attributes returns the measurement's attributes that make up its crowd
+	// ID, ordered by entropy, with high-entropy attributes coming first.  The
+	// first two attributes must be the metric name and value.
+	Attributes(m P3AMeasurement) []string
+	// AttributeNames returns the names of the attributes that Attributes
+	// returns, in the same order.
+	AttributeNames() []string
+}
+
+// attributeConfig represents the configuration of a single attribute that is
+// part of a crowd ID strategy.
+type attributeConfig struct {
+	Name      string `json:"name"`
+	Transform string `json:"transform,omitempty"`
+}
+
+// crowdIDStrategyConfig represents the configuration of a crowd ID strategy.
+type crowdIDStrategyConfig struct {
+	Name       string            `json:"name"`
+	Attributes []attributeConfig `json:"attributes"`
+}
+
+// attributeConfigs returns attribute configurations without transforms for
+// the given attribute names.
+func attributeConfigs(names ...string) []attributeConfig {
+	attrs := []attributeConfig{}
+	for _, name := range names {
+		attrs = append(attrs, attributeConfig{Name: name})
+	}
+	return attrs
+}
+
+// transform turns an attribute value into a (typically) coarser value.
+type transform func(value string) string
+
+// newTransform parses the given transform specification, which takes one of
+// the following forms:
+//
+//	bucket:N   Rounds an integer down to a multiple of N, e.g. 7 -> 4 for N=4.
+//	coarsen:N  Keeps the first N dot-separated components, e.g. 1.36.68 -> 1.36.
+//	hash       Replaces the value with its SHA-256 hash.
+func newTransform(spec string) (transform, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	switch name {
+	case "bucket":
+		size, err := strconv.Atoi(arg)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("bucket size must be a positive integer but is %q", arg)
+		}
+		return func(value string) string {
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return value
+			}
+			// Round towards negative infinity, so that buckets have the same
+			// size on either side of zero.
+			if v < 0 {
+				v -= size - 1
+			}
+			return strconv.Itoa(v / size * size)
+		}, nil
+	case "coarsen":
+		num, err := strconv.Atoi(arg)
+		if err != nil || num < 1 {
+			return nil, fmt.Errorf("number of components must be a positive integer but is %q", arg)
+		}
+		return func(value string) string {
+			components := strings.Split(value, ".")
+			if len(components) > num {
+				components = components[:num]
+			}
+			return strings.Join(components, ".")
+		}, nil
+	case "hash":
+		if arg != "" {
+			return nil, fmt.Errorf("hash transform takes no argument")
+		}
+		return func(value string) string {
+			return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transform %q", spec)
+	}
+}
+
+// attributeStrategy is a crowd ID strategy that consists of an ordered list of
+// attributes, each of which may be transformed.
+type attributeStrategy struct {
+	name    string
+	names   []string
+	getters []func(m P3AMeasurement) string
+}
+
+// newAttributeStrategy returns a new crowd ID strategy for the given
+// configuration.
+func newAttributeStrategy(cfg *crowdIDStrategyConfig) (CrowdIDStrategy, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("crowd ID strategy has no name")
+	}
+	if len(cfg.Attributes) < 2 || cfg.Attributes[0] != (attributeConfig{Name: "metric_name"}) ||
+		cfg.Attributes[1] != (attributeConfig{Name: "metric_value"}) {
+		return nil, fmt.Errorf("crowd ID strategy %q must start with untransformed metric_name and metric_value", cfg.Name)
+	}
+
+	s := &attributeStrategy{name: cfg.Name}
+	for _, attr := range cfg.Attributes {
+		get, exists := attributeGetters[attr.Name]
+		if !exists {
+			return nil, fmt.Errorf("crowd ID strategy %q uses unknown attribute %q", cfg.Name, attr.Name)
+		}
+		if attr.Transform != "" {
+			t, err := newTransform(attr.Transform)
+			if err != nil {
+				return nil, fmt.Errorf("crowd ID strategy %q has bad transform for %q: %w", cfg.Name, attr.Name, err)
+			}
+			untransformed := get
+			get = func(m P3AMeasurement) string { return t(untransformed(m)) }
+		}
+		s.names = append(s.names, attr.Name)
+		s.getters = append(s.getters, get)
+	}
+	return s, nil
+}
+
+// mustNewAttributeStrategy is like newAttributeStrategy but panics if the
+// configuration is invalid.  It's meant for our built-in strategies.
+func mustNewAttributeStrategy(cfg *crowdIDStrategyConfig) CrowdIDStrategy {
+	s, err := newAttributeStrategy(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Name returns the strategy's name.
+func (s *attributeStrategy) Name() string {
+	return s.name
+}
+
+// AttributeNames returns the names of the strategy's attributes.
+func (s *attributeStrategy) AttributeNames() []string {
+	return s.names
+}
+
+// Attributes returns the measurement's (transformed) attributes.
+func (s *attributeStrategy) Attributes(m P3AMeasurement) []string {
+	attrs := make([]string, len(s.getters))
+	for i, get := range s.getters {
+		attrs[i] = get(m)
+	}
+	return attrs
+}
+
+// strategyRegistry keeps track of all crowd ID strategies that we know of,
+// keyed by their case-insensitive name.
+type strategyRegistry struct {
+	sync.Mutex
+	builtin    map[string]bool
+	strategies map[string]CrowdIDStrategy
+}
+
+// newStrategyRegistry returns a registry that contains our built-in
+// strategies.
+func newStrategyRegistry() *strategyRegistry {
+	r := &strategyRegistry{
+		builtin:    make(map[string]bool),
+		strategies: make(map[string]CrowdIDStrategy),
+	}
+	for _, s := range legacyStrategies {
+		_ = r.register(s, true)
+	}
+	return r
+}
+
+// register adds the given strategy to the registry.  Built-in strategies
+// cannot be replaced.
+func (r *strategyRegistry) register(s CrowdIDStrategy, builtin bool) error {
+	r.Lock()
+	defer r.Unlock()
+
+	key := strings.ToLower(s.Name())
+	if r.builtin[key] {
+		return fmt.Errorf("cannot replace built-in crowd ID strategy %q", s.Name())
+	}
+	r.strategies[key] = s
+	r.builtin[key] = builtin
+	return nil
+}
+
+// Register adds the given strategy to the registry, replacing any
+// non-built-in strategy of the same name.
+func (r *strategyRegistry) Register(s CrowdIDStrategy) error {
+	return r.register(s, false)
+}
+
+// Lookup returns the strategy of the given name.  For backwards
+// compatibility, the built-in strategies can also be referred to by their
+// number, i.e. 0 for "All", 1 for "Refactored", and 2 for "Minimal".
+func (r *strategyRegistry) Lookup(name string) (CrowdIDStrategy, error) {
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(legacyStrategies) {
+		return legacyStrategies[i], nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	s, exists := r.strategies[strings.ToLower(name)]
+	if !exists {
+		return nil, fmt.Errorf("unknown crowd ID strategy %q", name)
+	}
+	return s, nil
+}
+
+// IsBuiltin returns true if the given name refers to a built-in strategy.
+func (r *strategyRegistry) IsBuiltin(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.builtin[strings.ToLower(name)]
+}
+
+// All returns all registered strategies, sorted by name.
+func (r *strategyRegistry) All() []CrowdIDStrategy {
+	r.Lock()
+	defer r.Unlock()
+
+	all := []CrowdIDStrategy{}
+	for _, s := range r.strategies {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name() < all[j].Name() })
+	return all
+}
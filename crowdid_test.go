@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testCrowdIDKey = crowdIDKey("crowd ID key for tests")
+
+// splits returns all ways to split the given string into a tuple of non-empty
+// attributes.
+func splits(s string) [][]string {
+	if len(s) <= 1 {
+		return [][]string{{s}}
+	}
+	var result [][]string
+	for _, rest := range splits(s[1:]) {
+		// Either start a new attribute or prepend to the first one.
+		result = append(result, append([]string{s[:1]}, rest...))
+		merged := append([]string{s[:1] + rest[0]}, rest[1:]...)
+		result = append(result, merged)
+	}
+	return result
+}
+
+func TestCrowdIDEncoding(t *testing.T) {
+	// Our old crowd IDs hashed the concatenated attributes, which made the
+	// following two measurements end up in the same crowd.
+	legacyCrowdID := func(m P3AMeasurement) string {
+		return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(m.OrderHighEntropyFirst(strategyAll), ""))))
+	}
+	m1, m2 := m, m
+	m1.MetricValue, m1.WeekOfInstall = 1, 23
+	m2.MetricValue, m2.WeekOfInstall = 12, 3
+	if legacyCrowdID(m1) != legacyCrowdID(m2) {
+		t.Fatal("Expected legacy crowd IDs to collide.")
+	}
+	if m1.CrowdID(strategyAll, testCrowdIDKey) == m2.CrowdID(strategyAll, testCrowdIDKey) {
+		t.Fatal("Distinct measurements must not share a crowd ID.")
+	}
+	b := NewBriefcase(strategyAll)
+	b.Add([]Report{m1, m2})
+	if b.NumCrowdIDs() != 2 {
+		t.Fatalf("Expected distinct measurements to be in 2 crowds but got %d.", b.NumCrowdIDs())
+	}
+
+	// No two ways of splitting the same string into attributes may result in
+	// the same crowd ID, and neither may tuples that only differ in empty
+	// attributes.
+	tuples := append(splits("1234567"), []string{}, []string{""}, []string{"", ""}, []string{"1", ""})
+	seen := make(map[CrowdID][]string)
+	for _, tuple := range tuples {
+		crowdID := testCrowdIDKey.crowdID(tuple)
+		if other, exists := seen[crowdID]; exists {
+			t.Fatalf("Attribute tuples %q and %q share a crowd ID.", tuple, other)
+		}
+		seen[crowdID] = tuple
+	}
+	if len(seen) != 64+4 {
+		t.Fatalf("Expected %d distinct crowd IDs but got %d.", 64+4, len(seen))
+	}
+}
+
+func TestCrowdIDKey(t *testing.T) {
+	k1, err := newCrowdIDKey()
+	if err != nil {
+		t.Fatalf("Failed to create crowd ID key: %s", err)
+	}
+	k2, err := newCrowdIDKey()
+	if err != nil {
+		t.Fatalf("Failed to create crowd ID key: %s", err)
+	}
+	if m.CrowdID(strategyAll, k1) != m.CrowdID(strategyAll, k1) {
+		t.Fatal("Crowd ID must be deterministic for a given key.")
+	}
+	if m.CrowdID(strategyAll, k1) == m.CrowdID(strategyAll, k2) {
+		t.Fatal("Crowd IDs derived with different keys must differ.")
+	}
+
+	// The briefcase must use a new key once a batch period ends.
+	b := NewBriefcase(strategyAll)
+	key := b.key
+	if _, err := b.ShuffleAndEmpty(); err != nil {
+		t.Fatalf("Failed to shuffle briefcase: %s", err)
+	}
+	if string(key) == string(b.key) {
+		t.Fatal("Briefcase didn't rotate its crowd ID key.")
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	for _, test := range []struct {
+		spec, in, out string
+	}{
+		{"bucket:4", "7", "4"},
+		{"bucket:4", "8", "8"},
+		{"bucket:4", "-1", "-4"},
+		{"bucket:4", "foo", "foo"},
+		{"coarsen:2", "1.36.68", "1.36"},
+		{"coarsen:2", "1", "1"},
+	} {
+		tr, err := newTransform(test.spec)
+		if err != nil {
+			t.Fatalf("Failed to parse transform %q: %s", test.spec, err)
+		}
+		if out := tr(test.in); out != test.out {
+			t.Fatalf("Expected transform %q to turn %q into %q but got %q.", test.spec, test.in, test.out, out)
+		}
+	}
+
+	hash, err := newTransform("hash")
+	if err != nil {
+		t.Fatalf("Failed to parse hash transform: %s", err)
+	}
+	if out := hash("none"); len(out) != 64 || out != hash("none") || out == hash("foo") {
+		t.Fatalf("Hash transform returned unexpected %q.", out)
+	}
+
+	for _, spec := range []string{"bucket", "bucket:0", "coarsen:x", "hash:1", "foo"} {
+		if _, err := newTransform(spec); err == nil {
+			t.Fatalf("Accepted bad transform %q.", spec)
+		}
+	}
+}
+
+func TestConfiguredStrategy(t *testing.T) {
+	s, err := newAttributeStrategy(&crowdIDStrategyConfig{
+		Name: "coarse",
+		Attributes: []attributeConfig{
+			{Name: "metric_name"},
+			{Name: "metric_value"},
+			{Name: "woi", Transform: "bucket:4"},
+			{Name: "version", Transform: "coarsen:2"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create strategy: %s", err)
+	}
+
+	m1, m2 := m, m
+	m1.WeekOfInstall, m1.Version = 5, "1.37.60"
+	m2.WeekOfInstall, m2.Version = 7, "1.37.113"
+	if m1.CrowdID(s, testCrowdIDKey) != m2.CrowdID(s, testCrowdIDKey) {
+		t.Fatal("Measurements in the same buckets must share a crowd ID.")
+	}
+	m2.WeekOfInstall = 8
+	if m1.CrowdID(s, testCrowdIDKey) == m2.CrowdID(s, testCrowdIDKey) {
+		t.Fatal("Measurements in different buckets must not share a crowd ID.")
+	}
+
+	for _, cfg := range []*crowdIDStrategyConfig{
+		{Attributes: attributeConfigs("metric_name", "metric_value")},
+		{Name: "foo", Attributes: attributeConfigs("metric_value", "metric_name")},
+		{Name: "foo", Attributes: attributeConfigs("metric_name", "metric_value", "foo")},
+		{Name: "foo", Attributes: []attributeConfig{
+			{Name: "metric_name"}, {Name: "metric_value", Transform: "bucket:2"},
+		}},
+	} {
+		if _, err := newAttributeStrategy(cfg); err == nil {
+			t.Fatalf("Accepted bad strategy configuration %+v.", cfg)
+		}
+	}
+}
+
+func TestStrategyRegistry(t *testing.T) {
+	for name, expected := range map[string]CrowdIDStrategy{
+		"All":     strategyAll,
+		"minimal": strategyMinimal,
+		"1":       strategyRefactored,
+	} {
+		s, err := strategies.Lookup(name)
+		if err != nil {
+			t.Fatalf("Failed to look up strategy %q: %s", name, err)
+		}
+		if s != expected {
+			t.Fatalf("Looked up unexpected strategy %q for %q.", s.Name(), name)
+		}
+	}
+	if _, err := strategies.Lookup("foo"); err == nil {
+		t.Fatal("Looked up unknown strategy.")
+	}
+
+	s := mustNewAttributeStrategy(&crowdIDStrategyConfig{
+		Name:       "ALL",
+		Attributes: attributeConfigs("metric_name", "metric_value"),
+	})
+	if err := strategies.Register(s); err == nil {
+		t.Fatal("Replaced built-in strategy.")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+// This file implements the outer layer of PROCHLO's nested encryption, i.e.
+// the layer that clients encrypt for the shuffler.  Clients encrypt a JSON-
+// encoded ShufflerReport using a hybrid scheme that is modelled after HPKE's
+// base mode: an ephemeral X25519 key exchange, HKDF-SHA256 for key derivation,
+// and ChaCha20-Poly1305 for authenticated encryption.  The resulting blob has
+// the following format:
+//
+//   ephemeral X25519 public key (32 bytes) || ChaCha20-Poly1305 ciphertext
+//
+// Because the client uses a fresh ephemeral key for every report, every
+// derived AEAD key is used only once, which is why we can use a zero nonce.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// hybridInfo is used as HKDF's info parameter and binds derived keys to
+	// our encryption scheme.
+	hybridInfo = "p3a-shuffler report encryption v1"
+	// aeadOverhead is the size of ChaCha20-Poly1305's authentication tag.
+	aeadOverhead = 16
+)
+
+var (
+	errBlobTooShort = errors.New("encrypted blob is too short")
+	errNoCrowdID    = errors.New("decrypted report has no crowd ID")
+)
+
+// shufflerKey represents the X25519 key pair that clients use to encrypt
+// reports for the shuffler.  The private key never leaves the enclave.
+type shufflerKey struct {
+	priv []byte
+	pub  []byte
+}
+
+// newShufflerKey generates and returns a new X25519 key pair.
+func newShufflerKey() (*shufflerKey, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &shufflerKey{priv: priv, pub: pub}, nil
+}
+
+// deriveAEADKey derives a ChaCha20-Poly1305 key from the given shared secret
+// and the two public keys that were involved in the key exchange.
+func deriveAEADKey(shared, ephemeralPub, recipientPub []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPub...), recipientPub...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(hybridInfo)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// decrypt decrypts the given blob and returns the resulting plaintext.
+func (k *shufflerKey) decrypt(blob []byte) ([]byte, error) {
+	if len(blob) < curve25519.PointSize+aeadOverhead {
+		return nil, errBlobTooShort
+	}
+	ephemeralPub, ciphertext := blob[:curve25519.PointSize], blob[curve25519.PointSize:]
+
+	shared, err := curve25519.X25519(k.priv, ephemeralPub)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveAEADKey(shared, ephemeralPub, k.pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// decryptReport decrypts the given shuffler measurement and returns the
+// report that it contains.
+func (k *shufflerKey) decryptReport(m ShufflerMeasurement) (*ShufflerReport, error) {
+	plaintext, err := k.decrypt(m.Encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt report: %w", err)
+	}
+
+	var r ShufflerReport
+	if err := json.Unmarshal(plaintext, &r); err != nil {
+		return nil, fmt.Errorf("failed to decode decrypted report: %w", err)
+	}
+	if r.ID == "" {
+		return nil, errNoCrowdID
+	}
+	return &r, nil
+}
+
+// createPublicKeyHandler creates a handler that returns the Base64-encoded
+// public key that clients must use to encrypt their reports.
+func createPublicKeyHandler(k *shufflerKey) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		resp := struct {
+			PublicKey string `json:"public_key"`
+		}{
+			PublicKey: base64.StdEncoding.EncodeToString(k.pub),
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			elog.Printf("Failed to send public key: %s", err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// encryptForShuffler does what clients do: it encrypts the given plaintext
+// for the given public key.
+func encryptForShuffler(t *testing.T, recipientPub, plaintext []byte) []byte {
+	ephemeralPriv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeralPriv); err != nil {
+		t.Fatal(err)
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeralPriv, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := curve25519.X25519(ephemeralPriv, recipientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := deriveAEADKey(shared, ephemeralPub, recipientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(ephemeralPub, nonce, plaintext, nil)
+}
+
+func TestDecryptReport(t *testing.T) {
+	k, err := newShufflerKey()
+	if err != nil {
+		t.Fatalf("Failed to create key: %s", err)
+	}
+
+	orig := ShufflerReport{ID: CrowdID("foo"), Data: []byte("bar")}
+	plaintext, _ := json.Marshal(orig)
+	blob := encryptForShuffler(t, k.pub, plaintext)
+
+	r, err := k.decryptReport(ShufflerMeasurement{Encrypted: blob})
+	if err != nil {
+		t.Fatalf("Failed to decrypt report: %s", err)
+	}
+	if r.ID != orig.ID {
+		t.Fatalf("Expected crowd ID %q but got %q.", orig.ID, r.ID)
+	}
+	if payload, _ := r.Payload(); !bytes.Equal(payload, orig.Data) {
+		t.Fatalf("Expected payload %q but got %q.", orig.Data, r.Data)
+	}
+
+	// Flipping a single bit must make decryption fail.
+	blob[len(blob)-1] ^= 1
+	if _, err := k.decryptReport(ShufflerMeasurement{Encrypted: blob}); err == nil {
+		t.Fatal("Decrypted tampered report.")
+	}
+	if _, err := k.decryptReport(ShufflerMeasurement{Encrypted: []byte("foo")}); err == nil {
+		t.Fatal("Decrypted truncated report.")
+	}
+
+	// A report without crowd ID must be rejected.
+	blob = encryptForShuffler(t, k.pub, []byte(`{"payload":"YmFy"}`))
+	if _, err := k.decryptReport(ShufflerMeasurement{Encrypted: blob}); err != errNoCrowdID {
+		t.Fatalf("Expected error %q but got %v.", errNoCrowdID, err)
+	}
+}
+
+func TestShufflerHandler(t *testing.T) {
+	k, err := newShufflerKey()
+	if err != nil {
+		t.Fatalf("Failed to create key: %s", err)
+	}
+	inbox := make(chan []Report, 1)
+	handler := createShufflerHandler(inbox, k, defaultHandlerConfig)
+
+	plaintext, _ := json.Marshal(ShufflerReport{ID: CrowdID("foo"), Data: []byte("bar")})
+	body, _ := json.Marshal(ShufflerMeasurement{Encrypted: encryptForShuffler(t, k.pub, plaintext)})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, shufflerEndpoint, bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	if rs := <-inbox; len(rs) != 1 {
+		t.Fatalf("Expected one report in inbox but got %d.", len(rs))
+	}
+
+	body, _ = json.Marshal(ShufflerMeasurement{Encrypted: []byte("not a valid blob")})
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, shufflerEndpoint, bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusBadRequest, w.Code)
+	}
+}
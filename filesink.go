@@ -0,0 +1,136 @@
+package main
+
+// This file implements a sink that appends chunks to rotating local files.
+// Every line of a file is the JSON encoding of a chunk, as described in
+// batch.go.  A new file is started once the current file would exceed its
+// maximum size, or once the rotation interval has passed.  We don't support
+// columnar formats like Parquet: a Parquet file is only readable once its
+// footer is written, so chunks wouldn't be durably stored until we rotate.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	fileFormatJSONL       = "jsonl"
+	defaultMaxFileBytes   = 100 << 20
+	defaultRotateInterval = time.Hour * 24
+	// fileTimeFormat determines the names of our files.
+	fileTimeFormat = "20060102T150405Z"
+)
+
+// fileSink appends chunks to rotating JSONL files in a directory.
+type fileSink struct {
+	sync.Mutex
+	name     string
+	dir      string
+	maxBytes int64
+	interval time.Duration
+	now      func() time.Time
+	f        *os.File
+	size     int64
+	opened   time.Time
+	// seq keeps file names unique if we rotate more than once per second.
+	seq int
+	// closed is set once the sink is closed, after which we refuse chunks.
+	closed bool
+}
+
+// newFileSink returns a new file sink that writes to the given directory,
+// which is created if it doesn't exist.  A non-positive maximum size or
+// rotation interval means that we use our default.
+func newFileSink(dir string, maxBytes int64, interval time.Duration) (*fileSink, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxFileBytes
+	}
+	if interval <= 0 {
+		interval = defaultRotateInterval
+	}
+	return &fileSink{
+		name:     sinkFile,
+		dir:      dir,
+		maxBytes: maxBytes,
+		interval: interval,
+		now:      time.Now,
+	}, nil
+}
+
+func (s *fileSink) Name() string {
+	return s.name
+}
+
+// Send appends the given chunk to the current file and syncs the file, so the
+// chunk is durably stored once Send returns.
+func (s *fileSink) Send(chunk *Batch) error {
+	msg, err := chunk.message()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return errSinkClosed
+	}
+	if s.f == nil || s.now().Sub(s.opened) >= s.interval ||
+		(s.size > 0 && s.size+int64(len(line)) > s.maxBytes) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// rotate closes the current file (if any) and opens a new one.  The caller
+// must hold the sink's lock.
+func (s *fileSink) rotate() error {
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	now := s.now()
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("batches-%s-%d.%s", now.UTC().Format(fileTimeFormat), s.seq, fileFormatJSONL))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	elog.Printf("Writing chunks to %s.", path)
+	s.f, s.size, s.opened = f, 0, now
+	return nil
+}
+
+// closeFile closes the current file, if any.  The caller must hold the sink's
+// lock.
+func (s *fileSink) closeFile() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return s.closeFile()
+}
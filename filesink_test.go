@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSink(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "batches")
+	s, err := newFileSink(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create file sink: %s", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	chunk := &Batch{ID: "foo", ChunkCount: 1, Reports: []Report{P3AMeasurement{}}}
+	send := func() {
+		if err := s.Send(chunk); err != nil {
+			t.Fatalf("Failed to send chunk: %s", err)
+		}
+	}
+	send()
+	send()
+	// Once the rotation interval has passed, we must start a new file.
+	now = now.Add(time.Hour)
+	send()
+	// Once a file would exceed its maximum size, we must start a new file.
+	s.maxBytes = s.size + 1
+	send()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Failed to close file sink: %s", err)
+	}
+	// A closed sink must not open another file.
+	if err := s.Send(chunk); err != errSinkClosed {
+		t.Fatalf("Expected %v but got: %v", errSinkClosed, err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "batches-*.jsonl"))
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 files but got %d.", len(files))
+	}
+	numLines := 0
+	for _, file := range files {
+		fd, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("Failed to open file: %s", err)
+		}
+		scanner := bufio.NewScanner(fd)
+		for scanner.Scan() {
+			if _, err := unmarshalBatchMessage(contentTypeJSON, scanner.Bytes()); err != nil {
+				t.Fatalf("Failed to decode chunk: %s", err)
+			}
+			numLines++
+		}
+		fd.Close()
+	}
+	if numLines != 4 {
+		t.Fatalf("Expected 4 chunks but got %d.", numLines)
+	}
+}
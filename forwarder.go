@@ -4,84 +4,222 @@ package main
 // external machine.
 
 import (
-	"bytes"
-	"encoding/json"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Forwarder is responsible for forwarding shuffled reports to the server
-// (a.k.a. the analyzer in PROCHLO).
+const (
+	// defaultRetryCheckInterval determines how often the forwarder checks its
+	// retry queue for chunks that are due.
+	defaultRetryCheckInterval = time.Second
+	// defaultChunkSize is the maximum number of reports per chunk.
+	defaultChunkSize = 10000
+)
+
+// Forwarder is responsible for forwarding shuffled reports to one or more
+// sinks, e.g. the analyzer (see sink.go).  Every batch is forwarded to every
+// sink in chunks, and chunks that a sink doesn't accept are kept in a bounded
+// retry queue and re-submitted with exponential backoff.
 type Forwarder struct {
 	sync.WaitGroup
 	done     chan bool
-	srvURL   string
-	shuffler chan []Report
+	drain    chan time.Duration
+	shuffler chan *Batch
+	sinks    []Sink
+	Retry    RetryPolicy
+	// ChunkSize is the maximum number of reports per chunk.
+	ChunkSize int
+	retries   *retryQueue
+	// workers tracks our forward and retry goroutines, and inFlight counts
+	// them.
+	workers  sync.WaitGroup
+	inFlight int32
+	// retryCheckInterval determines how often we check our retry queue.
+	retryCheckInterval time.Duration
 }
 
-// NewForwarder creates and returns a new forwarder.
-func NewForwarder(shuffler chan []Report, srvURL string) *Forwarder {
-	return &Forwarder{
-		done:     make(chan bool),
-		shuffler: shuffler,
-		srvURL:   srvURL,
+// SinkFactory creates a sink whose HTTP requests, if any, go through a client
+// that is derived from the given client.
+type SinkFactory func(client *http.Client) (Sink, error)
+
+// NewForwarder creates and returns a new forwarder that forwards the batches
+// of the given shuffler outbox to all sinks that the given factories create.
+// The sinks share an HTTP client that the given options configure.
+func NewForwarder(shuffler chan *Batch, factories []SinkFactory, opts ...ClientOption) (*Forwarder, error) {
+	client, err := newHTTPClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	f := &Forwarder{
+		done:               make(chan bool),
+		drain:              make(chan time.Duration),
+		shuffler:           shuffler,
+		Retry:              defaultRetryPolicy,
+		ChunkSize:          defaultChunkSize,
+		retryCheckInterval: defaultRetryCheckInterval,
 	}
+	for _, newSink := range factories {
+		sink, err := newSink(client)
+		if err != nil {
+			f.closeSinks()
+			return nil, err
+		}
+		f.sinks = append(f.sinks, sink)
+	}
+	return f, nil
 }
 
 // Start starts the forwarder.
 func (f *Forwarder) Start() {
+	f.retries = newRetryQueue(f.Retry)
 	f.Add(1)
 	go func() {
 		defer f.Done()
+		defer f.closeSinks()
+		ticker := time.NewTicker(f.retryCheckInterval)
+		defer ticker.Stop()
+		var draining bool
+		var drainDeadline time.Time
 		for {
 			select {
 			case <-f.done:
+				f.workers.Wait()
+				f.dropRetries()
 				return
-			case reports := <-f.shuffler:
-				elog.Printf("Received %d reports from shuffler.", len(reports))
-				go f.forward(reports)
+			case timeout := <-f.drain:
+				draining, drainDeadline = true, time.Now().Add(timeout)
+			case batch := <-f.shuffler:
+				elog.Printf("Received %d reports from shuffler.", len(batch.Reports))
+				for _, sink := range f.sinks {
+					sink := sink
+					f.spawn(func() { f.forward(sink, batch) })
+				}
+			case <-ticker.C:
+				for _, b := range f.retries.due(time.Now()) {
+					b := b
+					f.spawn(func() { f.retry(b) })
+				}
+				if !draining {
+					continue
+				}
+				if atomic.LoadInt32(&f.inFlight) == 0 && f.retries.size() == 0 {
+					elog.Println("Done draining.")
+					return
+				}
+				if time.Now().After(drainDeadline) {
+					elog.Println("Timed out while waiting for in-flight chunks.")
+					f.workers.Wait()
+					f.dropRetries()
+					return
+				}
 			}
 		}
 	}()
 }
 
-// Stop stops the forwarder.
+// Stop stops the forwarder.  Stop waits for chunks that are in flight, and
+// drops chunks that are waiting to be retried.
 func (f *Forwarder) Stop() {
 	f.done <- true
 	f.Wait()
 }
 
-// forward forwards the given reports to the server.
-func (f *Forwarder) forward(reports []Report) {
-	if len(reports) == 0 {
-		elog.Println("No reports given, so there's nothing to forward.")
-		return
+// Drain waits until the forwarder has no more in-flight or queued chunks, or
+// until the given timeout expires, and then stops the forwarder.  Chunks that
+// are in flight are allowed to finish.  Chunks that are still queued for a
+// retry at that point are lost: the retry queue isn't persisted, so they
+// can't be picked up again after a restart.
+func (f *Forwarder) Drain(timeout time.Duration) {
+	f.drain <- timeout
+	f.Wait()
+}
+
+// spawn runs the given function in a goroutine that Stop and Drain wait for.
+func (f *Forwarder) spawn(fn func()) {
+	atomic.AddInt32(&f.inFlight, 1)
+	f.workers.Add(1)
+	go func() {
+		defer f.workers.Done()
+		defer atomic.AddInt32(&f.inFlight, -1)
+		fn()
+	}()
+}
+
+// dropRetries drops all chunks that are waiting to be retried.
+func (f *Forwarder) dropRetries() {
+	if num := f.retries.size(); num > 0 {
+		elog.Printf("Dropping %d chunks that were waiting to be retried.", num)
 	}
+	f.retries.dropAll()
+}
 
-	// Marshal our reports.
-	type reportBatch struct {
-		Batch []Report `json:"batch"`
+// closeSinks closes all of our sinks.
+func (f *Forwarder) closeSinks() {
+	for _, sink := range f.sinks {
+		if err := sink.Close(); err != nil {
+			elog.Printf("Failed to close sink %s: %s", sink.Name(), err)
+		}
 	}
-	batch := reportBatch{Batch: reports}
-	jsonBytes, err := json.Marshal(batch)
-	if err != nil {
-		elog.Printf("Failed to marshal reports: %s", err)
-		return
+}
+
+// NumLost returns the number of reports that the forwarder permanently failed
+// to forward.
+func (f *Forwarder) NumLost() int {
+	if f.retries == nil {
+		return 0
 	}
+	return f.retries.NumLost()
+}
 
-	// Forward our JSON blob to the server.
-	// TODO: We should probably try to re-submit the reports in case of error.
-	// Otherwise, we would lose reports.
-	r := bytes.NewReader(jsonBytes)
-	resp, err := http.Post(f.srvURL, "application/json", r)
-	if err != nil {
-		elog.Printf("Failed to POST reports to server: %s", err)
+// forward splits the given batch into chunks and forwards them to the given
+// sink, in random order.  Chunks that we fail to forward are added to our
+// retry queue.
+func (f *Forwarder) forward(sink Sink, batch *Batch) {
+	if len(batch.Reports) == 0 {
+		elog.Println("No reports given, so there's nothing to forward.")
 		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		elog.Printf("Received HTTP status code %d from server.", resp.StatusCode)
+
+	chunks := batch.chunks(f.ChunkSize)
+	// The batch is already shuffled, so the order in which we send chunks
+	// doesn't reveal anything, but sinks shouldn't be able to rely on it
+	// either.
+	if err := shuffle(len(chunks), func(i, j int) {
+		chunks[i], chunks[j] = chunks[j], chunks[i]
+	}); err != nil {
+		elog.Printf("Failed to shuffle chunks: %s", err)
+	}
+	for _, chunk := range chunks {
+		if err := f.send(sink, chunk); err != nil {
+			elog.Printf("Failed to forward %s to %s: %s", chunk, sink.Name(), err)
+			f.retries.add(sink, chunk, time.Now())
+			continue
+		}
+		elog.Printf("Forwarded %s to %s.", chunk, sink.Name())
+	}
+}
+
+// retry re-submits the given chunk.  If that fails, the chunk goes back into
+// our retry queue.
+func (f *Forwarder) retry(b *pendingBatch) {
+	if err := f.send(b.sink, b.batch); err != nil {
+		elog.Printf("Retry %d of %s to %s failed: %s", b.attempts, b.batch, b.sink.Name(), err)
+		f.retries.failed(b, time.Now())
 		return
 	}
+	elog.Printf("Forwarded %s to %s after %d retries.", b.batch, b.sink.Name(), b.attempts)
+}
 
-	elog.Printf("Forwarded %d reports to server.", len(reports))
+// send sends the given chunk to the given sink.  The chunk's reports only
+// count as forwarded once the sink accepted the chunk.
+func (f *Forwarder) send(sink Sink, chunk *Batch) error {
+	defer metrics.forwardDuration.ObserveSince(time.Now())
+	if err := sink.Send(chunk); err != nil {
+		metrics.forwardFailures.Add(sink.Name(), 1)
+		return err
+	}
+	metrics.reportsForwarded.Add(sink.Name(), len(chunk.Reports))
+	return nil
 }
@@ -1,10 +1,259 @@
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ackChunk decodes the given chunk and acknowledges it, like the analyzer
+// would.  If the chunk is invalid, ackChunk responds with HTTP 400 and returns
+// nil.
+func ackChunk(w http.ResponseWriter, contentType string, body []byte) *batchMessage {
+	m, err := unmarshalBatchMessage(contentType, body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	_ = json.NewEncoder(w).Encode(&chunkAck{BatchID: m.BatchID, ChunkIndex: &m.ChunkIndex})
+	return m
+}
+
+// ackHandler acknowledges every chunk that it receives.
+func ackHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	ackChunk(w, r.Header.Get("Content-Type"), body)
+}
+
+// httpSinkFactory returns a factory for an HTTP sink that sends JSON-encoded
+// chunks to the given URL.
+func httpSinkFactory(url string) SinkFactory {
+	return func(client *http.Client) (Sink, error) {
+		return newHTTPSink(url, contentTypeJSON, client), nil
+	}
+}
+
+// staticSinks returns factories that return the given sinks.
+func staticSinks(sinks ...Sink) []SinkFactory {
+	var factories []SinkFactory
+	for _, sink := range sinks {
+		sink := sink
+		factories = append(factories, func(*http.Client) (Sink, error) { return sink, nil })
+	}
+	return factories
+}
+
+// mustNewForwarder returns a new forwarder or fails the test.
+func mustNewForwarder(t *testing.T, shuffler chan *Batch, factories []SinkFactory, opts ...ClientOption) *Forwarder {
+	f, err := NewForwarder(shuffler, factories, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	return f
+}
 
 func TestLifecycle(t *testing.T) {
-	c := make(chan []Report)
-	f := NewForwarder(c, "foo")
+	c := make(chan *Batch)
+	f := mustNewForwarder(t, c, []SinkFactory{httpSinkFactory("foo")})
 	f.Start()
 	f.Stop()
 }
+
+func TestForwarderClientOptions(t *testing.T) {
+	custom := &http.Client{Timeout: time.Second * 42}
+	f := mustNewForwarder(t, make(chan *Batch), []SinkFactory{httpSinkFactory("foo")}, WithHTTPClient(custom))
+	if s := f.sinks[0].(*httpSink); s.client != custom {
+		t.Fatalf("Expected sink to use our custom HTTP client but got %+v.", s.client)
+	}
+	f = mustNewForwarder(t, make(chan *Batch), []SinkFactory{httpSinkFactory("foo")}, WithTimeout(time.Second))
+	if s := f.sinks[0].(*httpSink); s.client.Timeout != time.Second {
+		t.Fatalf("Expected sink to use timeout of 1s but got %s.", s.client.Timeout)
+	}
+
+	// A custom client would ignore all other options.
+	if _, err := NewForwarder(make(chan *Batch), nil, WithHTTPClient(custom), WithKeepAlive(0)); err == nil {
+		t.Fatal("Accepted custom HTTP client along with other client options.")
+	}
+	// If a sink cannot be created, the sinks that were already created must
+	// be closed.
+	sink := &memorySink{}
+	failing := func(*http.Client) (Sink, error) { return nil, errSinkClosed }
+	if _, err := NewForwarder(make(chan *Batch), append(staticSinks(sink), failing)); err != errSinkClosed {
+		t.Fatalf("Expected error %q but got %v.", errSinkClosed, err)
+	}
+	if !sink.closed {
+		t.Fatal("Forwarder didn't close sink after failing to create another one.")
+	}
+}
+
+func TestForwardRetry(t *testing.T) {
+	var numRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first two requests.
+		if atomic.AddInt32(&numRequests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ackHandler(w, r)
+	}))
+	defer srv.Close()
+
+	c := make(chan *Batch)
+	f := mustNewForwarder(t, c, []SinkFactory{httpSinkFactory(srv.URL)})
+	f.Retry.InitialBackoff = time.Millisecond
+	f.Retry.MaxBackoff = time.Millisecond
+	f.retryCheckInterval = time.Millisecond
+	f.Start()
+	defer f.Stop()
+
+	c <- &Batch{Reports: []Report{P3AMeasurement{}}}
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&numRequests) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("Forwarder did not retry failed batch.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if f.NumLost() != 0 {
+		t.Fatalf("Expected no lost reports but got %d.", f.NumLost())
+	}
+}
+
+func TestForwarderDrain(t *testing.T) {
+	var numRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 50)
+		atomic.AddInt32(&numRequests, 1)
+		ackHandler(w, r)
+	}))
+	defer srv.Close()
+
+	c := make(chan *Batch)
+	f := mustNewForwarder(t, c, []SinkFactory{httpSinkFactory(srv.URL)})
+	f.retryCheckInterval = time.Millisecond
+	f.Start()
+
+	c <- &Batch{Reports: []Report{P3AMeasurement{}}}
+	f.Drain(time.Second * 5)
+	if atomic.LoadInt32(&numRequests) != 1 {
+		t.Fatal("Forwarder stopped before finishing in-flight batch.")
+	}
+}
+
+func TestChunkedForwarding(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		keys        = make(map[string]int)
+		acked       = make(map[int]bool)
+		numPayloads int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		m, err := unmarshalBatchMessage(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.Header.Get("Idempotency-Key")
+		keys[key]++
+		if key != fmt.Sprintf("%s-%d", m.BatchID, m.ChunkIndex) || m.ChunkCount != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Don't acknowledge the first attempt of the second chunk.
+		if m.ChunkIndex == 1 && keys[key] == 1 {
+			return
+		}
+		if !acked[m.ChunkIndex] {
+			numPayloads += len(m.Payloads)
+		}
+		acked[m.ChunkIndex] = true
+		ackChunk(w, r.Header.Get("Content-Type"), body)
+	}))
+	defer srv.Close()
+
+	c := make(chan *Batch)
+	f := mustNewForwarder(t, c, []SinkFactory{httpSinkFactory(srv.URL)})
+	f.ChunkSize = 10
+	f.Retry.InitialBackoff = time.Millisecond
+	f.Retry.MaxBackoff = time.Millisecond
+	f.retryCheckInterval = time.Millisecond
+	f.Start()
+
+	batch := &Batch{ID: "foo"}
+	for i := 0; i < 25; i++ {
+		batch.Reports = append(batch.Reports, &DummyReport{crowdID: CrowdID("foo")})
+	}
+	c <- batch
+	f.Drain(time.Second * 5)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(acked) != 3 || numPayloads != 25 {
+		t.Fatalf("Expected 3 acknowledged chunks with 25 payloads but got %d with %d.", len(acked), numPayloads)
+	}
+	if keys["foo-1"] != 2 || keys["foo-0"] != 1 || keys["foo-2"] != 1 {
+		t.Fatalf("Unexpected requests per idempotency key: %v", keys)
+	}
+	if f.NumLost() != 0 {
+		t.Fatalf("Expected no lost reports but got %d.", f.NumLost())
+	}
+}
+
+// blockingSink blocks in Send until its release channel is closed, and
+// records whether it was closed while a Send was still in progress.
+type blockingSink struct {
+	sending       int32
+	closedEarly   int32
+	release, sent chan bool
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+
+func (s *blockingSink) Send(chunk *Batch) error {
+	atomic.StoreInt32(&s.sending, 1)
+	s.sent <- true
+	<-s.release
+	atomic.StoreInt32(&s.sending, 0)
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	if atomic.LoadInt32(&s.sending) == 1 {
+		atomic.StoreInt32(&s.closedEarly, 1)
+	}
+	return nil
+}
+
+func TestStopWaitsForInFlight(t *testing.T) {
+	sink := &blockingSink{release: make(chan bool), sent: make(chan bool, 1)}
+	c := make(chan *Batch)
+	f := mustNewForwarder(t, c, staticSinks(sink))
+	f.Start()
+
+	c <- &Batch{Reports: []Report{P3AMeasurement{}}}
+	<-sink.sent
+	stopped := make(chan bool)
+	go func() {
+		f.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Forwarder stopped while a chunk was in flight.")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(sink.release)
+	<-stopped
+	if atomic.LoadInt32(&sink.closedEarly) == 1 {
+		t.Fatal("Forwarder closed sink while a chunk was in flight.")
+	}
+}
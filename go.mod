@@ -1,21 +1,35 @@
 module github.com/brave-experiments/p3a-shuffler
 
-go 1.17
+go 1.19
 
-require github.com/brave-experiments/nitriding v1.0.0
+require (
+	github.com/aws/aws-sdk-go-v2 v1.24.1
+	github.com/aws/aws-sdk-go-v2/credentials v1.16.16
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.26.8
+	github.com/aws/aws-sdk-go-v2/service/kms v1.27.9
+	github.com/brave-experiments/nitriding v1.0.0
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/hf/nsm v0.0.0-20211106132757-1ae65a6a69ae
+	github.com/klauspost/compress v1.15.15
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.2.10 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.5.10 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/accept-encoding v1.10.4 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/endpoint-discovery v1.8.11 // indirect
+	github.com/aws/smithy-go v1.19.0 // indirect
 	github.com/brave-experiments/viproxy v0.1.0 // indirect
 	github.com/docker/libcontainer v2.2.1+incompatible // indirect
-	github.com/fxamacker/cbor/v2 v2.4.0 // indirect
 	github.com/go-chi/chi/v5 v5.0.7 // indirect
-	github.com/hf/nsm v0.0.0-20211106132757-1ae65a6a69ae // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/mdlayher/socket v0.2.0 // indirect
 	github.com/mdlayher/vsock v1.1.1 // indirect
 	github.com/milosgajdos/tenus v0.0.3 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
-	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
 	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f // indirect
 	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
 	golang.org/x/text v0.3.7 // indirect
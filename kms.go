@@ -0,0 +1,367 @@
+package main
+
+// This file decrypts KMS ciphertexts for the enclave, e.g. the snapshot key,
+// which is a KMS data key whose ciphertext can be stored anywhere, because
+// only KMS can decrypt it.  We ask KMS to decrypt a ciphertext for the
+// enclave: we generate an ephemeral RSA key pair, put its public key into a
+// Nitro attestation document, and send the document along with our decryption
+// request.  KMS checks the document against the key policy (e.g. the
+// kms:RecipientAttestation:PCR0 condition) and returns the plaintext encrypted
+// to our ephemeral public key, as a CMS EnvelopedData structure (RFC 5652).
+// Neither the host nor anyone else who doesn't run our enclave image ever sees
+// the plaintext.
+//
+// The AWS SDK doesn't open the envelope for us, and the CMS libraries that we
+// know of only address recipients by issuer and serial number, whereas KMS
+// addresses our ephemeral key by its subject key identifier.  We therefore
+// parse the few parts of EnvelopedData that KMS uses ourselves.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const (
+	kmsRecipientRSAKeyBits = 2048
+)
+
+var (
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidRSAESOAEP     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidAES256CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+
+	errBadEnvelope    = errors.New("malformed CMS enveloped data")
+	errBadCredentials = errors.New("KMS-encrypted AWS credentials are incomplete")
+)
+
+// keyAttester returns a Nitro attestation document that contains the given
+// public key.
+type keyAttester func(publicKey []byte) ([]byte, error)
+
+// nsmAttestKey asks the Nitro hypervisor for an attestation document that
+// contains the given public key.
+func nsmAttestKey(publicKey []byte) ([]byte, error) {
+	return nsmAttestation([]byte{}, []byte{}, publicKey)
+}
+
+// kmsDecrypter decrypts KMS ciphertexts for the enclave.
+type kmsDecrypter struct {
+	api    *kms.Client
+	attest keyAttester
+}
+
+// newKMSDecrypter returns a decrypter that uses the KMS client with the given
+// configuration, and proves that it runs in our enclave with the given
+// attester.
+func newKMSDecrypter(cfg aws.Config, attest keyAttester) *kmsDecrypter {
+	return &kmsDecrypter{api: kms.NewFromConfig(cfg), attest: attest}
+}
+
+// readKMSCiphertext reads a Base64-encoded KMS ciphertext from the given file,
+// e.g. the CiphertextBlob that "aws kms generate-data-key" returns.
+func readKMSCiphertext(filename string) ([]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("KMS ciphertext is not Base64-encoded: %w", err)
+	}
+	return ciphertext, nil
+}
+
+// decrypt returns the plaintext of the given KMS ciphertext.
+func (k *kmsDecrypter) decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, kmsRecipientRSAKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := k.attest(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain attestation document: %w", err)
+	}
+
+	out, err := k.api.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob: ciphertext,
+		Recipient: &types.RecipientInfo{
+			KeyEncryptionAlgorithm: types.KeyEncryptionMechanismRsaesOaepSha256,
+			AttestationDocument:    doc,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.CiphertextForRecipient) == 0 {
+		return nil, errors.New("KMS didn't encrypt the plaintext for our enclave")
+	}
+	return openEnvelope(out.CiphertextForRecipient, priv)
+}
+
+// key returns a function that returns the plaintext of the given data key
+// ciphertext, for our snapshotter.
+func (k *kmsDecrypter) key(ciphertext []byte) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return k.decrypt(context.Background(), ciphertext)
+	}
+}
+
+// credentials returns a provider of the AWS credentials whose JSON encoding
+// (see awsCredentials) the given ciphertext contains.  Unlike the credentials
+// in our environment, these credentials are only available to our enclave.
+func (k *kmsDecrypter) credentials(ciphertext []byte) aws.CredentialsProvider {
+	return aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		plaintext, err := k.decrypt(ctx, ciphertext)
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		var creds awsCredentials
+		if err := json.Unmarshal(plaintext, &creds); err != nil {
+			return aws.Credentials{}, fmt.Errorf("failed to decode KMS-encrypted AWS credentials: %w", err)
+		}
+		if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+			return aws.Credentials{}, errBadCredentials
+		}
+		return creds.provider().Retrieve(ctx)
+	})
+}
+
+// The following types represent the parts of CMS EnvelopedData that KMS uses.
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsEnvelopedData struct {
+	Version              int
+	RecipientInfos       []cmsKeyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo cmsEncryptedContentInfo
+}
+
+type cmsKeyTransRecipientInfo struct {
+	Version                int
+	RecipientIdentifier    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type cmsEncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0"`
+}
+
+// openEnvelope decrypts the content of the given CMS EnvelopedData structure,
+// whose content encryption key is encrypted to the given RSA key with
+// RSAES-OAEP and SHA-256, and whose content is encrypted with AES-256-CBC.
+func openEnvelope(ber []byte, priv *rsa.PrivateKey) ([]byte, error) {
+	der, err := berToDER(ber)
+	if err != nil {
+		return nil, err
+	}
+	var info cmsContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadEnvelope, err)
+	}
+	if !info.ContentType.Equal(oidEnvelopedData) {
+		return nil, fmt.Errorf("%w: unexpected content type %s", errBadEnvelope, info.ContentType)
+	}
+	var env cmsEnvelopedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadEnvelope, err)
+	}
+	if len(env.RecipientInfos) != 1 {
+		return nil, fmt.Errorf("%w: expected one recipient but got %d", errBadEnvelope, len(env.RecipientInfos))
+	}
+	ri := env.RecipientInfos[0]
+	if !ri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSAESOAEP) {
+		return nil, fmt.Errorf("%w: unsupported key encryption algorithm %s", errBadEnvelope, ri.KeyEncryptionAlgorithm.Algorithm)
+	}
+	cek, err := rsa.DecryptOAEP(sha256.New(), nil, priv, ri.EncryptedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content encryption key: %w", err)
+	}
+
+	eci := env.EncryptedContentInfo
+	if !eci.ContentEncryptionAlgorithm.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("%w: unsupported content encryption algorithm %s", errBadEnvelope, eci.ContentEncryptionAlgorithm.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("%w: bad IV", errBadEnvelope)
+	}
+	ciphertext, err := implicitOctetString(eci.EncryptedContent)
+	if err != nil {
+		return nil, err
+	}
+	return decryptAESCBC(cek, iv, ciphertext)
+}
+
+// implicitOctetString returns the content of the given implicitly tagged
+// OCTET STRING, which BER allows to be split into several OCTET STRINGs.
+func implicitOctetString(v asn1.RawValue) ([]byte, error) {
+	if !v.IsCompound {
+		return v.Bytes, nil
+	}
+	var content []byte
+	for rest := v.Bytes; len(rest) > 0; {
+		var part []byte
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &part); err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadEnvelope, err)
+		}
+		content = append(content, part...)
+	}
+	return content, nil
+}
+
+// decryptAESCBC decrypts the given AES-CBC ciphertext and removes its PKCS #7
+// padding.
+func decryptAESCBC(key, iv, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: bad ciphertext length %d", errBadEnvelope, len(ciphertext))
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	padLen := int(plaintext[len(plaintext)-1])
+	if padLen == 0 || padLen > aes.BlockSize ||
+		!bytes.Equal(plaintext[len(plaintext)-padLen:], bytes.Repeat([]byte{byte(padLen)}, padLen)) {
+		return nil, fmt.Errorf("%w: bad padding", errBadEnvelope)
+	}
+	return plaintext[:len(plaintext)-padLen], nil
+}
+
+// berToDER converts the given BER encoding to DER, as far as encoding/asn1
+// needs it: indefinite lengths are replaced by definite lengths.  KMS encodes
+// its enveloped data with indefinite lengths.
+func berToDER(ber []byte) ([]byte, error) {
+	der, rest, err := convertBERElement(ber)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: trailing data", errBadEnvelope)
+	}
+	return der, nil
+}
+
+// convertBERElement converts the first element of the given BER encoding to
+// DER, and returns the remaining bytes.
+func convertBERElement(ber []byte) (der, rest []byte, err error) {
+	errTruncated := fmt.Errorf("%w: truncated element", errBadEnvelope)
+
+	// Parse the identifier, which may span several bytes for high tag numbers.
+	if len(ber) < 2 {
+		return nil, nil, errTruncated
+	}
+	idLen := 1
+	if ber[0]&0x1f == 0x1f {
+		for idLen < len(ber) && ber[idLen]&0x80 != 0 {
+			idLen++
+		}
+		idLen++
+	}
+	if idLen >= len(ber) {
+		return nil, nil, errTruncated
+	}
+	id, constructed := ber[:idLen], ber[0]&0x20 != 0
+
+	// Parse the length.
+	pos := idLen
+	lenByte := ber[pos]
+	pos++
+	var content []byte
+	switch {
+	case lenByte == 0x80:
+		if !constructed {
+			return nil, nil, fmt.Errorf("%w: primitive element with indefinite length", errBadEnvelope)
+		}
+		rest = ber[pos:]
+		for {
+			if len(rest) < 2 {
+				return nil, nil, errTruncated
+			}
+			if rest[0] == 0 && rest[1] == 0 {
+				rest = rest[2:]
+				break
+			}
+			var child []byte
+			if child, rest, err = convertBERElement(rest); err != nil {
+				return nil, nil, err
+			}
+			content = append(content, child...)
+		}
+		return append(append(append([]byte{}, id...), derLength(len(content))...), content...), rest, nil
+	case lenByte < 0x80:
+		if pos+int(lenByte) > len(ber) {
+			return nil, nil, errTruncated
+		}
+		content, rest = ber[pos:pos+int(lenByte)], ber[pos+int(lenByte):]
+	default:
+		numBytes := int(lenByte & 0x7f)
+		if numBytes > 4 || pos+numBytes > len(ber) {
+			return nil, nil, errTruncated
+		}
+		length := 0
+		for _, b := range ber[pos : pos+numBytes] {
+			length = length<<8 | int(b)
+		}
+		pos += numBytes
+		if length < 0 || pos+length > len(ber) {
+			return nil, nil, errTruncated
+		}
+		content, rest = ber[pos:pos+length], ber[pos+length:]
+	}
+
+	// The children of constructed elements may use indefinite lengths too.
+	if constructed {
+		var converted []byte
+		for remaining := content; len(remaining) > 0; {
+			var child []byte
+			if child, remaining, err = convertBERElement(remaining); err != nil {
+				return nil, nil, err
+			}
+			converted = append(converted, child...)
+		}
+		content = converted
+	}
+	return append(append(append([]byte{}, id...), derLength(len(content))...), content...), rest, nil
+}
+
+// derLength returns the DER encoding of the given length.
+func derLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var b []byte
+	for l := length; l > 0; l >>= 8 {
+		b = append([]byte{byte(l)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// sealEnvelope encrypts the given plaintext to the given public key, like KMS
+// does, and returns the resulting CMS EnvelopedData structure.
+func sealEnvelope(t *testing.T, plaintext []byte, pub *rsa.PublicKey) []byte {
+	cek, iv := make([]byte, 32), make([]byte, aes.BlockSize)
+	_, _ = rand.Read(cek)
+	_, _ = rand.Read(iv)
+	block, _ := aes.NewCipher(cek)
+	padLen := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, cek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ivDER, _ := asn1.Marshal(iv)
+	env, err := asn1.Marshal(cmsEnvelopedData{
+		Version: 2,
+		RecipientInfos: []cmsKeyTransRecipientInfo{{
+			Version:                2,
+			RecipientIdentifier:    asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: []byte("key-id")},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAESOAEP},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: cmsEncryptedContentInfo{
+			ContentType:                asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1},
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivDER}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(cmsContentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: env},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return toIndefiniteLength(t, der)
+}
+
+// toIndefiniteLength re-encodes the outermost element of the given DER
+// encoding with an indefinite length, as KMS does.
+func toIndefiniteLength(t *testing.T, der []byte) []byte {
+	var v asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &v); err != nil {
+		t.Fatal(err)
+	}
+	ber := append([]byte{der[0], 0x80}, v.Bytes...)
+	return append(ber, 0, 0)
+}
+
+func TestBERToDER(t *testing.T) {
+	// SEQUENCE { INTEGER 5, SEQUENCE { NULL } }, with indefinite lengths.
+	ber := []byte{0x30, 0x80, 0x02, 0x01, 0x05, 0x30, 0x80, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00}
+	der, err := berToDER(ber)
+	if err != nil {
+		t.Fatalf("Failed to convert BER to DER: %s", err)
+	}
+	expected := []byte{0x30, 0x07, 0x02, 0x01, 0x05, 0x30, 0x02, 0x05, 0x00}
+	if !bytes.Equal(der, expected) {
+		t.Fatalf("Expected %x but got %x.", expected, der)
+	}
+
+	for _, bad := range [][]byte{{0x30}, {0x30, 0x80, 0x02, 0x01}, {0x04, 0x80, 0x00, 0x00}, {0x30, 0x05, 0x02}} {
+		if _, err := berToDER(bad); err == nil {
+			t.Fatalf("Accepted malformed BER %x.", bad)
+		}
+	}
+}
+
+// fakeKMS implements just enough of KMS's Decrypt action for kmsDecrypter.  It
+// maps ciphertexts to their plaintexts.
+type fakeKMS struct {
+	t          *testing.T
+	plaintexts map[string][]byte
+}
+
+func (k *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		CiphertextBlob []byte
+		Recipient      struct {
+			AttestationDocument    []byte
+			KeyEncryptionAlgorithm string
+		}
+	}
+	if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" || json.NewDecoder(r.Body).Decode(&in) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	plaintext, exists := k.plaintexts[string(in.CiphertextBlob)]
+	if !exists || in.Recipient.KeyEncryptionAlgorithm != "RSAES_OAEP_SHA_256" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"__type":"InvalidCiphertextException","message":"bad ciphertext"}`))
+		return
+	}
+	// Our fake attestation document is just the public key.
+	pub, err := x509.ParsePKIXPublicKey(in.Recipient.AttestationDocument)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string][]byte{
+		"CiphertextForRecipient": sealEnvelope(k.t, plaintext, pub.(*rsa.PublicKey)),
+	})
+}
+
+// newTestKMSDecrypter returns a decrypter that talks to the given fake KMS
+// endpoint.
+func newTestKMSDecrypter(endpoint string, client *http.Client) *kmsDecrypter {
+	cfg := awsConfig("us-west-2", (&awsCredentials{AccessKeyID: "id", SecretAccessKey: "secret"}).provider(), client)
+	cfg.BaseEndpoint = aws.String(endpoint)
+	attest := func(pub []byte) ([]byte, error) { return pub, nil }
+	return newKMSDecrypter(cfg, attest)
+}
+
+func TestKMSDecrypter(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{0x42}, snapshotKeyLen)
+	srv := httptest.NewServer(&fakeKMS{t: t, plaintexts: map[string][]byte{
+		"key":        dataKey,
+		"creds":      []byte(`{"access_key_id": "AKID", "secret_access_key": "secret"}`),
+		"half-creds": []byte(`{"access_key_id": "AKID"}`),
+	}})
+	defer srv.Close()
+	k := newTestKMSDecrypter(srv.URL, srv.Client())
+
+	key, err := k.key([]byte("key"))()
+	if err != nil {
+		t.Fatalf("Failed to obtain key from KMS: %s", err)
+	}
+	if !bytes.Equal(key, dataKey) {
+		t.Fatalf("Expected key %x but got %x.", dataKey, key)
+	}
+	if _, err := k.key([]byte("foo"))(); err == nil {
+		t.Fatal("Expected KMS error for bad ciphertext.")
+	}
+
+	creds, err := k.credentials([]byte("creds")).Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to obtain credentials from KMS: %s", err)
+	}
+	if creds.AccessKeyID != "AKID" || creds.SecretAccessKey != "secret" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+	if _, err := k.credentials([]byte("half-creds")).Retrieve(context.Background()); !errors.Is(err, errBadCredentials) {
+		t.Fatalf("Expected error %q but got %v.", errBadCredentials, err)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
 	"time"
 
 	// This module must be imported first because of its side effects of
@@ -15,66 +18,190 @@ import (
 )
 
 const (
-	analyzerURL          = "https://example.com"
-	p3aEndpoint          = "/reports"
-	shufflerEndpoint     = "/encrypted-reports"
-	anonymityThreshold   = 10
-	defaultCrowdIDMethod = attrsAll
+	p3aEndpoint              = "/reports"
+	shufflerEndpoint         = "/encrypted-reports"
+	publicKeyEndpoint        = "/public-key"
+	batchAttestationEndpoint = "/batch-attestation"
+	metricsEndpoint          = "/metrics"
+	anonymityThreshold       = 10
 )
 
 var (
-	batchPeriod = time.Hour * 24
-	elog        = log.New(os.Stderr, "p3a-shuffler: ", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
+	defaultCrowdIDStrategy = strategyAll
+	batchPeriod            = time.Hour * 24
+	elog                   = log.New(os.Stderr, "p3a-shuffler: ", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
 )
 
-func deploymentMode() {
-	shuffler := NewShuffler(batchPeriod, anonymityThreshold, defaultCrowdIDMethod)
+func deploymentMode(cfg *deploymentConfig) {
+	period := time.Duration(cfg.BatchPeriod)
+	opts, err := cfg.shufflerOptions()
+	if err != nil {
+		elog.Fatalf("Failed to configure shuffler: %v", err)
+	}
+	manifest := cfg.manifestLoader()
+	if manifest != nil {
+		if err := manifest.load(); err != nil {
+			elog.Fatalf("Failed to load release manifest: %v", err)
+		}
+		manifest.Start()
+		elog.Printf("Loaded release manifest from %s.", cfg.ReleaseManifest)
+	}
+
+	shuffler := NewShuffler(period, cfg.AnonymityThreshold, cfg.crowdIDStrategy(), opts...)
 	shuffler.Start()
-	defer shuffler.Stop()
-	elog.Printf("Started shuffler with batch period of %s.", batchPeriod)
+	registerShufflerGauges(shuffler)
+	elog.Printf("Started shuffler with batch period of %s.", period)
+
+	signer, err := newBatchSigner()
+	if err != nil {
+		elog.Fatalf("Failed to generate batch signing key: %v", err)
+	}
 
-	forwarder := NewForwarder(shuffler.outbox, analyzerURL)
+	clientOpts, err := cfg.clientOptions()
+	if err != nil {
+		elog.Fatalf("Failed to configure HTTP client: %v", err)
+	}
+	forwarder, err := NewForwarder(shuffler.outbox, cfg.sinks(signer), clientOpts...)
+	if err != nil {
+		elog.Fatalf("Failed to configure forwarder: %v", err)
+	}
+	forwarder.ChunkSize = cfg.ChunkSize
 	forwarder.Start()
-	defer forwarder.Stop()
 	elog.Println("Started forwarder.")
 
-	enclave := nitriding.NewEnclave(
-		&nitriding.Config{
-			SOCKSProxy: "socks5://127.0.0.1:1080",
-			FQDN:       "nitro.nymity.ch",
-			Port:       8080,
-			Debug:      true,
-			UseACME:    false,
-		},
-	)
-	enclave.AddRoute(http.MethodPost, p3aEndpoint, createP3AHandler(shuffler.inbox))
-	enclave.AddRoute(http.MethodPost, shufflerEndpoint, createShufflerHandler(shuffler.inbox))
-	if err := enclave.Start(); err != nil {
+	key, err := newShufflerKey()
+	if err != nil {
+		elog.Fatalf("Failed to generate shuffler key: %v", err)
+	}
+
+	enclave := nitriding.NewEnclave(cfg.enclaveConfig())
+	handlerCfg := cfg.handlerConfig()
+	gate := &drainGate{}
+	enclave.AddRoute(http.MethodPost, p3aEndpoint,
+		gate.wrap(createP3AHandler(shuffler.inbox, handlerCfg), handlerCfg))
+	enclave.AddRoute(http.MethodPost, shufflerEndpoint,
+		gate.wrap(createShufflerHandler(shuffler.inbox, key, handlerCfg), handlerCfg))
+	enclave.AddRoute(http.MethodGet, publicKeyEndpoint, createPublicKeyHandler(key))
+	enclave.AddRoute(http.MethodGet, batchAttestationEndpoint, createBatchAttestationHandler(signer, nsmAttest))
+	enclave.AddRoute(http.MethodGet, metricsEndpoint, createMetricsHandler())
+
+	// The enclave's Start function doesn't return unless something goes
+	// wrong, so we run it in the background while we wait for a signal that
+	// tells us to shut down.
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- enclave.Start()
+	}()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-errChan:
 		elog.Fatalf("Enclave terminated: %v", err)
+	case sig := <-sigChan:
+		// Forward whatever reports meet our anonymity threshold before we
+		// exit, so that a rolling upgrade doesn't cost us a batch period.
+		timeout := time.Duration(cfg.DrainTimeout)
+		elog.Printf("Received %s.  Draining shuffler and forwarder within %s.", sig, timeout)
+		deadline := time.Now().Add(timeout)
+		// Stop accepting reports first, so that we don't acknowledge reports
+		// that arrive after the shuffler drained its inbox.
+		gate.close()
+		if manifest != nil {
+			manifest.Stop()
+		}
+		shuffler.Drain(time.Until(deadline))
+		forwarder.Drain(time.Until(deadline))
+		elog.Println("Drained shuffler and forwarder.  Exiting.")
 	}
 }
 
+// explicitFlag returns the value of the given command line flag if it was set
+// explicitly, and an empty string otherwise.
+func explicitFlag(name string) string {
+	var value string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			value = f.Value.String()
+		}
+	})
+	return value
+}
+
 func main() {
+	// The verify-batch subcommand is used by the analyzer and has its own
+	// flags.
+	if len(os.Args) > 1 && os.Args[1] == "verify-batch" {
+		if err := verifyBatchCommand(os.Args[2:], os.Stdout); err != nil {
+			elog.Fatalf("Failed to verify batch: %v", err)
+		}
+		return
+	}
+
 	dataDir := flag.String("datadir", "", "Directory pointing to local P3A measurements, as stored in the S3 bucket.")
 	simulate := flag.Bool("simulate", false, "Use simulation mode instead of deployment mode.")
 	attributeCSV := flag.Bool("attrcsv", false, "Print attributes instead of running simulation.")
 	entropy := flag.Bool("entropy", false, "Determine empirical entropy of all P3A attributes.")
+	thresholds := flag.String("thresholds", "", "Comma-separated k-anonymity thresholds or ranges to simulate, e.g. \"5,10,20-100:20\".")
+	order := flag.String("order", "first", "STAR attribute order to simulate: \"first\" (high-entropy attributes first), \"last\", or \"both\".")
+	simulation := flag.String("simulation", "both", "Simulation to run: \"shuffler\", \"star\", or \"both\".")
+	outputFile := flag.String("out", "", "File to which simulation results are written.  Results are written to stdout if empty.")
+	outputFormat := flag.String("format", "jsonl", "Format of simulation results: \"json\", \"jsonl\", or \"csv\" (one file per result type).")
+	noise := flag.String("noise", noiseLaplace, "Noise mechanism of simulated noisy thresholding: \"laplace\" or \"gaussian\".")
+	epsilons := flag.String("epsilons", "", "Comma-separated privacy parameters epsilon of simulated noisy thresholding, e.g. \"0.1,0.5,1\".")
+	delta := flag.Float64("delta", 1e-6, "Privacy parameter delta of simulated Gaussian noisy thresholding.")
+	dropFraction := flag.Float64("dropfraction", 0, "Fraction of reports that simulated noisy thresholding randomly drops.")
+	workers := flag.Int("workers", runtime.NumCPU(), "Number of simulation tasks to run concurrently.")
+	quarantineFile := flag.String("quarantine", "", "File to which rejected input lines are written in simulation mode.")
+	parseReportFile := flag.String("parsereport", "", "File to which per-file parse statistics are written in simulation mode.")
+	configFile := flag.String("config", "", "JSON- or YAML-encoded configuration file.  In simulation mode, only its crowd ID strategies and threshold policy are used.")
+	registerDeploymentFlags(flag.CommandLine)
 	flag.Parse()
 
 	if (*simulate || *entropy || *attributeCSV) && *dataDir == "" {
-		log.Fatal("Must use -datadir when -simulate, -attrcsv, or -entropy is provided.")
+		elog.Fatal("Must use -datadir when -simulate, -attrcsv, or -entropy is provided.")
 	}
 
 	// Are we supposed to use simulation mode or deployment mode?  In
 	// simulation mode, we don't take as input actual data; we only operate on
 	// offline data and produce a CSV.
 	if *simulate || *attributeCSV || *entropy {
-		simulationMode(&simulationConfig{
-			DataDir:      *dataDir,
-			AttributeCSV: *attributeCSV,
-			Entropy:      *entropy,
-		})
+		// The configuration's crowd ID strategies are simulated alongside
+		// our built-in strategies.  Our flags mean something else in
+		// simulation mode, so we don't apply them to the configuration.
+		var registry *strategyRegistry
+		var policy *thresholdPolicy
+		if *configFile != "" {
+			var err error
+			if registry, policy, err = loadSimulationConfig(*configFile); err != nil {
+				elog.Fatalf("Failed to load configuration: %v", err)
+			}
+		}
+		simCfg := &simulationConfig{
+			DataDir:         *dataDir,
+			AttributeCSV:    *attributeCSV,
+			Entropy:         *entropy,
+			QuarantineFile:  *quarantineFile,
+			ParseReportFile: *parseReportFile,
+			OutputFile:      *outputFile,
+			OutputFormat:    *outputFormat,
+			Workers:         *workers,
+			Registry:        registry,
+			Policy:          policy,
+		}
+		err := simCfg.setSweep(*thresholds, explicitFlag("threshold"), explicitFlag("crowdid"), *order, *simulation)
+		if err != nil {
+			elog.Fatalf("Bad simulation flags: %v", err)
+		}
+		if err := simCfg.setNoise(*noise, *epsilons, *delta, *dropFraction); err != nil {
+			elog.Fatalf("Bad noise flags: %v", err)
+		}
+		simulationMode(simCfg)
 	} else {
-		deploymentMode()
+		cfg, err := loadDeploymentConfig(*configFile, flag.CommandLine)
+		if err != nil {
+			elog.Fatalf("Failed to load configuration: %v", err)
+		}
+		deploymentMode(cfg)
 	}
 }
@@ -0,0 +1,200 @@
+package main
+
+// This file implements signed release manifests, which tell the shuffler what
+// Brave releases exist per channel.  Without a manifest, the shuffler learns
+// the latest version from the measurements it receives, so a single spoofed
+// client that reports a made-up version could make every real client's
+// version look outdated.  A manifest file has the following format:
+//
+//	{
+//	  "manifest": "<Base64-encoded manifest>",
+//	  "signature": "<Base64-encoded Ed25519 signature over the manifest>"
+//	}
+//
+// The decoded manifest is JSON-encoded, e.g.:
+//
+//	{
+//	  "issued": "2022-04-01T00:00:00Z",
+//	  "releases": {
+//	    "release": ["1.36.68", "1.37.109"],
+//	    "beta": ["1.38.90"]
+//	  }
+//	}
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultManifestInterval determines how often we re-read the release
+	// manifest.
+	defaultManifestInterval = time.Hour
+)
+
+var (
+	errBadManifestSignature = errors.New("release manifest has invalid signature")
+	errManifestRollback     = errors.New("release manifest is older than the current one")
+	errEmptyManifest        = errors.New("release manifest contains no releases")
+)
+
+// signedManifest represents a release manifest and its signature, as it's
+// stored on disk.
+type signedManifest struct {
+	Manifest  []byte `json:"manifest"`
+	Signature []byte `json:"signature"`
+}
+
+// releaseManifest represents the releases of Brave per channel.
+type releaseManifest struct {
+	Issued   time.Time           `json:"issued"`
+	Releases map[string][]string `json:"releases"`
+}
+
+// latest returns the latest release of every channel in the manifest.
+func (m *releaseManifest) latest() (map[string]*version, error) {
+	latest := make(map[string]*version)
+	for channel, releases := range m.Releases {
+		for _, r := range releases {
+			v, err := parseVersion(r)
+			if err != nil {
+				return nil, fmt.Errorf("bad release in channel %q: %w", channel, err)
+			}
+			if l, exists := latest[channel]; !exists || v.newerThan(l) {
+				latest[channel] = v
+			}
+		}
+	}
+	if len(latest) == 0 {
+		return nil, errEmptyManifest
+	}
+	return latest, nil
+}
+
+// parseReleaseManifestKey parses a hex-encoded Ed25519 public key.
+func parseReleaseManifestKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("release manifest key is not hex-encoded: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("release manifest key must be %d bytes but is %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verifyReleaseManifest checks the signature of the given manifest file
+// against the given public key and returns the decoded manifest.
+func verifyReleaseManifest(blob []byte, pubKey ed25519.PublicKey) (*releaseManifest, error) {
+	var signed signedManifest
+	if err := json.Unmarshal(blob, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse release manifest file: %w", err)
+	}
+	if !ed25519.Verify(pubKey, signed.Manifest, signed.Signature) {
+		return nil, errBadManifestSignature
+	}
+	var m releaseManifest
+	if err := json.Unmarshal(signed.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse release manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// manifestLoader periodically loads a release manifest from a file and hands
+// its latest releases to a version tracker.
+type manifestLoader struct {
+	sync.WaitGroup
+	path     string
+	pubKey   ed25519.PublicKey
+	tracker  *VersionTracker
+	interval time.Duration
+	// issued is the issue time of the manifest that we currently use, or the
+	// configured minimum until we loaded our first manifest.
+	issued time.Time
+	pinned bool
+	done   chan bool
+}
+
+// newManifestLoader returns a new manifest loader that reads the manifest at
+// the given path every interval, and only accepts manifests that are signed
+// by the given key and that were issued no earlier than the given minimum.
+func newManifestLoader(path string, pubKey ed25519.PublicKey, tracker *VersionTracker, interval time.Duration, minIssued time.Time) *manifestLoader {
+	return &manifestLoader{
+		path:     path,
+		pubKey:   pubKey,
+		tracker:  tracker,
+		interval: interval,
+		issued:   minIssued,
+		done:     make(chan bool),
+	}
+}
+
+// load reads and verifies the manifest, and pins the version tracker to the
+// manifest's latest releases.  We refuse manifests that were issued before
+// the one we already have, so an attacker cannot roll us back to an old but
+// validly-signed manifest.  We only remember the current manifest in memory,
+// though.  After a restart, the configured minimum issue time is all that
+// keeps the host from feeding us an older manifest.  The first manifest is
+// pinned right away, before the first batch period starts.  Later manifests
+// are only staged, and the shuffler pins them at the end of the current batch
+// period.
+func (l *manifestLoader) load() error {
+	blob, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	m, err := verifyReleaseManifest(blob, l.pubKey)
+	if err != nil {
+		return err
+	}
+	if m.Issued.Before(l.issued) {
+		return fmt.Errorf("%w: issued at %s", errManifestRollback, m.Issued)
+	}
+	latest, err := m.latest()
+	if err != nil {
+		return err
+	}
+	if !l.pinned {
+		l.tracker.Pin(latest)
+		l.pinned = true
+	} else {
+		l.tracker.StagePin(latest)
+	}
+	l.issued = m.Issued
+	return nil
+}
+
+// Start starts refreshing the manifest in the background.  If a refresh
+// fails, we keep using the manifest that we already have.
+func (l *manifestLoader) Start() {
+	l.Add(1)
+	go func() {
+		defer l.Done()
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+				if err := l.load(); err != nil {
+					elog.Printf("Failed to refresh release manifest: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing the manifest.
+func (l *manifestLoader) Stop() {
+	l.done <- true
+	l.Wait()
+}
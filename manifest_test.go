@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeManifest(t *testing.T, path string, privKey ed25519.PrivateKey, m *releaseManifest) {
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %s", err)
+	}
+	blob, err := json.Marshal(&signedManifest{
+		Manifest:  manifest,
+		Signature: ed25519.Sign(privKey, manifest),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal signed manifest: %s", err)
+	}
+	if err := os.WriteFile(path, blob, 0600); err != nil {
+		t.Fatalf("Failed to write manifest: %s", err)
+	}
+}
+
+func TestReleaseManifest(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	issued := time.Now().UTC()
+	writeManifest(t, path, privKey, &releaseManifest{
+		Issued: issued,
+		Releases: map[string][]string{
+			"release": {"1.36.68", "1.37.109", "1.37.100"},
+		},
+	})
+
+	tracker := NewVersionTracker()
+	l := newManifestLoader(path, pubKey, tracker, time.Hour, issued.Add(-time.Minute))
+	if err := l.load(); err != nil {
+		t.Fatalf("Failed to load manifest: %s", err)
+	}
+	for _, test := range []struct {
+		channel, version string
+		recent           bool
+	}{
+		{"release", "1.37.109", true},
+		{"release", "1.36.68", false},
+		{"release", "1.37.110", false}, // Future versions aren't recent.
+		{"release", "999.0.0", false},
+		{"release", "1.37.109", true}, // Spoofed versions mustn't change anything.
+		{"beta", "1.37.109", false},   // Channels that aren't in the manifest.
+	} {
+		recent, _ := tracker.IsRecent(test.channel, test.version)
+		if recent != test.recent {
+			t.Fatalf("Expected recentness of %s on %s to be %v.", test.version, test.channel, test.recent)
+		}
+	}
+
+	// An older manifest must be refused, even if it's validly signed.
+	writeManifest(t, path, privKey, &releaseManifest{
+		Issued:   issued.Add(-time.Hour),
+		Releases: map[string][]string{"release": {"1.36.68"}},
+	})
+	if err := l.load(); !errors.Is(err, errManifestRollback) {
+		t.Fatalf("Expected error %q but got %v.", errManifestRollback, err)
+	}
+
+	// A manifest that's signed by another key must be refused.
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeManifest(t, path, otherKey, &releaseManifest{
+		Issued:   issued.Add(time.Hour),
+		Releases: map[string][]string{"release": {"999.0.0"}},
+	})
+	if err := l.load(); err != errBadManifestSignature {
+		t.Fatalf("Expected error %q but got %v.", errBadManifestSignature, err)
+	}
+	if latest, _ := tracker.Latest("release"); latest != "1.37.109" {
+		t.Fatalf("Expected latest version 1.37.109 but got %s.", latest)
+	}
+
+	writeManifest(t, path, privKey, &releaseManifest{Issued: issued.Add(time.Hour)})
+	if err := l.load(); err != errEmptyManifest {
+		t.Fatalf("Expected error %q but got %v.", errEmptyManifest, err)
+	}
+
+	// Later manifests only take effect at the end of the batch period.
+	writeManifest(t, path, privKey, &releaseManifest{
+		Issued:   issued.Add(time.Hour),
+		Releases: map[string][]string{"release": {"1.38.1"}},
+	})
+	if err := l.load(); err != nil {
+		t.Fatalf("Failed to load manifest: %s", err)
+	}
+	if latest, _ := tracker.Latest("release"); latest != "1.37.109" {
+		t.Fatalf("Expected staged manifest to be pending but got latest version %s.", latest)
+	}
+	tracker.ApplyStagedPin()
+	if latest, _ := tracker.Latest("release"); latest != "1.38.1" {
+		t.Fatalf("Expected latest version 1.38.1 but got %s.", latest)
+	}
+
+	// After a restart, the minimum issue time must keep us from accepting
+	// the manifest that we had before.
+	writeManifest(t, path, privKey, &releaseManifest{
+		Issued:   issued,
+		Releases: map[string][]string{"release": {"1.37.109"}},
+	})
+	l = newManifestLoader(path, pubKey, NewVersionTracker(), time.Hour, issued.Add(time.Hour))
+	if err := l.load(); !errors.Is(err, errManifestRollback) {
+		t.Fatalf("Expected error %q but got %v.", errManifestRollback, err)
+	}
+}
+
+func TestReleaseManifestKey(t *testing.T) {
+	if _, err := parseReleaseManifestKey("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"); err != nil {
+		t.Fatalf("Failed to parse key: %s", err)
+	}
+	for _, key := range []string{"", "foo", "d75a9801"} {
+		if _, err := parseReleaseManifestKey(key); err == nil {
+			t.Fatalf("Accepted bad key %q.", key)
+		}
+	}
+}
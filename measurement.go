@@ -1,34 +1,19 @@
 package main
 
 import (
-	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
-	"strings"
-)
-
-const (
-	attrsAll        = iota // All attributes are used for k-anonymity.
-	attrsRefactored        // Our current set of attributes.
-	attrsMinimal           // A minimal set of attributes.
 )
 
 var (
-	anonymityAttrs = map[int]string{
-		attrsAll:        "All",
-		attrsRefactored: "Refactored",
-		attrsMinimal:    "Minimal",
-	}
-	lastVersion = map[string]*version{
-		"nightly":   newVersion("0.0.0"),
-		"release":   newVersion("0.0.0"),
-		"beta":      newVersion("0.0.0"),
-		"canary":    newVersion("0.0.0"),
-		"dev":       newVersion("0.0.0"),
-		"developer": newVersion("0.0.0"),
-		"unknown":   newVersion("0.0.0"),
-		"":          newVersion("0.0.0"),
-	}
+	errBadYear             = errors.New("year of survey or install is before 1970")
+	errBadWeekOfSurvey     = errors.New("week of survey is not in [1, 53]")
+	errBadWeekOfInstall    = errors.New("week of install is not in [1, 53]")
+	errBadMetricValue      = errors.New("metric value is negative")
+	errNoMetricName        = errors.New("metric name is empty")
+	errNoPlatformOrVersion = errors.New("platform or version is empty")
+	errNoChannel           = errors.New("channel is empty")
 )
 
 // ShufflerMeasurement represents an encrypted measurement for the shuffler.
@@ -36,6 +21,26 @@ type ShufflerMeasurement struct {
 	Encrypted []byte `json:"encrypted"`
 }
 
+// ShufflerReport represents the content of a decrypted ShufflerMeasurement.
+// It consists of a crowd ID that's chosen by the client and a payload that is
+// opaque to the shuffler because it's encrypted for the analyzer.
+// ShufflerReport also implements the Report interface.
+type ShufflerReport struct {
+	ID   CrowdID `json:"crowd_id"`
+	Data []byte  `json:"payload"`
+}
+
+// CrowdID returns the report's keyed crowd ID.  The given strategy is ignored
+// because the client already determined the crowd ID.
+func (r ShufflerReport) CrowdID(strategy CrowdIDStrategy, key crowdIDKey) CrowdID {
+	return key.crowdID([]string{string(r.ID)})
+}
+
+// Payload returns the report's opaque payload.
+func (r ShufflerReport) Payload() ([]byte, error) {
+	return r.Data, nil
+}
+
 // P3AMeasurement represents a P3A measurement as it's sent by Brave clients.
 // See the browser code for how measurements are created:
 // https://github.com/brave/brave-core/blob/1adaa0bc057a83f432e9c278c7c373ef60a5b766/components/p3a/p3a_measurement.cc#L70
@@ -54,30 +59,36 @@ type P3AMeasurement struct {
 	RefCode       string `json:"refcode"`
 }
 
-// IsValid returns true if the given P3A measurement is valid.
-func (m P3AMeasurement) IsValid() bool {
+// Validate returns nil if the given P3A measurement is valid, and otherwise
+// an error that explains which of our rules the measurement violates.
+func (m P3AMeasurement) Validate() error {
 	if m.YearOfSurvey < 1970 || m.YearOfInstall < 1970 {
-		return false
+		return errBadYear
 	}
 	if m.WeekOfSurvey < 1 || m.WeekOfSurvey > 53 {
-		return false
+		return errBadWeekOfSurvey
 	}
 	if m.WeekOfInstall < 1 || m.WeekOfInstall > 53 {
-		return false
+		return errBadWeekOfInstall
 	}
 	if m.MetricValue < 0 {
-		return false
+		return errBadMetricValue
 	}
 	if m.MetricName == "" {
-		return false
+		return errNoMetricName
 	}
 	if m.Platform == "" || m.Version == "" {
-		return false
+		return errNoPlatformOrVersion
 	}
 	if m.Channel == "" {
-		return false
+		return errNoChannel
 	}
-	return true
+	return nil
+}
+
+// IsValid returns true if the given P3A measurement is valid.
+func (m P3AMeasurement) IsValid() bool {
+	return m.Validate() == nil
 }
 
 // String returns a human-readable string representation of the P3A
@@ -104,150 +115,22 @@ func (m P3AMeasurement) String() string {
 
 // OrderHighEntropyFirst turns the measurement into a a slice of strings,
 // ordered by entropy, with high-entropy attributes coming first.  The argument
-// 'method' determines what attributes are returned.
-func (m P3AMeasurement) OrderHighEntropyFirst(method int) []string {
-	switch method {
-	case attrsAll:
-		return []string{
-			// The following entropy numbers came from running:
-			// p3a-shuffler -simulate -datadir 2022-03-27 -entropy
-			m.MetricName,                       // 0.90
-			fmt.Sprintf("%d", m.MetricValue),   // 0.66
-			fmt.Sprintf("%d", m.WeekOfInstall), // 0.93
-			m.CountryCode,                      // 0.72
-			m.Platform,                         // 0.57
-			fmt.Sprintf("%d", m.YearOfInstall), // 0.40
-			m.Version,                          // 0.25
-			m.RefCode,                          // 0.17
-			fmt.Sprintf("%d", m.WeekOfSurvey),  // 0.15
-			m.Channel,                          // 0.03
-			fmt.Sprintf("%d", m.YearOfSurvey),  // 0.00
-		}
-	case attrsMinimal:
-		return []string{
-			m.MetricName,
-			fmt.Sprintf("%d", m.MetricValue),
-			fmt.Sprintf("%d", m.WeekOfInstall),
-			m.CountryCode,
-			m.Platform,
-			m.Channel,
-			fmt.Sprintf("%t", isRecentVersion(m.Channel, m.Version)),
-		}
-	case attrsRefactored:
-		return []string{
-			m.MetricName,
-			fmt.Sprintf("%d", m.MetricValue),
-			fmt.Sprintf("%d", m.WeekOfInstall),
-			m.CountryCode,
-			m.Platform,
-			m.Channel,
-			fmt.Sprintf("%d", m.YearOfInstall),
-			fmt.Sprintf("%d", m.WeekOfSurvey),
-			fmt.Sprintf("%d", m.YearOfSurvey),
-			fmt.Sprintf("%t", isRecentVersion(m.Channel, m.Version)),
-		}
-	default:
-		elog.Fatalf("Unexpected method for measurement: %d", method)
-		return []string{}
-	}
+// 'strategy' determines what attributes are returned.
+func (m P3AMeasurement) OrderHighEntropyFirst(strategy CrowdIDStrategy) []string {
+	return strategy.Attributes(m)
 }
 
 // OrderHighEntropyLast returns the reverse ordering of OrderHighEntropyFirst.
-func (m P3AMeasurement) OrderHighEntropyLast(method int) []string {
-	orig := m.OrderHighEntropyFirst(method)
+func (m P3AMeasurement) OrderHighEntropyLast(strategy CrowdIDStrategy) []string {
+	orig := m.OrderHighEntropyFirst(strategy)
 	reversed := []string{}
-	reversed = append(reversed, m.MetricName)
-	reversed = append(reversed, fmt.Sprintf("%d", m.MetricValue))
+	reversed = append(reversed, orig[0], orig[1])
 	for i := len(orig) - 1; i >= 2; i-- {
 		reversed = append(reversed, orig[i])
 	}
 	return reversed
 }
 
-// version represents a Brave Browser version, which is based on semantic
-// versioning.
-type version struct {
-	major int
-	minor int
-	patch int
-}
-
-// newerThan returns true if the given version is newer than the object's
-// version.
-func (v1 *version) newerThan(v2 *version) bool {
-	if v1.major > v2.major {
-		return true
-	}
-	if v1.major < v2.major {
-		return false
-	}
-	// Major version numbers are identical.
-	if v1.minor > v2.minor {
-		return true
-	}
-	if v1.minor < v2.minor {
-		return false
-	}
-	// Minor version numbers are identical.
-	if v1.patch > v2.patch {
-		return true
-	}
-	return false
-}
-
-// isEqual returns true if the given version is identical to the object's
-// version.
-func (v1 *version) isEqual(v2 *version) bool {
-	return v1.major == v2.major && v1.minor == v2.minor && v1.patch == v2.patch
-}
-
-// newVersion returns a new version for the given version string.
-func newVersion(strVersion string) *version {
-	var err error
-	attrs := strings.Split(strVersion, ".")
-	v := &version{}
-
-	v.major, err = strconv.Atoi(attrs[0])
-	if err != nil {
-		elog.Fatalf("Couldn't convert major version number %s to int.", attrs[0])
-	}
-	v.minor, err = strconv.Atoi(attrs[1])
-	if err != nil {
-		elog.Fatalf("Couldn't convert minor version number %s to int.", attrs[1])
-	}
-	v.patch, err = strconv.Atoi(attrs[2])
-	if err != nil {
-		elog.Fatalf("Couldn't convert patch version number %s to int.", attrs[2])
-	}
-
-	return v
-}
-
-// isRecentVersion returns true if the given version is identical to or newer
-// than the latest version we've seen so far for the given channel.  Note that
-// the function updates the latest versions as it's seeing newer versions.  The
-// fact that we update the latest version as we're going through measurements
-// means that we will have a small number of false positives but that doesn't
-// matter considering that we're processing millions of measurements.
-func isRecentVersion(channel, strVersion string) bool {
-	maybeLastVersion, exists := lastVersion[channel]
-	if !exists {
-		elog.Printf("Got unexpected channel %q.", channel)
-		return false
-	}
-	if strVersion == "" {
-		return false
-	}
-
-	version := newVersion(strVersion)
-	if version.newerThan(maybeLastVersion) {
-		elog.Printf("Updating latest version for %s to %s.", channel, strVersion)
-		lastVersion[channel] = version
-		return true
-	}
-	return version.isEqual(maybeLastVersion)
-}
-
 // CSVHeader returns the header for a CSV-formatted file that contains P3A
 // measurements.
 func (m P3AMeasurement) CSVHeader() string {
@@ -264,17 +147,60 @@ func (m P3AMeasurement) CSV() string {
 		m.Channel, m.RefCode)
 }
 
-// CrowdID returns the crowd ID of the P3A measurement.
-func (m P3AMeasurement) CrowdID(method int) CrowdID {
-	// No need to do anything extravagant here.  Simply get an ordered slice
-	// for the given measurement, hash it, and return it.
-	attrs := m.OrderHighEntropyFirst(method)
-	payload := []byte(strings.Join(attrs, ""))
-	hash := fmt.Sprintf("%x", sha1.Sum(payload))
-	return CrowdID(hash)
+// CrowdID returns the crowd ID of the P3A measurement, keyed with the given
+// key.
+func (m P3AMeasurement) CrowdID(strategy CrowdIDStrategy, key crowdIDKey) CrowdID {
+	return key.crowdID(m.OrderHighEntropyFirst(strategy))
 }
 
-// Payload returns the P3A measurement's payload.
-func (m P3AMeasurement) Payload() []byte {
-	return []byte(m.String())
+// Payload returns the JSON-encoded P3A measurement.
+func (m P3AMeasurement) Payload() ([]byte, error) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal P3A measurement: %w", err)
+	}
+	return payload, nil
+}
+
+// PartialMeasurement represents a P3A measurement of which only a prefix of
+// its attributes (in the order of a crowd ID strategy) met our anonymity
+// threshold.  All other attributes are redacted.  PartialMeasurement also
+// implements the Report interface.
+type PartialMeasurement struct {
+	// Attributes maps the names of the unlocked attributes to their
+	// (possibly transformed) values.
+	Attributes map[string]string `json:"attributes"`
+	// Redacted contains the names of the redacted attributes.
+	Redacted []string `json:"redacted"`
+	prefix   []string
+}
+
+// NewPartialMeasurement returns the given measurement with all but the first
+// 'length' attributes of the given strategy redacted.
+func NewPartialMeasurement(m P3AMeasurement, strategy CrowdIDStrategy, length int) *PartialMeasurement {
+	names, values := strategy.AttributeNames(), m.OrderHighEntropyFirst(strategy)
+	p := &PartialMeasurement{
+		Attributes: make(map[string]string),
+		Redacted:   append([]string{}, names[length:]...),
+		prefix:     values[:length],
+	}
+	for i := 0; i < length; i++ {
+		p.Attributes[names[i]] = values[i]
+	}
+	return p
+}
+
+// CrowdID returns the crowd ID of the partial measurement's unlocked
+// attributes, keyed with the given key.
+func (p *PartialMeasurement) CrowdID(strategy CrowdIDStrategy, key crowdIDKey) CrowdID {
+	return key.crowdID(p.prefix)
+}
+
+// Payload returns the JSON-encoded partial measurement.
+func (p *PartialMeasurement) Payload() ([]byte, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal partial measurement: %w", err)
+	}
+	return payload, nil
 }
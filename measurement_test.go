@@ -20,23 +20,23 @@ var m P3AMeasurement = P3AMeasurement{
 }
 
 func TestCrowdIDs(t *testing.T) {
-	fullCrowdID1 := m.CrowdID(attrsAll)
-	originCrowdID1 := m.CrowdID(attrsMinimal)
+	fullCrowdID1 := m.CrowdID(strategyAll, testCrowdIDKey)
+	originCrowdID1 := m.CrowdID(strategyMinimal, testCrowdIDKey)
 
 	if fullCrowdID1 == originCrowdID1 {
 		t.Fatalf("Full and origin crowd ID are unlikely to be identical.")
 	}
 
 	m.MetricValue++
-	fullCrowdID2 := m.CrowdID(attrsAll)
+	fullCrowdID2 := m.CrowdID(strategyAll, testCrowdIDKey)
 	if fullCrowdID2 == fullCrowdID1 {
 		t.Fatalf("Full crowd ID must be affected when metric value changes.")
 	}
 }
 
 func TestOrdering(t *testing.T) {
-	hef := m.OrderHighEntropyFirst(attrsAll)
-	hel := m.OrderHighEntropyLast(attrsAll)
+	hef := m.OrderHighEntropyFirst(strategyAll)
+	hel := m.OrderHighEntropyLast(strategyAll)
 
 	if len(hef) != 11 || len(hel) != 11 {
 		t.Fatalf("Measurement doesn't have expected number of attributes.")
@@ -73,6 +73,9 @@ func TestIsValid(t *testing.T) {
 	if badM.IsValid() {
 		t.Fatal("Bad measurement considered valid despite not having metric name.")
 	}
+	if err := badM.Validate(); err != errNoMetricName {
+		t.Fatalf("Expected error %q but got %v.", errNoMetricName, err)
+	}
 }
 
 func TestCSV(t *testing.T) {
@@ -82,41 +85,3 @@ func TestCSV(t *testing.T) {
 		t.Fatal("CSV header and record don't have the same number of commas.")
 	}
 }
-
-func TestVersions(t *testing.T) {
-	if !newVersion("0.0.1").newerThan(newVersion("0.0.0")) {
-		t.Fatal("expected 0.0.1 to be newer than 0.0.0")
-	}
-	if !newVersion("1.2.3").newerThan(newVersion("1.2.2")) {
-		t.Fatal("expected 1.2.3 to be newer than 1.2.2")
-	}
-	if !newVersion("1.0.0").newerThan(newVersion("0.1.1")) {
-		t.Fatal("expected 1.0.0 to be newer than 0.1.1")
-	}
-
-	if newVersion("1.0.0").newerThan(newVersion("1.0.0")) {
-		t.Fatal("identical version cannot be newer")
-	}
-	if !newVersion("1.0.0").isEqual(newVersion("1.0.0")) {
-		t.Fatal("identical version considered not identical")
-	}
-	if newVersion("1.0.0").isEqual(newVersion("2.0.0")) {
-		t.Fatal("different version considered identical")
-	}
-
-	if !isRecentVersion("release", "0.0.1") {
-		t.Fatal("first seen version not considered recent")
-	}
-	if !isRecentVersion("release", "0.0.2") {
-		t.Fatal("newer version not considered recent")
-	}
-	if !isRecentVersion("release", "1.0.0") {
-		t.Fatal("newer version not considered recent")
-	}
-	if isRecentVersion("release", "0.9.0") {
-		t.Fatal("old version considered recent")
-	}
-	if !isRecentVersion("release", "1.0.0") {
-		t.Fatal("new version not considered recent")
-	}
-}
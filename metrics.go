@@ -0,0 +1,272 @@
+package main
+
+// This file implements a minimal set of Prometheus metrics and exposes them in
+// Prometheus's text-based exposition format.  Note that none of our metrics
+// must contain per-crowd data because that would weaken our k-anonymity
+// guarantees.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsPrefix = "p3a_shuffler_"
+)
+
+var (
+	// durationBuckets contains the upper bounds (in seconds) of the buckets
+	// of our duration histograms.
+	durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+	registry = &metricsRegistry{}
+	metrics  = struct {
+		reportsReceived  *counter
+		reportsRejected  *counterVec
+		crowdIDsDropped  *counter
+		reportsDropped   *counter
+		reportsRedacted  *counter
+		reportsForwarded *counterVec
+		reportsLost      *counter
+		forwardFailures  *counterVec
+		forwardDuration  *histogram
+		batchDuration    *histogram
+	}{
+		reportsReceived: registry.counter("reports_received_total",
+			"Number of reports that clients sent to the shuffler."),
+		reportsRejected: registry.counterVec("reports_rejected_total",
+			"Number of reports that the shuffler rejected upon receipt.", "reason"),
+		crowdIDsDropped: registry.counter("crowd_ids_dropped_total",
+			"Number of crowd IDs that were dropped for not meeting the anonymity threshold."),
+		reportsDropped: registry.counter("reports_dropped_total",
+			"Number of reports that were dropped for not meeting the anonymity threshold."),
+		reportsRedacted: registry.counter("reports_redacted_total",
+			"Number of reports whose attributes were partially redacted for not meeting the anonymity threshold."),
+		reportsForwarded: registry.counterVec("reports_forwarded_total",
+			"Number of reports that were forwarded, per sink.", "sink"),
+		reportsLost: registry.counter("reports_lost_total",
+			"Number of reports that the forwarder permanently failed to forward."),
+		forwardFailures: registry.counterVec("forward_failures_total",
+			"Number of failed attempts to forward a chunk, per sink.", "sink"),
+		forwardDuration: registry.histogram("forward_duration_seconds",
+			"Duration of attempts to forward a chunk to a sink.", durationBuckets),
+		batchDuration: registry.histogram("batch_duration_seconds",
+			"Time it takes to threshold and shuffle a batch at the end of a batch period.", durationBuckets),
+	}
+)
+
+// metric is implemented by everything that can write itself in Prometheus's
+// text-based exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricsRegistry keeps track of all metrics that we expose.
+type metricsRegistry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.Lock()
+	defer r.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// counter registers and returns a new counter.
+func (r *metricsRegistry) counter(name, help string) *counter {
+	c := &counter{name: metricsPrefix + name, help: help}
+	r.register(c)
+	return c
+}
+
+// counterVec registers and returns a new counter that is partitioned by the
+// given label.
+func (r *metricsRegistry) counterVec(name, help, label string) *counterVec {
+	c := &counterVec{name: metricsPrefix + name, help: help, label: label, values: make(map[string]int64)}
+	r.register(c)
+	return c
+}
+
+// gauge registers a new gauge whose value is determined by calling the given
+// function at scrape time.
+func (r *metricsRegistry) gauge(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{name: metricsPrefix + name, help: help, fn: fn})
+}
+
+// histogram registers and returns a new histogram with the given buckets.
+func (r *metricsRegistry) histogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{
+		name:    metricsPrefix + name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	r.register(h)
+	return h
+}
+
+// write writes all registered metrics to the given writer.
+func (r *metricsRegistry) write(w io.Writer) {
+	r.Lock()
+	defer r.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// counter represents a monotonically increasing value.
+type counter struct {
+	name  string
+	help  string
+	value int64
+}
+
+func (c *counter) Add(n int) {
+	atomic.AddInt64(&c.value, int64(n))
+}
+
+func (c *counter) Inc() {
+	c.Add(1)
+}
+
+func (c *counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+func (c *counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// counterVec represents a set of counters that are distinguished by the value
+// of a single label.
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]int64
+}
+
+func (c *counterVec) Add(labelValue string, n int) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[labelValue] += int64(n)
+}
+
+func (c *counterVec) Value(labelValue string) int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	labelValues := make([]string, 0, len(c.values))
+	for labelValue := range c.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, labelValue, c.values[labelValue])
+	}
+}
+
+// gaugeFunc represents a value that can go up and down.  The value is
+// determined at scrape time.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// histogram samples observations and counts them in buckets.
+type histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveSince observes the time that elapsed since the given time.
+func (h *histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, upperBound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(upperBound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// registerShufflerGauges registers gauges that expose the state of the given
+// shuffler.
+func registerShufflerGauges(s *Shuffler) {
+	registry.gauge("briefcase_reports", "Number of reports in the briefcase.",
+		func() float64 { return float64(s.briefcase.NumReports()) })
+	registry.gauge("briefcase_crowd_ids", "Number of crowd IDs in the briefcase.",
+		func() float64 { return float64(s.briefcase.NumCrowdIDs()) })
+	registry.gauge("inbox_depth", "Number of requests waiting in the shuffler's inbox.",
+		func() float64 { return float64(s.QueueDepth()) })
+	registry.gauge("inbox_capacity", "Number of requests that the shuffler's inbox can buffer.",
+		func() float64 { return float64(cap(s.inbox)) })
+}
+
+// createMetricsHandler creates a handler that exposes our metrics in
+// Prometheus's text-based exposition format.
+func createMetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		registry.write(w)
+	}
+}
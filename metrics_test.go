@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	r := &metricsRegistry{}
+	c := r.counter("foo_total", "Foo.")
+	v := r.counterVec("bar_total", "Bar.", "reason")
+	h := r.histogram("baz_seconds", "Baz.", []float64{1, 10})
+	r.gauge("qux", "Qux.", func() float64 { return 42 })
+
+	c.Add(3)
+	v.Add("invalid", 2)
+	h.Observe(0.5)
+	h.Observe(5)
+	h.Observe(50)
+
+	var b strings.Builder
+	r.write(&b)
+	for _, line := range []string{
+		"# TYPE p3a_shuffler_foo_total counter",
+		"p3a_shuffler_foo_total 3",
+		`p3a_shuffler_bar_total{reason="invalid"} 2`,
+		`p3a_shuffler_baz_seconds_bucket{le="1"} 1`,
+		`p3a_shuffler_baz_seconds_bucket{le="10"} 2`,
+		`p3a_shuffler_baz_seconds_bucket{le="+Inf"} 3`,
+		"p3a_shuffler_baz_seconds_sum 55.5",
+		"p3a_shuffler_baz_seconds_count 3",
+		"# TYPE p3a_shuffler_qux gauge",
+		"p3a_shuffler_qux 42",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Fatalf("Expected line %q in output:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	before := metrics.crowdIDsDropped.Value()
+	b := getFullBriefcase(10, 10)
+	b.DumpFewerThan(2)
+	if metrics.crowdIDsDropped.Value()-before != 10 {
+		t.Fatalf("Expected 10 dropped crowd IDs but got %d.", metrics.crowdIDsDropped.Value()-before)
+	}
+
+	w := httptest.NewRecorder()
+	createMetricsHandler()(w, httptest.NewRequest(http.MethodGet, metricsEndpoint, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "p3a_shuffler_crowd_ids_dropped_total") {
+		t.Fatal("Metrics don't contain number of dropped crowd IDs.")
+	}
+}
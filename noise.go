@@ -0,0 +1,268 @@
+package main
+
+// This file implements noisy thresholding, which makes our anonymity threshold
+// differentially private.  With a deterministic threshold, an adversary who
+// controls k-1 clients can learn if a target crowd exists by checking if the
+// adversary's own reports are forwarded.  Instead, we add Laplace or Gaussian
+// noise to the size of every crowd before we compare it to our threshold, and
+// optionally drop a random fraction of reports beforehand.
+//
+// Note that this only makes the decision whether to release a crowd
+// differentially private.  Once a crowd meets the noisy threshold, we release
+// all of its reports, so the size of a released crowd is exact.  For a crowd
+// that exists with or without a given client's report, the decision is
+// (epsilon, delta)-DP, where delta is only non-zero for the Gaussian
+// mechanism.  A crowd that consists of a single report, however, doesn't
+// exist without it, and it still meets the threshold with a small
+// probability, which adds to delta.  The larger the threshold, the smaller
+// that probability, which is why we compute delta from the threshold.  We
+// don't account for the privacy amplification of dropping reports.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+)
+
+const (
+	noiseLaplace  = "laplace"
+	noiseGaussian = "gaussian"
+)
+
+// noiseConfig represents the configuration of noisy thresholding.
+type noiseConfig struct {
+	// Mechanism is either "laplace", "gaussian", or empty, in which case we
+	// don't add noise.
+	Mechanism string
+	Epsilon   float64
+	// Delta is only used by the Gaussian mechanism.
+	Delta float64
+	// DropFraction is the probability with which we drop every report before
+	// thresholding.
+	DropFraction float64
+}
+
+// enabled returns true if the configuration asks for noise or dropping.
+func (c *noiseConfig) enabled() bool {
+	return c.Mechanism != "" || c.DropFraction > 0
+}
+
+// validate returns an error if the configuration is invalid.
+func (c *noiseConfig) validate() error {
+	switch c.Mechanism {
+	case "":
+	case noiseLaplace, noiseGaussian:
+		if c.Epsilon <= 0 || math.IsInf(c.Epsilon, 0) || math.IsNaN(c.Epsilon) {
+			return fmt.Errorf("noise epsilon must be positive but is %g", c.Epsilon)
+		}
+		if c.Mechanism == noiseGaussian && (c.Delta <= 0 || c.Delta >= 1) {
+			return fmt.Errorf("noise delta must be in (0, 1) but is %g", c.Delta)
+		}
+		// The classic Gaussian mechanism's standard deviation only holds for
+		// an epsilon below 1.
+		if c.Mechanism == noiseGaussian && c.Epsilon >= 1 {
+			return fmt.Errorf("epsilon of Gaussian noise must be below 1 but is %g", c.Epsilon)
+		}
+	default:
+		return fmt.Errorf("noise mechanism must be %q or %q but is %q", noiseLaplace, noiseGaussian, c.Mechanism)
+	}
+	if c.DropFraction < 0 || c.DropFraction >= 1 {
+		return fmt.Errorf("drop fraction must be in [0, 1) but is %g", c.DropFraction)
+	}
+	return nil
+}
+
+// randFloat returns a uniformly distributed number in (0, 1) that's derived
+// from crypto/rand.
+func randFloat() (float64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		// Use the 53 bits that a float64 can represent exactly.
+		if f := float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53); f > 0 {
+			return f, nil
+		}
+	}
+}
+
+// noisyThreshold adds noise to crowd sizes before they're compared to our
+// anonymity threshold, and keeps track of the privacy budget that we spent.
+// A nil noisyThreshold is deterministic.
+type noisyThreshold struct {
+	sync.Mutex
+	cfg  noiseConfig
+	rand func() (float64, error)
+	// stddev is the standard deviation of the Gaussian mechanism.
+	stddev float64
+	// batches is the number of batches that we thresholded.
+	batches int
+	// spentDelta is the sum of the deltas of all batches.  Unlike epsilon,
+	// delta depends on each batch's threshold.
+	spentDelta float64
+}
+
+// newNoisyThreshold returns a new noisyThreshold for the given configuration.
+func newNoisyThreshold(cfg *noiseConfig) (*noisyThreshold, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	n := &noisyThreshold{cfg: *cfg, rand: randFloat}
+	if cfg.Mechanism == noiseGaussian {
+		// The classic Gaussian mechanism for a sensitivity of 1, as every
+		// client contributes a single report to a crowd.
+		n.stddev = math.Sqrt(2*math.Log(1.25/cfg.Delta)) / cfg.Epsilon
+	} else {
+		n.cfg.Delta = 0
+	}
+	return n, nil
+}
+
+// fresh returns a new noisyThreshold with the same configuration and source of
+// randomness as n, but which hasn't spent any privacy budget yet.
+func (n *noisyThreshold) fresh() *noisyThreshold {
+	if n == nil {
+		return nil
+	}
+	return &noisyThreshold{cfg: n.cfg, rand: n.rand, stddev: n.stddev}
+}
+
+// noise returns a sample of our noise distribution.
+func (n *noisyThreshold) noise() (float64, error) {
+	switch n.cfg.Mechanism {
+	case noiseLaplace:
+		u, err := n.rand()
+		if err != nil {
+			return 0, err
+		}
+		// Inverse transform sampling with a scale of 1/epsilon.
+		u -= 0.5
+		return -math.Copysign(1, u) * math.Log(1-2*math.Abs(u)) / n.cfg.Epsilon, nil
+	case noiseGaussian:
+		u1, err := n.rand()
+		if err != nil {
+			return 0, err
+		}
+		u2, err := n.rand()
+		if err != nil {
+			return 0, err
+		}
+		// The Box-Muller transform.
+		return math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2) * n.stddev, nil
+	default:
+		return 0, nil
+	}
+}
+
+// meets returns true if a crowd of the given size meets the given threshold
+// after adding noise to the crowd's size.  If we fail to sample noise, the
+// crowd doesn't meet the threshold.
+func (n *noisyThreshold) meets(size, threshold int) bool {
+	if n == nil {
+		return size >= threshold
+	}
+	noise, err := n.noise()
+	if err != nil {
+		elog.Printf("Failed to sample noise: %s", err)
+		return false
+	}
+	return float64(size)+noise >= float64(threshold)
+}
+
+// subsample returns the given reports after dropping every report with our
+// drop probability.  The given slice is not modified.  If we fail to sample
+// randomness, all reports are dropped.
+func (n *noisyThreshold) subsample(reports []Report) []Report {
+	if n == nil || n.cfg.DropFraction == 0 {
+		return reports
+	}
+	kept := []Report{}
+	for _, r := range reports {
+		u, err := n.rand()
+		if err != nil {
+			elog.Printf("Failed to sample randomness: %s", err)
+			return nil
+		}
+		if u >= n.cfg.DropFraction {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// tail returns the probability that our noise is at least the given value.
+func (n *noisyThreshold) tail(x float64) float64 {
+	switch n.cfg.Mechanism {
+	case noiseLaplace:
+		if x < 0 {
+			return 1 - 0.5*math.Exp(x*n.cfg.Epsilon)
+		}
+		return 0.5 * math.Exp(-x*n.cfg.Epsilon)
+	case noiseGaussian:
+		return 0.5 * math.Erfc(x/(n.stddev*math.Sqrt2))
+	default:
+		if x <= 0 {
+			return 1
+		}
+		return 0
+	}
+}
+
+// budget returns the privacy parameters epsilon and delta that a batch costs
+// if we threshold it with the given (smallest) threshold.  Delta is the
+// mechanism's own delta plus the probability that a crowd of a single report
+// meets the threshold.  Without a noise mechanism, thresholding isn't
+// differentially private and we return an infinite epsilon.
+func (n *noisyThreshold) budget(threshold int) (epsilon, delta float64) {
+	if n.cfg.Mechanism == "" {
+		return math.Inf(1), 1
+	}
+	delta = math.Min(1, n.cfg.Delta+n.tail(float64(threshold-1)))
+	return n.cfg.Epsilon, delta
+}
+
+// batchNoise returns the parameters of noisy thresholding for the header of a
+// batch that we thresholded with the given (smallest) threshold, or nil if we
+// don't add noise or drop reports.
+func (n *noisyThreshold) batchNoise(threshold int) *batchNoise {
+	if n == nil {
+		return nil
+	}
+	bn := &batchNoise{Mechanism: n.cfg.Mechanism, DropFraction: n.cfg.DropFraction}
+	if n.cfg.Mechanism != "" {
+		bn.Epsilon, bn.Delta = n.budget(threshold)
+	}
+	return bn
+}
+
+// account logs the privacy budget that we spent on a batch that we
+// thresholded with the given (smallest) threshold, and the total budget that
+// we spent so far, using basic composition of the per-batch budgets.  The
+// budget protects a client's report in a single crowd of a batch.  A client
+// that contributes reports to several crowds of a batch spends the budget
+// once per crowd.
+func (n *noisyThreshold) account(numCrowds, numDumped, threshold int) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+
+	n.batches++
+	if n.cfg.Mechanism == "" {
+		elog.Printf("Privacy accounting: batch %d dropped reports with probability %g and dumped %d of %d "+
+			"crowds.  Without noise, thresholding isn't differentially private.",
+			n.batches, n.cfg.DropFraction, numDumped, numCrowds)
+		return
+	}
+	epsilon, delta := n.budget(threshold)
+	n.spentDelta = math.Min(1, n.spentDelta+delta)
+	elog.Printf("Privacy accounting: batch %d used %s noise with threshold %d (epsilon=%g, delta=%g, "+
+		"drop fraction=%g) and dumped %d of %d crowds.  Total budget over %d batches: epsilon=%g, delta=%g.",
+		n.batches, n.cfg.Mechanism, threshold, epsilon, delta, n.cfg.DropFraction,
+		numDumped, numCrowds,
+		n.batches, float64(n.batches)*epsilon, n.spentDelta)
+}
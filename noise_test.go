@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNoiseConfig(t *testing.T) {
+	for _, cfg := range []*noiseConfig{
+		{},
+		{DropFraction: 0.5},
+		{Mechanism: noiseLaplace, Epsilon: 1},
+		{Mechanism: noiseGaussian, Epsilon: 0.5, Delta: 1e-6, DropFraction: 0.1},
+	} {
+		if err := cfg.validate(); err != nil {
+			t.Fatalf("Rejected valid noise configuration %+v: %s", cfg, err)
+		}
+	}
+	for _, cfg := range []*noiseConfig{
+		{Mechanism: "foo", Epsilon: 1},
+		{Mechanism: noiseLaplace},
+		{Mechanism: noiseLaplace, Epsilon: math.Inf(1)},
+		{Mechanism: noiseGaussian, Epsilon: 1},
+		{Mechanism: noiseGaussian, Epsilon: 1, Delta: 1},
+		{Mechanism: noiseGaussian, Epsilon: 1, Delta: 1e-6},
+		{DropFraction: 1},
+		{DropFraction: -0.1},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Fatalf("Accepted invalid noise configuration %+v.", cfg)
+		}
+	}
+}
+
+func TestNoiseDistribution(t *testing.T) {
+	const numSamples = 20000
+	for _, cfg := range []*noiseConfig{
+		{Mechanism: noiseLaplace, Epsilon: 0.5},
+		{Mechanism: noiseGaussian, Epsilon: 0.5, Delta: 1e-5},
+	} {
+		n, err := newNoisyThreshold(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create noisy threshold: %s", err)
+		}
+		// The Laplace distribution's variance is 2b^2 for a scale of b.
+		expectedVar := 2 / (cfg.Epsilon * cfg.Epsilon)
+		if cfg.Mechanism == noiseGaussian {
+			expectedVar = n.stddev * n.stddev
+		}
+		var sum, sumSquares float64
+		for i := 0; i < numSamples; i++ {
+			x, err := n.noise()
+			if err != nil {
+				t.Fatalf("Failed to sample noise: %s", err)
+			}
+			sum += x
+			sumSquares += x * x
+		}
+		mean := sum / numSamples
+		variance := sumSquares/numSamples - mean*mean
+		// Allow for five standard errors of the mean and 10% off the variance.
+		if math.Abs(mean) > 5*math.Sqrt(expectedVar/numSamples) ||
+			math.Abs(variance-expectedVar)/expectedVar > 0.1 {
+			t.Fatalf("Unexpected %s noise: mean %.3f, variance %.3f (expected %.3f)",
+				cfg.Mechanism, mean, variance, expectedVar)
+		}
+	}
+}
+
+func TestNoisyDumpFewerThan(t *testing.T) {
+	// Without noise, we must threshold deterministically.
+	var deterministic *noisyThreshold
+	if deterministic.meets(9, 10) || !deterministic.meets(10, 10) {
+		t.Fatal("Deterministic threshold doesn't threshold deterministically.")
+	}
+
+	n, err := newNoisyThreshold(&noiseConfig{Mechanism: noiseLaplace, Epsilon: 1, DropFraction: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to create noisy threshold: %s", err)
+	}
+	// A uniform sample of 0.95 drops no reports and results in positive
+	// noise of ln(10), which lets a crowd of size 9 meet a threshold of 10.
+	n.rand = func() (float64, error) { return 0.95, nil }
+	b := getFullBriefcase(18, 2)
+	b.noise = n
+	b.DumpFewerThan(10)
+	checkLengths(t, b, 18, 2)
+
+	// A uniform sample of 0.25 drops all reports.
+	n.rand = func() (float64, error) { return 0.25, nil }
+	b.DumpFewerThan(1)
+	checkLengths(t, b, 0, 0)
+}
+
+func TestNoiseBudget(t *testing.T) {
+	laplace, _ := newNoisyThreshold(&noiseConfig{Mechanism: noiseLaplace, Epsilon: 1})
+	gaussian, _ := newNoisyThreshold(&noiseConfig{Mechanism: noiseGaussian, Epsilon: 0.5, Delta: 1e-6})
+	dropping, _ := newNoisyThreshold(&noiseConfig{DropFraction: 0.5})
+
+	for _, test := range []struct {
+		n         *noisyThreshold
+		threshold int
+		epsilon   float64
+		delta     float64
+	}{
+		// A single report must overcome a noise of k-1.
+		{laplace, 1, 1, 0.5},
+		{laplace, 10, 1, 0.5 * math.Exp(-9)},
+		{gaussian, 1, 0.5, 1e-6 + 0.5},
+		{gaussian, 50, 0.5, 1e-6 + 0.5*math.Erfc(49/(gaussian.stddev*math.Sqrt2))},
+		{dropping, 10, math.Inf(1), 1},
+	} {
+		epsilon, delta := test.n.budget(test.threshold)
+		if epsilon != test.epsilon || math.Abs(delta-test.delta) > 1e-12 {
+			t.Fatalf("Expected budget (%g, %g) for %s noise and threshold %d but got (%g, %g).",
+				test.epsilon, test.delta, test.n.cfg.Mechanism, test.threshold, epsilon, delta)
+		}
+	}
+	// A larger threshold must cost less.
+	if _, small := gaussian.budget(100); small >= 1e-6+0.5*math.Erfc(49/(gaussian.stddev*math.Sqrt2)) {
+		t.Fatalf("Delta %g didn't decrease with the threshold.", small)
+	}
+}
+
+func TestFreshNoisyThreshold(t *testing.T) {
+	var deterministic *noisyThreshold
+	if deterministic.fresh() != nil {
+		t.Fatal("Fresh copy of a deterministic threshold isn't deterministic.")
+	}
+
+	n, _ := newNoisyThreshold(&noiseConfig{Mechanism: noiseGaussian, Epsilon: 0.5, Delta: 1e-6})
+	n.account(10, 5, 20)
+	f := n.fresh()
+	if f.batches != 0 || f.spentDelta != 0 {
+		t.Fatalf("Fresh noisy threshold already spent budget: %d batches, delta %g.", f.batches, f.spentDelta)
+	}
+	if f.cfg != n.cfg || f.stddev != n.stddev {
+		t.Fatal("Fresh noisy threshold doesn't match the original's configuration.")
+	}
+	if n.batches != 1 {
+		t.Fatalf("Expected the original to have accounted for 1 batch but got %d.", n.batches)
+	}
+}
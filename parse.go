@@ -0,0 +1,475 @@
+package main
+
+// This file implements a streaming parser for the P3A measurements that our
+// simulations take as input.  Files may be gzip- or zstd-compressed, and
+// contain measurements in one of the following formats:
+//
+//   - Syslog lines with single-quoted JSON, as stored in our S3 bucket.
+//   - A JSON array of measurements.
+//   - JSON Lines, i.e. one JSON-encoded measurement per line.
+//   - CSV with the same columns as P3AMeasurement.CSVHeader.
+//
+// Files are parsed concurrently and measurements are handed to simulations
+// through a reportIterator, so we never hold an entire data set in memory.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// reportChunkSize is the number of reports that a parser hands to the
+	// iterator at once.
+	reportChunkSize = 1024
+	// maxLineSize is the maximum size of a line in an input file.
+	maxLineSize = 1 << 20
+)
+
+var (
+	re = regexp.MustCompile(`'({[^']+})'`)
+
+	errIteratorClosed = errors.New("iterator was closed")
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// parseFunc parses records from the given reader and hands them to the given
+// file parser.
+type parseFunc func(r io.Reader, p *fileParser) error
+
+// decompress returns a reader that transparently decompresses the given
+// reader's content if it's gzip- or zstd-compressed.
+func decompress(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, zstdMagic):
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// detectFormat peeks at the beginning of the given reader and returns the
+// parser for the reader's format.
+func detectFormat(r *bufio.Reader) parseFunc {
+	prefix, _ := r.Peek(len(P3AMeasurement{}.CSVHeader()))
+	trimmed := bytes.TrimLeft(prefix, " \t\r\n")
+	switch {
+	case string(prefix) == P3AMeasurement{}.CSVHeader():
+		return parseCSV
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return parseJSONArray
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return parseJSONLines
+	default:
+		return parseSyslog
+	}
+}
+
+// newLineScanner returns a scanner that splits the given reader into lines.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	return s
+}
+
+// parseSyslog parses a P3A measurement file as it can be found in our S3
+// bucket.  Those files have the following (sanitized) format:
+//
+// <134>2022-01-01T00:00:00Z foo bar[quuz]: "-" "-" 2022-01-01:00:xx:xx
+// POST / HTTP/2 200 '{"channel":"nightly","country_code":"US","metric_name":
+// "...","metric_value":0,"platform":"linux-bc","refcode":"none",
+// "version":"1.36.46","woi":3,"wos":3,"yoi":2022,"yos":2022}'
+func parseSyslog(r io.Reader, p *fileParser) error {
+	s := newLineScanner(r)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		p.read(line)
+		// Extract P3A measurement from the current line.  Lines without
+		// measurements are expected, so we don't reject them.
+		measurements := re.FindStringSubmatch(s.Text())
+		if len(measurements) != 2 {
+			continue
+		}
+		p.decodeJSON([]byte(measurements[1]))
+	}
+	return s.Err()
+}
+
+// parseJSONLines parses one JSON-encoded measurement per line.
+func parseJSONLines(r io.Reader, p *fileParser) error {
+	s := newLineScanner(r)
+	for line := 1; s.Scan(); line++ {
+		record := bytes.TrimSpace(s.Bytes())
+		if len(record) == 0 {
+			continue
+		}
+		p.read(line)
+		p.decodeJSON(record)
+	}
+	return s.Err()
+}
+
+// parseJSONArray parses a JSON array of measurements without reading the
+// entire array into memory.  A syntax error makes us lose track of where we
+// are in the array, so we give up on the file.
+func parseJSONArray(r io.Reader, p *fileParser) error {
+	lc := &lineCounter{r: r}
+	dec := json.NewDecoder(lc)
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			p.read(lc.lineAt(dec.InputOffset()))
+			p.decoded("", nil, err)
+			return err
+		}
+		// After decoding, the decoder's offset points to the end of the
+		// element.
+		p.read(lc.lineAt(dec.InputOffset() - int64(len(raw))))
+		p.decodeJSON(raw)
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// lineCounter keeps track of the newlines in the data that's read through it,
+// so that we can map the offsets of a JSON decoder to lines.
+type lineCounter struct {
+	r      io.Reader
+	offset int64
+	// newlines contains the offsets of the newlines that lineAt hasn't
+	// passed yet.
+	newlines []int64
+	line     int
+}
+
+func (c *lineCounter) Read(buf []byte) (int, error) {
+	n, err := c.r.Read(buf)
+	for i, b := range buf[:n] {
+		if b == '\n' {
+			c.newlines = append(c.newlines, c.offset+int64(i))
+		}
+	}
+	c.offset += int64(n)
+	return n, err
+}
+
+// lineAt returns the line, counted from 1, that contains the given offset.
+// Offsets must not decrease from one call to the next.
+func (c *lineCounter) lineAt(offset int64) int {
+	for len(c.newlines) > 0 && c.newlines[0] < offset {
+		c.newlines = c.newlines[1:]
+		c.line++
+	}
+	return c.line + 1
+}
+
+// parseCSV parses CSV-encoded measurements whose columns are given by the
+// header in the first line.
+func parseCSV(r io.Reader, p *fileParser) error {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	cr.FieldsPerRecord = len(header)
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		perr, isParseErr := err.(*csv.ParseError)
+		switch {
+		case isParseErr:
+			p.read(perr.StartLine)
+		case err == nil:
+			line, _ := cr.FieldPos(0)
+			p.read(line)
+		default:
+			// We don't know where the record starts, so we report the line
+			// of the previous record.
+			p.read(p.line)
+		}
+		if isParseErr && perr.Err == csv.ErrFieldCount {
+			// The record is malformed but we can carry on with the next one.
+			p.decoded(strings.Join(record, ","), nil, err)
+			continue
+		}
+		if err != nil {
+			p.decoded("", nil, err)
+			return err
+		}
+		m, err := measurementFromCSV(header, record)
+		p.decoded(strings.Join(record, ","), m, err)
+	}
+}
+
+// measurementFromCSV turns the given CSV record into a measurement.
+func measurementFromCSV(header, record []string) (*P3AMeasurement, error) {
+	m := &P3AMeasurement{}
+	ints := map[string]*int{
+		"yos":          &m.YearOfSurvey,
+		"yoi":          &m.YearOfInstall,
+		"wos":          &m.WeekOfSurvey,
+		"woi":          &m.WeekOfInstall,
+		"metric_value": &m.MetricValue,
+	}
+	strs := map[string]*string{
+		"metric_name":  &m.MetricName,
+		"country_code": &m.CountryCode,
+		"platform":     &m.Platform,
+		"version":      &m.Version,
+		"channel":      &m.Channel,
+		"refcode":      &m.RefCode,
+	}
+
+	for i, column := range header {
+		if field, exists := ints[column]; exists {
+			num, err := strconv.Atoi(record[i])
+			if err != nil {
+				return nil, fmt.Errorf("column %q is not an integer: %w", column, err)
+			}
+			*field = num
+		} else if field, exists := strs[column]; exists {
+			*field = record[i]
+		} else {
+			return nil, fmt.Errorf("unknown column %q", column)
+		}
+	}
+	return m, nil
+}
+
+// parseFile parses the given file and hands its valid measurements to the
+// given function in chunks.  Rejected records are written to the given
+// quarantine, if any.  The returned stats are complete even if parsing fails
+// half-way through the file.
+func parseFile(filename string, q *quarantine, emit func([]Report)) (*parseStats, error) {
+	stats := newParseStats()
+	f, err := os.Open(filename)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	rc, err := decompress(bufio.NewReader(f))
+	if err != nil {
+		return stats, err
+	}
+	defer rc.Close()
+	r := bufio.NewReader(rc)
+
+	chunk := make([]Report, 0, reportChunkSize)
+	p := &fileParser{
+		filename:   filename,
+		stats:      stats,
+		quarantine: q,
+		emit: func(m P3AMeasurement) {
+			chunk = append(chunk, m)
+			if len(chunk) == reportChunkSize {
+				emit(chunk)
+				chunk = make([]Report, 0, reportChunkSize)
+			}
+		},
+	}
+	err = detectFormat(r)(r, p)
+	if len(chunk) > 0 {
+		emit(chunk)
+	}
+	return stats, err
+}
+
+// dataset represents a directory (and its subdirectories) of files that
+// contain P3A measurements.
+type dataset struct {
+	dir     string
+	workers int
+	// quarantine receives the records that the first iterator rejects.  We
+	// don't quarantine records more than once.
+	quarantine *quarantine
+	passes     int
+}
+
+// newDataset returns a new dataset for the given directory.
+func newDataset(dir string) *dataset {
+	return &dataset{dir: dir, workers: runtime.NumCPU()}
+}
+
+// Reports returns an iterator over all valid measurements in the dataset.
+// The dataset is parsed anew for each iterator.
+func (d *dataset) Reports() *reportIterator {
+	d.passes++
+	q := d.quarantine
+	d.quarantine = nil
+	it := &reportIterator{
+		chunks: make(chan []Report, d.workers),
+		done:   make(chan struct{}),
+		report: newParseReport(),
+		pass:   d.passes,
+	}
+	filenames := make(chan string)
+
+	go func() {
+		defer close(filenames)
+		err := filepath.Walk(d.dir, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			select {
+			case filenames <- filename:
+				return nil
+			case <-it.done:
+				return errIteratorClosed
+			}
+		})
+		if err != nil && err != errIteratorClosed {
+			it.setErr(err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range filenames {
+				stats, err := parseFile(filename, q, func(chunk []Report) {
+					select {
+					case it.chunks <- chunk:
+					case <-it.done:
+					}
+				})
+				if err != nil {
+					elog.Printf("Failed to parse %s because: %s", filename, err)
+					stats.Failures++
+					stats.Error = err.Error()
+				}
+				it.report.add(filename, stats)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(it.chunks)
+	}()
+
+	return it
+}
+
+// reportIterator iterates over the reports of a dataset.  It's used like
+// bufio.Scanner:
+//
+//	it := d.Reports()
+//	defer it.Close()
+//	for it.Next() {
+//		r := it.Report()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type reportIterator struct {
+	sync.Mutex
+	chunks    chan []Report
+	done      chan struct{}
+	closeOnce sync.Once
+	chunk     []Report
+	current   Report
+	err       error
+	report    *parseReport
+	// pass is the number of iterators over the dataset, including this one.
+	pass int
+}
+
+// setErr records the given error, unless we already recorded one.
+func (it *reportIterator) setErr(err error) {
+	it.Lock()
+	defer it.Unlock()
+	if it.err == nil {
+		it.err = err
+	}
+}
+
+// Next advances the iterator to the next report and returns false once there
+// are no more reports.
+func (it *reportIterator) Next() bool {
+	for len(it.chunk) == 0 {
+		chunk, ok := <-it.chunks
+		if !ok {
+			it.current = nil
+			return false
+		}
+		it.chunk = chunk
+	}
+	it.current, it.chunk = it.chunk[0], it.chunk[1:]
+	return true
+}
+
+// Report returns the report that the last call to Next advanced to.
+func (it *reportIterator) Report() Report {
+	return it.current
+}
+
+// Err returns the first error that prevented the iterator from reading the
+// dataset.  Files that fail to parse are logged but don't cause an error.
+func (it *reportIterator) Err() error {
+	it.Lock()
+	defer it.Unlock()
+	return it.err
+}
+
+// Stats returns the parse stats of the files that the iterator has read so
+// far.  Once the iterator is exhausted, the stats cover the entire dataset.
+func (it *reportIterator) Stats() *parseReport {
+	return it.report
+}
+
+// Close stops the iterator before it's exhausted and releases its resources.
+func (it *reportIterator) Close() {
+	it.closeOnce.Do(func() {
+		close(it.done)
+		// Drain the remaining chunks, so our goroutines can terminate.
+		go func() {
+			for range it.chunks {
+			}
+		}()
+	})
+}
+
+// All returns all remaining reports.  It's meant for small datasets.
+func (it *reportIterator) All() []Report {
+	var reports []Report
+	for it.Next() {
+		reports = append(reports, it.Report())
+	}
+	return reports
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	testMeasurement = `{"channel":"nightly","country_code":"US","metric_name":"Brave.Foo",` +
+		`"metric_value":0,"platform":"linux-bc","refcode":"none","version":"1.36.46",` +
+		`"woi":3,"wos":3,"yoi":2022,"yos":2022}`
+	invalidMeasurement = `{"channel":"","country_code":"US","metric_name":"Brave.Foo",` +
+		`"metric_value":0,"platform":"linux-bc","refcode":"none","version":"1.36.46",` +
+		`"woi":3,"wos":3,"yoi":2022,"yos":2022}`
+)
+
+func gzipped(t *testing.T, content string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("Failed to compress: %s", err)
+	}
+	w.Close()
+	return buf.String()
+}
+
+func zstded(t *testing.T, content string) string {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %s", err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("Failed to compress: %s", err)
+	}
+	w.Close()
+	return buf.String()
+}
+
+// writeDataset writes the given files to a temporary directory and returns
+// the directory.
+func writeDataset(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatalf("Failed to create directory: %s", err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write file: %s", err)
+		}
+	}
+	return dir
+}
+
+func TestParseFormats(t *testing.T) {
+	var m P3AMeasurement
+	if err := json.Unmarshal([]byte(testMeasurement), &m); err != nil {
+		t.Fatalf("Failed to unmarshal measurement: %s", err)
+	}
+	syslog := fmt.Sprintf("<134>2022-01-01T00:00:00Z foo bar[quuz]: \"-\" \"-\" POST / HTTP/2 200 '%s'\n", testMeasurement)
+	jsonLines := testMeasurement + "\n\n" + invalidMeasurement + "\n" + testMeasurement + "\n"
+	csv := m.CSVHeader() + "\n" + m.CSV() + "\n" + m.CSV() + "\n"
+
+	for name, test := range map[string]struct {
+		content string
+		num     int
+	}{
+		"syslog":       {syslog + "no measurement\n" + syslog, 2},
+		"json-array":   {" [" + testMeasurement + "," + invalidMeasurement + "]", 1},
+		"json-lines":   {jsonLines, 2},
+		"csv":          {csv, 2},
+		"gzip-syslog":  {gzipped(t, syslog), 1},
+		"zstd-csv":     {zstded(t, csv), 2},
+		"gzip-jsonl":   {gzipped(t, jsonLines), 2},
+		"zstd-jsonarr": {zstded(t, "["+testMeasurement+"]"), 1},
+	} {
+		var reports []Report
+		_, err := parseFile(filepath.Join(writeDataset(t, map[string]string{"f": test.content}), "f"), nil,
+			func(chunk []Report) { reports = append(reports, chunk...) })
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", name, err)
+		}
+		if len(reports) != test.num {
+			t.Fatalf("Expected %d measurements in %s but got %d.", test.num, name, len(reports))
+		}
+		if reports[0].(P3AMeasurement) != m {
+			t.Fatalf("Parsed unexpected measurement from %s: %v", name, reports[0])
+		}
+	}
+}
+
+func TestDatasetIterator(t *testing.T) {
+	numFiles, numLines := 10, reportChunkSize+1
+	files := make(map[string]string)
+	for i := 0; i < numFiles; i++ {
+		files[fmt.Sprintf("dir%d/file%d.jsonl", i%3, i)] = strings.Repeat(testMeasurement+"\n", numLines)
+	}
+	files["broken.jsonl"] = "{foo"
+	d := newDataset(writeDataset(t, files))
+
+	it := d.Reports()
+	if reports := it.All(); len(reports) != numFiles*numLines {
+		t.Fatalf("Expected %d measurements but got %d.", numFiles*numLines, len(reports))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iterator failed: %s", err)
+	}
+
+	// We must be able to stop an iterator early.
+	it = d.Reports()
+	for i := 0; i < 10 && it.Next(); i++ {
+	}
+	it.Close()
+
+	it = newDataset(filepath.Join(t.TempDir(), "does-not-exist")).Reports()
+	if it.Next() || it.Err() == nil {
+		t.Fatal("Expected iterator over non-existing directory to fail.")
+	}
+}
+
+func TestJSONArrayLines(t *testing.T) {
+	var lines []int
+	p := &fileParser{filename: "test", stats: newParseStats()}
+	p.emit = func(P3AMeasurement) { lines = append(lines, p.line) }
+	array := "[\n  " + testMeasurement + ",\n\n  " + invalidMeasurement + ", " + testMeasurement + "\n]"
+	if err := parseJSONArray(strings.NewReader(array), p); err != nil {
+		t.Fatalf("Failed to parse JSON array: %s", err)
+	}
+	if fmt.Sprint(lines) != "[2 4]" {
+		t.Fatalf("Expected valid measurements on lines [2 4] but got %v.", lines)
+	}
+}
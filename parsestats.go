@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// parseStats counts what happened to the records of one or more input files.
+// A record is a line, except for JSON arrays, whose records are the array's
+// elements.
+type parseStats struct {
+	// LinesRead is the number of non-empty records that we read.
+	LinesRead int `json:"lines_read"`
+	// LinesMatched is the number of records that looked like they contain a
+	// measurement.  For all formats but syslog, that's every record.
+	LinesMatched int `json:"lines_matched"`
+	// DecodeErrors is the number of records that we failed to decode.
+	DecodeErrors int `json:"decode_errors"`
+	// Invalid maps the reason why a decoded measurement is invalid (see
+	// P3AMeasurement.Validate) to the number of measurements that were
+	// invalid for that reason.
+	Invalid map[string]int `json:"invalid"`
+	// Accepted is the number of valid measurements.
+	Accepted int `json:"accepted"`
+	// Failures is the number of files that we failed to read to the end.
+	Failures int `json:"failures"`
+	// Error is the reason why we failed to read the file to the end.
+	Error string `json:"error,omitempty"`
+}
+
+func newParseStats() *parseStats {
+	return &parseStats{Invalid: make(map[string]int)}
+}
+
+// NumInvalid returns the number of invalid measurements.
+func (s *parseStats) NumInvalid() int {
+	num := 0
+	for _, n := range s.Invalid {
+		num += n
+	}
+	return num
+}
+
+// add adds the given stats to the object's stats.
+func (s *parseStats) add(s2 *parseStats) {
+	s.LinesRead += s2.LinesRead
+	s.LinesMatched += s2.LinesMatched
+	s.DecodeErrors += s2.DecodeErrors
+	s.Accepted += s2.Accepted
+	s.Failures += s2.Failures
+	for reason, num := range s2.Invalid {
+		s.Invalid[reason] += num
+	}
+}
+
+// String returns a one-line summary of the stats.
+func (s *parseStats) String() string {
+	reasons := []string{}
+	for reason, num := range s.Invalid {
+		reasons = append(reasons, fmt.Sprintf("%q: %d", reason, num))
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("%d lines read, %d matched, %d decode errors, %d invalid (%s), %d accepted, %d failed files",
+		s.LinesRead, s.LinesMatched, s.DecodeErrors, s.NumInvalid(),
+		strings.Join(reasons, ", "), s.Accepted, s.Failures)
+}
+
+// parseReport contains the parse stats of every file in a dataset, and their
+// total.
+type parseReport struct {
+	sync.Mutex
+	Files map[string]*parseStats `json:"files"`
+	Total *parseStats            `json:"total"`
+}
+
+func newParseReport() *parseReport {
+	return &parseReport{
+		Files: make(map[string]*parseStats),
+		Total: newParseStats(),
+	}
+}
+
+// add adds the stats of the given file to the report.
+func (r *parseReport) add(filename string, s *parseStats) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.Files[filename] = s
+	r.Total.add(s)
+}
+
+// write writes the JSON-encoded report to the given file.
+func (r *parseReport) write(filename string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, content, 0600)
+}
+
+// quarantinedLine represents a rejected input line, as it's written to the
+// quarantine file.
+type quarantinedLine struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Reason  string `json:"reason"`
+	Content string `json:"content"`
+}
+
+// quarantine writes rejected input lines to a file, one JSON object per line.
+// It's safe for concurrent use.
+type quarantine struct {
+	sync.Mutex
+	f *os.File
+	w *bufio.Writer
+}
+
+// newQuarantine creates the given quarantine file.
+func newQuarantine(filename string) (*quarantine, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &quarantine{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// add writes the given rejected line to the quarantine file.
+func (q *quarantine) add(l *quarantinedLine) {
+	content, err := json.Marshal(l)
+	if err != nil {
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if _, err := q.w.Write(append(content, '\n')); err != nil {
+		elog.Printf("Failed to write to quarantine file: %s", err)
+	}
+}
+
+// Close flushes and closes the quarantine file.
+func (q *quarantine) Close() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if err := q.w.Flush(); err != nil {
+		q.f.Close()
+		return err
+	}
+	return q.f.Close()
+}
+
+// fileParser keeps track of the records of a single file as the file's
+// format-specific parser hands them over.
+type fileParser struct {
+	filename string
+	// line is the line of the input file on which the current record starts.
+	// Lines are counted from 1 and include empty lines and CSV headers, so
+	// that quarantine entries point at the right place in the file.
+	line       int
+	stats      *parseStats
+	quarantine *quarantine
+	emit       func(P3AMeasurement)
+}
+
+// read records that we read the next (non-empty) record, which starts on the
+// given line of the input file.
+func (p *fileParser) read(line int) {
+	p.line = line
+	p.stats.LinesRead++
+}
+
+// reject records that the current record was rejected for the given reason.
+func (p *fileParser) reject(content, reason string) {
+	if p.quarantine != nil {
+		p.quarantine.add(&quarantinedLine{
+			File:    p.filename,
+			Line:    p.line,
+			Reason:  reason,
+			Content: content,
+		})
+	}
+}
+
+// decoded handles the outcome of decoding the current record: decoding errors
+// and invalid measurements are counted and rejected, and valid measurements
+// are emitted.
+func (p *fileParser) decoded(content string, m *P3AMeasurement, err error) {
+	p.stats.LinesMatched++
+	if err != nil {
+		p.stats.DecodeErrors++
+		p.reject(content, err.Error())
+		return
+	}
+	if err := m.Validate(); err != nil {
+		p.stats.Invalid[err.Error()]++
+		p.reject(content, err.Error())
+		return
+	}
+	p.stats.Accepted++
+	p.emit(*m)
+}
+
+// decodeJSON decodes the current record, which is a JSON-encoded measurement.
+func (p *fileParser) decodeJSON(content []byte) {
+	var m P3AMeasurement
+	err := json.Unmarshal(content, &m)
+	p.decoded(string(content), &m, err)
+}
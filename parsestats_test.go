@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseStats(t *testing.T) {
+	var m P3AMeasurement
+	if err := json.Unmarshal([]byte(testMeasurement), &m); err != nil {
+		t.Fatalf("Failed to unmarshal measurement: %s", err)
+	}
+	badWeek := strings.Replace(testMeasurement, `"woi":3`, `"woi":54`, 1)
+	dir := writeDataset(t, map[string]string{
+		"syslog": "<134>foo '" + testMeasurement + "'\n" +
+			"<134>no measurement\n" +
+			"<134>foo '{broken}'\n",
+		"jsonl": testMeasurement + "\n" +
+			"\n" +
+			invalidMeasurement + "\n" +
+			invalidMeasurement + "\n" +
+			badWeek + "\n" +
+			"{\n",
+		"csv": m.CSVHeader() + "\n" +
+			m.CSV() + "\n" +
+			"too,few,fields\n" +
+			m.CSV() + "\n",
+	})
+	quarantineFile := filepath.Join(t.TempDir(), "quarantine")
+	q, err := newQuarantine(quarantineFile)
+	if err != nil {
+		t.Fatalf("Failed to create quarantine: %s", err)
+	}
+
+	d := newDataset(dir)
+	d.quarantine = q
+	it := d.Reports()
+	if num := len(it.All()); num != 4 {
+		t.Fatalf("Expected 4 valid measurements but got %d.", num)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("Failed to close quarantine: %s", err)
+	}
+
+	report := it.Stats()
+	syslog := report.Files[filepath.Join(dir, "syslog")]
+	if syslog.LinesRead != 3 || syslog.LinesMatched != 2 || syslog.DecodeErrors != 1 || syslog.Accepted != 1 {
+		t.Fatalf("Unexpected syslog stats: %s", syslog)
+	}
+	jsonl := report.Files[filepath.Join(dir, "jsonl")]
+	if jsonl.DecodeErrors != 1 || jsonl.Invalid[errNoChannel.Error()] != 2 ||
+		jsonl.Invalid[errBadWeekOfInstall.Error()] != 1 || jsonl.Accepted != 1 {
+		t.Fatalf("Unexpected JSON Lines stats: %s", jsonl)
+	}
+	csv := report.Files[filepath.Join(dir, "csv")]
+	if csv.LinesRead != 3 || csv.DecodeErrors != 1 || csv.Accepted != 2 {
+		t.Fatalf("Unexpected CSV stats: %s", csv)
+	}
+	total := report.Total
+	if total.LinesRead != 11 || total.DecodeErrors != 3 || total.NumInvalid() != 3 ||
+		total.Accepted != 4 || total.Failures != 0 {
+		t.Fatalf("Unexpected total stats: %s", total)
+	}
+
+	// Every rejected line must be in the quarantine.
+	f, err := os.Open(quarantineFile)
+	if err != nil {
+		t.Fatalf("Failed to open quarantine: %s", err)
+	}
+	defer f.Close()
+	// Quarantined lines must point at the physical line in the input file,
+	// including empty lines and the CSV header.
+	expected := map[string]bool{"syslog:3": true, "jsonl:3": true, "jsonl:4": true, "jsonl:5": true, "jsonl:6": true, "csv:3": true}
+	numQuarantined := 0
+	for s := bufio.NewScanner(f); s.Scan(); numQuarantined++ {
+		var l quarantinedLine
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			t.Fatalf("Failed to unmarshal quarantined line: %s", err)
+		}
+		if l.File == "" || l.Line == 0 || l.Reason == "" {
+			t.Fatalf("Quarantined line is incomplete: %+v", l)
+		}
+		if pos := fmt.Sprintf("%s:%d", filepath.Base(l.File), l.Line); !expected[pos] {
+			t.Fatalf("Unexpected quarantined line %s: %+v", pos, l)
+		}
+	}
+	if numQuarantined != 6 {
+		t.Fatalf("Expected 6 quarantined lines but got %d.", numQuarantined)
+	}
+}
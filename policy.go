@@ -0,0 +1,143 @@
+package main
+
+// This file implements threshold policies, which let us use different
+// anonymity thresholds (and crowd ID strategies) for different P3A metrics.
+// Policies are defined in our configuration file as an ordered list of rules,
+// the first of which that matches a metric's name applies, e.g.:
+//
+//   "threshold_policy": [
+//     {"pattern": "Brave.Core.NumberOfExtensions", "threshold": 50, "crowd_id_strategy": "minimal"},
+//     {"pattern": "Brave.Welcome.*", "threshold": 20}
+//   ]
+//
+// Metrics that match no rule use the shuffler's anonymity threshold and crowd
+// ID strategy.  Rules can only raise the anonymity threshold: a rule whose
+// threshold is below the shuffler's would weaken the k-anonymity guarantee
+// that the shuffler advertises, so our configuration rejects such rules, and
+// simulations that sweep over thresholds use the larger of the two.
+
+import (
+	"fmt"
+	"path"
+)
+
+// thresholdRuleConfig represents the configuration of a single rule of a
+// threshold policy.
+type thresholdRuleConfig struct {
+	// Pattern is matched against metric names using path.Match, e.g.
+	// "Brave.Core.*".
+	Pattern   string `json:"pattern"`
+	Threshold int    `json:"threshold"`
+	// Strategy is the (optional) name of the crowd ID strategy for matching
+	// metrics.
+	Strategy string `json:"crowd_id_strategy,omitempty"`
+}
+
+// validate returns an error if the rule's pattern or threshold is invalid.
+func (c *thresholdRuleConfig) validate() error {
+	if _, err := path.Match(c.Pattern, ""); err != nil || c.Pattern == "" {
+		return fmt.Errorf("threshold policy has bad pattern %q", c.Pattern)
+	}
+	if c.Threshold < 1 {
+		return fmt.Errorf("threshold of pattern %q must be at least 1 but is %d", c.Pattern, c.Threshold)
+	}
+	return nil
+}
+
+// thresholdRule is a rule of a threshold policy.  A nil strategy means that
+// the shuffler's strategy applies.
+type thresholdRule struct {
+	pattern   string
+	threshold int
+	strategy  CrowdIDStrategy
+}
+
+// thresholdPolicy maps metric names to anonymity thresholds and crowd ID
+// strategies.  A nil policy has no rules.
+type thresholdPolicy struct {
+	rules []*thresholdRule
+}
+
+// newThresholdPolicy returns a new threshold policy for the given rules.  The
+// rules' strategies are looked up in the given registry.
+func newThresholdPolicy(cfgs []*thresholdRuleConfig, registry *strategyRegistry) (*thresholdPolicy, error) {
+	p := &thresholdPolicy{}
+	for _, cfg := range cfgs {
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		rule := &thresholdRule{pattern: cfg.Pattern, threshold: cfg.Threshold}
+		if cfg.Strategy != "" {
+			s, err := registry.Lookup(cfg.Strategy)
+			if err != nil {
+				return nil, err
+			}
+			rule.strategy = s
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// match returns the first rule that matches the given metric name, or nil if
+// no rule matches.
+func (p *thresholdPolicy) match(metricName string) *thresholdRule {
+	if p == nil {
+		return nil
+	}
+	for _, rule := range p.rules {
+		if matched, _ := path.Match(rule.pattern, metricName); matched {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ruleFor returns the rule that applies to the given report.  Only P3A
+// measurements have a metric name, so rules never apply to other reports.
+func (p *thresholdPolicy) ruleFor(r Report) *thresholdRule {
+	m, ok := r.(P3AMeasurement)
+	if !ok {
+		return nil
+	}
+	return p.match(m.MetricName)
+}
+
+// threshold returns the anonymity threshold for the given report, which is
+// the given default unless a rule raises it.
+func (p *thresholdPolicy) threshold(r Report, def int) int {
+	if rule := p.ruleFor(r); rule != nil && rule.threshold > def {
+		return rule.threshold
+	}
+	return def
+}
+
+// batchRules returns the policy's rules as they apply to a batch with the given
+// default threshold and crowd ID strategy, i.e. with the threshold that we
+// enforced and the name of the strategy that we used.
+func (p *thresholdPolicy) batchRules(def int, strategy CrowdIDStrategy) []batchRule {
+	if p == nil {
+		return nil
+	}
+	var rules []batchRule
+	for _, rule := range p.rules {
+		r := batchRule{Pattern: rule.pattern, Threshold: def, CrowdIDMethod: strategy.Name()}
+		if rule.threshold > def {
+			r.Threshold = rule.threshold
+		}
+		if rule.strategy != nil {
+			r.CrowdIDMethod = rule.strategy.Name()
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// strategy returns the crowd ID strategy for the given report, or the given
+// default if no rule (with a strategy) applies.
+func (p *thresholdPolicy) strategy(r Report, def CrowdIDStrategy) CrowdIDStrategy {
+	if rule := p.ruleFor(r); rule != nil && rule.strategy != nil {
+		return rule.strategy
+	}
+	return def
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestThresholdPolicy(t *testing.T) {
+	p, err := newThresholdPolicy([]*thresholdRuleConfig{
+		{Pattern: "Brave.Core.NumberOfExtensions", Threshold: 50, Strategy: "minimal"},
+		{Pattern: "Brave.Core.*", Threshold: 20},
+		{Pattern: "Brave.Welcome.*", Threshold: 2},
+	}, strategies)
+	if err != nil {
+		t.Fatalf("Failed to create threshold policy: %s", err)
+	}
+	for name, expected := range map[string]struct {
+		threshold int
+		strategy  CrowdIDStrategy
+	}{
+		"Brave.Core.NumberOfExtensions": {50, strategyMinimal},
+		"Brave.Core.TorEverUsed":        {20, strategyAll},
+		"Brave.Foo":                     {10, strategyAll},
+		// Rules cannot lower the threshold.
+		"Brave.Welcome.InteractionStatus": {10, strategyAll},
+	} {
+		m := P3AMeasurement{MetricName: name}
+		if k := p.threshold(m, 10); k != expected.threshold {
+			t.Fatalf("Expected threshold %d for %s but got %d.", expected.threshold, name, k)
+		}
+		if s := p.strategy(m, strategyAll); s != expected.strategy {
+			t.Fatalf("Expected strategy %s for %s but got %s.", expected.strategy.Name(), name, s.Name())
+		}
+	}
+	// Rules never apply to reports without a metric name, and a nil policy
+	// has no rules.
+	if k := p.threshold(&DummyReport{}, 10); k != 10 {
+		t.Fatalf("Expected default threshold for non-P3A report but got %d.", k)
+	}
+	var nilPolicy *thresholdPolicy
+	if k := nilPolicy.threshold(P3AMeasurement{MetricName: "Brave.Core.TorEverUsed"}, 10); k != 10 {
+		t.Fatalf("Expected default threshold for nil policy but got %d.", k)
+	}
+
+	for _, cfg := range []*thresholdRuleConfig{
+		{Pattern: "", Threshold: 5},
+		{Pattern: "Brave.[", Threshold: 5},
+		{Pattern: "Brave.*", Threshold: 0},
+		{Pattern: "Brave.*", Threshold: 5, Strategy: "foo"},
+	} {
+		if _, err := newThresholdPolicy([]*thresholdRuleConfig{cfg}, strategies); err == nil {
+			t.Fatalf("Accepted bad threshold rule %+v.", cfg)
+		}
+	}
+}
+
+func TestBriefcasePolicy(t *testing.T) {
+	var m P3AMeasurement
+	if err := json.Unmarshal([]byte(testMeasurement), &m); err != nil {
+		t.Fatalf("Failed to unmarshal measurement: %s", err)
+	}
+	sensitive := m
+	sensitive.MetricName = "Brave.Core.NumberOfExtensions"
+	p, err := newThresholdPolicy([]*thresholdRuleConfig{
+		{Pattern: "Brave.Core.*", Threshold: 3},
+	}, strategies)
+	if err != nil {
+		t.Fatalf("Failed to create threshold policy: %s", err)
+	}
+
+	b := NewBriefcase(strategyAll)
+	b.policy = p
+	b.Add([]Report{m, m, sensitive, sensitive})
+	// Our default threshold of 2 applies to m, but the policy's threshold of
+	// 3 applies to the sensitive metric.
+	b.DumpFewerThan(2)
+	checkLengths(t, b, 2, 1)
+}
@@ -0,0 +1,284 @@
+package main
+
+// This file implements the results of our simulations and the writers that
+// output them as JSON, JSON Lines, or CSV.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	resultTypeShuffler    = "shuffler"
+	resultTypeSTAR        = "star"
+	resultTypeSTARLengths = "star_partial_lengths"
+)
+
+// result is a typed record that a simulation produces.
+type result interface {
+	// resultType returns the record's type, e.g. "shuffler".
+	resultType() string
+	// csvHeader returns the column names of the record type.
+	csvHeader() []string
+	// csvRecord returns the record's CSV-encoded columns.
+	csvRecord() []string
+}
+
+// shufflerResult is the result of a shuffler simulation.
+type shufflerResult struct {
+	Strategy      string  `json:"strategy"`
+	Threshold     int     `json:"threshold"`
+	NumReports    int     `json:"num_reports"`
+	NumForwarded  int     `json:"num_forwarded"`
+	FracForwarded float64 `json:"frac_forwarded"`
+	// Policy is true if the simulation used our threshold policy.
+	Policy bool `json:"policy"`
+	// The following fields describe noisy thresholding, if any.
+	Mechanism    string  `json:"mechanism"`
+	Epsilon      float64 `json:"epsilon"`
+	Delta        float64 `json:"delta"`
+	DropFraction float64 `json:"drop_fraction"`
+	// UtilityCost is the fraction of reports that noisy thresholding costs us,
+	// compared to deterministic thresholding.
+	UtilityCost float64 `json:"utility_cost"`
+}
+
+func (r *shufflerResult) resultType() string { return resultTypeShuffler }
+
+func (r *shufflerResult) csvHeader() []string {
+	return []string{"strategy", "threshold", "num_reports", "num_forwarded", "frac_forwarded", "policy",
+		"mechanism", "epsilon", "delta", "drop_fraction", "utility_cost"}
+}
+
+func (r *shufflerResult) csvRecord() []string {
+	return []string{
+		r.Strategy,
+		strconv.Itoa(r.Threshold),
+		strconv.Itoa(r.NumReports),
+		strconv.Itoa(r.NumForwarded),
+		formatFloat(r.FracForwarded),
+		strconv.FormatBool(r.Policy),
+		r.Mechanism,
+		formatFloat(r.Epsilon),
+		formatFloat(r.Delta),
+		formatFloat(r.DropFraction),
+		formatFloat(r.UtilityCost),
+	}
+}
+
+// starResult is the result of a Nested STAR simulation.
+type starResult struct {
+	Strategy  string `json:"strategy"`
+	Order     string `json:"order"`
+	Threshold int    `json:"threshold"`
+	// Policy is true if the simulation used our threshold policy.
+	Policy          bool    `json:"policy"`
+	NumMeasurements int     `json:"num_measurements"`
+	NumFull         int     `json:"num_full"`
+	NumPartial      int     `json:"num_partial"`
+	FracPartial     float64 `json:"frac_partial"`
+	NumTags         int     `json:"num_tags"`
+	NumLeafTags     int     `json:"num_leaf_tags"`
+}
+
+func (r *starResult) resultType() string { return resultTypeSTAR }
+
+func (r *starResult) csvHeader() []string {
+	return []string{"strategy", "order", "threshold", "policy", "num_measurements", "num_full",
+		"num_partial", "frac_partial", "num_tags", "num_leaf_tags"}
+}
+
+func (r *starResult) csvRecord() []string {
+	return []string{
+		r.Strategy,
+		r.Order,
+		strconv.Itoa(r.Threshold),
+		strconv.FormatBool(r.Policy),
+		strconv.Itoa(r.NumMeasurements),
+		strconv.Itoa(r.NumFull),
+		strconv.Itoa(r.NumPartial),
+		formatFloat(r.FracPartial),
+		strconv.Itoa(r.NumTags),
+		strconv.Itoa(r.NumLeafTags),
+	}
+}
+
+// starLengthResult is the number of partial measurements of a given length,
+// i.e. with the given number of unlocked attributes, in a Nested STAR
+// simulation.
+type starLengthResult struct {
+	Strategy  string `json:"strategy"`
+	Order     string `json:"order"`
+	Threshold int    `json:"threshold"`
+	// Policy is true if the simulation used our threshold policy.
+	Policy     bool `json:"policy"`
+	Length     int  `json:"length"`
+	NumPartial int  `json:"num_partial"`
+}
+
+func (r *starLengthResult) resultType() string { return resultTypeSTARLengths }
+
+func (r *starLengthResult) csvHeader() []string {
+	return []string{"strategy", "order", "threshold", "policy", "length", "num_partial"}
+}
+
+func (r *starLengthResult) csvRecord() []string {
+	return []string{
+		r.Strategy,
+		r.Order,
+		strconv.Itoa(r.Threshold),
+		strconv.FormatBool(r.Policy),
+		strconv.Itoa(r.Length),
+		strconv.Itoa(r.NumPartial),
+	}
+}
+
+// orderName returns the name of the given STAR attribute order.
+func orderName(order int) string {
+	if order == orderHighEntropyLast {
+		return "last"
+	}
+	return "first"
+}
+
+// resultWriter writes simulation results.  Results may be buffered until the
+// writer is closed.
+type resultWriter interface {
+	Write(r result) error
+	Close() error
+}
+
+// newResultWriter returns a writer for the given format ("json", "jsonl", or
+// "csv") that writes to the given file, or to stdout if the file is empty.
+// CSV output consists of one file per result type, whose names are derived
+// from the given file, e.g. "out-shuffler.csv" for "out.csv".
+func newResultWriter(format, filename string) (resultWriter, error) {
+	switch format {
+	case "json", "jsonl":
+		var w io.WriteCloser = nopWriteCloser{os.Stdout}
+		if filename != "" {
+			f, err := os.Create(filename)
+			if err != nil {
+				return nil, err
+			}
+			w = f
+		}
+		if format == "json" {
+			return &jsonResultWriter{w: w, results: make(map[string][]result)}, nil
+		}
+		return &jsonLinesResultWriter{w: w}, nil
+	case "csv":
+		if filename == "" {
+			return nil, fmt.Errorf("CSV output requires an output file")
+		}
+		return &csvResultWriter{filename: filename, files: make(map[string]*csvFile)}, nil
+	default:
+		return nil, fmt.Errorf("output format must be \"json\", \"jsonl\", or \"csv\" but is %q", format)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// jsonResultWriter writes a single JSON object that maps result types to
+// lists of results.
+type jsonResultWriter struct {
+	w       io.WriteCloser
+	results map[string][]result
+}
+
+func (w *jsonResultWriter) Write(r result) error {
+	w.results[r.resultType()] = append(w.results[r.resultType()], r)
+	return nil
+}
+
+func (w *jsonResultWriter) Close() error {
+	enc := json.NewEncoder(w.w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(w.results); err != nil {
+		w.w.Close()
+		return err
+	}
+	return w.w.Close()
+}
+
+// jsonLinesResultWriter writes one JSON object per result, whose "type" field
+// contains the result type.
+type jsonLinesResultWriter struct {
+	w io.WriteCloser
+}
+
+func (w *jsonLinesResultWriter) Write(r result) error {
+	record, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// Splice the type into the record's JSON object.
+	line := fmt.Sprintf("{\"type\":%q,%s\n", r.resultType(), record[1:])
+	_, err = io.WriteString(w.w, line)
+	return err
+}
+
+func (w *jsonLinesResultWriter) Close() error {
+	return w.w.Close()
+}
+
+// csvFile is a CSV file for a single result type.
+type csvFile struct {
+	f *os.File
+	w *csv.Writer
+}
+
+// csvResultWriter writes one CSV file per result type.
+type csvResultWriter struct {
+	filename string
+	files    map[string]*csvFile
+}
+
+// csvFilename returns the name of the CSV file for the given result type.
+func (w *csvResultWriter) csvFilename(resultType string) string {
+	ext := filepath.Ext(w.filename)
+	if ext == "" {
+		ext = ".csv"
+	}
+	return strings.TrimSuffix(w.filename, filepath.Ext(w.filename)) + "-" + resultType + ext
+}
+
+func (w *csvResultWriter) Write(r result) error {
+	file, exists := w.files[r.resultType()]
+	if !exists {
+		f, err := os.Create(w.csvFilename(r.resultType()))
+		if err != nil {
+			return err
+		}
+		file = &csvFile{f: f, w: csv.NewWriter(f)}
+		w.files[r.resultType()] = file
+		if err := file.w.Write(r.csvHeader()); err != nil {
+			return err
+		}
+	}
+	return file.w.Write(r.csvRecord())
+}
+
+func (w *csvResultWriter) Close() error {
+	var firstErr error
+	for _, file := range w.files {
+		file.w.Flush()
+		if err := file.w.Error(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := file.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
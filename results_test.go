@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testResults = []result{
+	&shufflerResult{Strategy: "All", Threshold: 10, NumReports: 4, NumForwarded: 2, FracForwarded: 0.5},
+	&starResult{Strategy: "All", Order: "first", Threshold: 10, NumMeasurements: 4, NumFull: 1, NumPartial: 2},
+	&starLengthResult{Strategy: "All", Order: "first", Threshold: 10, Length: 1, NumPartial: 2},
+	&starLengthResult{Strategy: "All", Order: "first", Threshold: 10, Length: 2, NumPartial: 0},
+}
+
+func writeResults(t *testing.T, format, filename string) {
+	w, err := newResultWriter(format, filename)
+	if err != nil {
+		t.Fatalf("Failed to create %s writer: %s", format, err)
+	}
+	for _, r := range testResults {
+		if err := w.Write(r); err != nil {
+			t.Fatalf("Failed to write %s result: %s", format, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close %s writer: %s", format, err)
+	}
+}
+
+func TestJSONResults(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.json")
+	writeResults(t, "json", filename)
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read results: %s", err)
+	}
+	var results map[string][]map[string]interface{}
+	if err := json.Unmarshal(content, &results); err != nil {
+		t.Fatalf("Failed to unmarshal results: %s", err)
+	}
+	if len(results[resultTypeShuffler]) != 1 ||
+		len(results[resultTypeSTAR]) != 1 ||
+		len(results[resultTypeSTARLengths]) != 2 {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+	if results[resultTypeShuffler][0]["frac_forwarded"] != 0.5 {
+		t.Fatalf("Unexpected shuffler result: %v", results[resultTypeShuffler][0])
+	}
+}
+
+func TestJSONLinesResults(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.jsonl")
+	writeResults(t, "jsonl", filename)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to open results: %s", err)
+	}
+	defer f.Close()
+	types := []string{}
+	for s := bufio.NewScanner(f); s.Scan(); {
+		var r map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("Failed to unmarshal result %q: %s", s.Text(), err)
+		}
+		if r["strategy"] != "All" {
+			t.Fatalf("Result lacks its fields: %v", r)
+		}
+		types = append(types, r["type"].(string))
+	}
+	for i, r := range testResults {
+		if types[i] != r.resultType() {
+			t.Fatalf("Expected result type %q but got %q.", r.resultType(), types[i])
+		}
+	}
+}
+
+func TestCSVResults(t *testing.T) {
+	dir := t.TempDir()
+	writeResults(t, "csv", filepath.Join(dir, "out.csv"))
+
+	for resultType, numRecords := range map[string]int{
+		resultTypeShuffler:    1,
+		resultTypeSTAR:        1,
+		resultTypeSTARLengths: 2,
+	} {
+		f, err := os.Open(filepath.Join(dir, "out-"+resultType+".csv"))
+		if err != nil {
+			t.Fatalf("Failed to open CSV file: %s", err)
+		}
+		records, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatalf("Failed to read CSV file: %s", err)
+		}
+		if len(records) != numRecords+1 {
+			t.Fatalf("Expected %d %s records but got %d.", numRecords, resultType, len(records)-1)
+		}
+		if records[0][0] != "strategy" {
+			t.Fatalf("Unexpected %s header: %v", resultType, records[0])
+		}
+	}
+
+	if _, err := newResultWriter("csv", ""); err == nil {
+		t.Fatal("Expected CSV writer without output file to fail.")
+	}
+	if _, err := newResultWriter("xml", ""); err == nil {
+		t.Fatal("Expected writer for unknown format to fail.")
+	}
+}
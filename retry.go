@@ -0,0 +1,180 @@
+package main
+
+// This file implements the forwarder's retry queue, which holds on to chunks
+// of batches that we failed to forward, so we can try again later.  The queue
+// only lives in memory.  Retries protect against analyzer outages while the
+// shuffler is running; surviving a shuffler restart is out of scope, because
+// persisting the queue would put shuffled reports on storage that the host
+// controls.  Chunks that are still queued when the shuffler exits count as
+// lost.
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// RetryPolicy determines how the forwarder re-submits chunks that it failed
+// to forward.
+type RetryPolicy struct {
+	// MaxBatches is the maximum number of chunks that the retry queue holds.
+	// Chunks that fail while the queue is full are lost.
+	MaxBatches int
+	// InitialBackoff is the delay before the first retry.  The delay doubles
+	// with every subsequent retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two retries.
+	MaxBackoff time.Duration
+	// Deadline determines how long after its first failure we keep retrying a
+	// chunk before we give up on it.
+	Deadline time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxBatches:     1024,
+	InitialBackoff: time.Second * 10,
+	MaxBackoff:     time.Minute * 30,
+	Deadline:       time.Hour * 12,
+}
+
+// pendingBatch represents a chunk of reports that is waiting to be retried.
+type pendingBatch struct {
+	sink         Sink
+	batch        *Batch
+	attempts     int
+	firstFailure time.Time
+	nextAttempt  time.Time
+}
+
+// retryQueue is a bounded queue of chunks that we failed to forward.
+type retryQueue struct {
+	sync.Mutex
+	policy  RetryPolicy
+	batches []*pendingBatch
+	numLost int
+}
+
+// newRetryQueue returns a new retry queue that uses the given policy.
+func newRetryQueue(policy RetryPolicy) *retryQueue {
+	return &retryQueue{policy: policy}
+}
+
+// backoff returns the delay before the given attempt.  The delay grows
+// exponentially with the number of attempts and is jittered, so that retries
+// don't hit the analyzer in lockstep once it comes back up.
+func (q *retryQueue) backoff(attempt int) time.Duration {
+	d := q.policy.InitialBackoff
+	for i := 1; i < attempt && d < q.policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.policy.MaxBackoff {
+		d = q.policy.MaxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+
+	// Pick a delay uniformly at random from [d/2, d].
+	half := d / 2
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(d-half)+1))
+	if err != nil {
+		return d
+	}
+	return half + time.Duration(jitter.Int64())
+}
+
+// lose records that we permanently lost the given number of reports.  The
+// caller must hold the queue's lock.
+func (q *retryQueue) lose(num int) {
+	q.numLost += num
+	metrics.reportsLost.Add(num)
+}
+
+// add adds a chunk whose first attempt to be forwarded to the given sink
+// failed.  If the queue is full, the chunk is lost and add returns false.
+func (q *retryQueue) add(sink Sink, batch *Batch, now time.Time) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.batches) >= q.policy.MaxBatches {
+		q.lose(len(batch.Reports))
+		elog.Printf("Retry queue is full.  Lost %d reports.", len(batch.Reports))
+		return false
+	}
+	q.batches = append(q.batches, &pendingBatch{
+		sink:         sink,
+		batch:        batch,
+		attempts:     1,
+		firstFailure: now,
+		nextAttempt:  now.Add(q.backoff(1)),
+	})
+	return true
+}
+
+// due removes and returns all batches whose next attempt is due.
+func (q *retryQueue) due(now time.Time) []*pendingBatch {
+	q.Lock()
+	defer q.Unlock()
+
+	var due, remaining []*pendingBatch
+	for _, b := range q.batches {
+		if now.Before(b.nextAttempt) {
+			remaining = append(remaining, b)
+		} else {
+			due = append(due, b)
+		}
+	}
+	q.batches = remaining
+	return due
+}
+
+// failed re-schedules a batch whose retry failed.  If the batch has exceeded
+// our deadline, it is lost and failed returns false.
+func (q *retryQueue) failed(b *pendingBatch, now time.Time) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	b.attempts++
+	b.nextAttempt = now.Add(q.backoff(b.attempts))
+	if b.nextAttempt.Sub(b.firstFailure) > q.policy.Deadline {
+		q.lose(len(b.batch.Reports))
+		elog.Printf("Giving up on %s after %d attempts.", b.batch, b.attempts)
+		return false
+	}
+	if len(q.batches) >= q.policy.MaxBatches {
+		q.lose(len(b.batch.Reports))
+		elog.Printf("Retry queue is full.  Lost %d reports.", len(b.batch.Reports))
+		return false
+	}
+	q.batches = append(q.batches, b)
+	return true
+}
+
+// dropAll empties the queue and counts all queued reports as lost.
+func (q *retryQueue) dropAll() {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, b := range q.batches {
+		q.lose(len(b.batch.Reports))
+	}
+	q.batches = nil
+}
+
+// size returns the number of batches in the queue.
+func (q *retryQueue) size() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.batches)
+}
+
+// NumLost returns the number of reports that we permanently lost because we
+// failed to forward them.
+func (q *retryQueue) NumLost() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.numLost
+}
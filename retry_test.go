@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	q := newRetryQueue(RetryPolicy{
+		MaxBatches:     1,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Second * 8,
+		Deadline:       time.Minute,
+	})
+
+	for attempt, max := range []time.Duration{
+		time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 8,
+	} {
+		d := q.backoff(attempt + 1)
+		if d < max/2 || d > max {
+			t.Fatalf("Expected backoff in [%s, %s] but got %s.", max/2, max, d)
+		}
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	now := time.Now()
+	q := newRetryQueue(RetryPolicy{
+		MaxBatches:     1,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Second,
+		Deadline:       time.Second * 3,
+	})
+	batch := &Batch{Reports: []Report{&DummyReport{crowdID: CrowdID("foo")}}}
+
+	if !q.add(nil, batch, now) {
+		t.Fatal("Failed to add batch to empty retry queue.")
+	}
+	// The queue only holds a single batch, so the following batch is lost.
+	if q.add(nil, batch, now) {
+		t.Fatal("Added batch to full retry queue.")
+	}
+	if q.NumLost() != 1 {
+		t.Fatalf("Expected 1 lost report but got %d.", q.NumLost())
+	}
+
+	if len(q.due(now)) != 0 {
+		t.Fatal("Batch must not be due before its backoff elapsed.")
+	}
+	due := q.due(now.Add(time.Second))
+	if len(due) != 1 || q.size() != 0 {
+		t.Fatal("Expected batch to be due after its backoff elapsed.")
+	}
+
+	// Keep failing until we exceed our deadline.
+	b := due[0]
+	for q.failed(b, b.nextAttempt) {
+		if q.due(b.nextAttempt)[0] != b {
+			t.Fatal("Expected failed batch to be due again.")
+		}
+	}
+	if q.NumLost() != 2 || q.size() != 0 {
+		t.Fatalf("Expected 2 lost reports but got %d.", q.NumLost())
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+const (
+	// progressInterval is the number of reports after which we log our
+	// progress while reading the dataset.
+	progressInterval = 1000000
+	// simulationBacklog is the number of report chunks that a simulation can
+	// buffer before the dataset reader blocks.
+	simulationBacklog = 16
+)
+
+// simulation is a single (strategy, order) combination whose state we build
+// in one pass over the dataset and then evaluate for our thresholds.
+type simulation interface {
+	// add adds the given reports to the simulation's state.  The reports are
+	// shared with other simulations and must not be modified.
+	add(reports []Report)
+	// tasks returns the functions that evaluate the simulation's state for
+	// the given thresholds.  Tasks may run concurrently.
+	tasks(thresholds []int) []func() []result
+}
+
+// shufflerSimulation simulates the shuffler for a given crowd ID strategy,
+// (optional) threshold policy, and (optional) noisy thresholding.  Whether
+// the shuffler forwards a crowd only depends on the crowd's size and
+// threshold, so rather than holding on to reports, we only count the reports
+// of every crowd.
+type shufflerSimulation struct {
+	strategy CrowdIDStrategy
+	policy   *thresholdPolicy
+	noise    *noiseConfig
+	noisy    *noisyThreshold
+	key      crowdIDKey
+	// crowds maps the rules of our policy to the number of reports of every
+	// crowd that the rule applies to.  Crowds that no rule applies to are
+	// counted under the nil rule.  All reports of a crowd share the same
+	// metric name and thus the same rule.
+	crowds     map[*thresholdRule]map[CrowdID]int
+	numReports int
+}
+
+func newShufflerSimulation(strategy CrowdIDStrategy, policy *thresholdPolicy, noise *noiseConfig) (*shufflerSimulation, error) {
+	key, err := newCrowdIDKey()
+	if err != nil {
+		return nil, err
+	}
+	s := &shufflerSimulation{
+		strategy: strategy,
+		policy:   policy,
+		noise:    noise,
+		key:      key,
+		crowds:   make(map[*thresholdRule]map[CrowdID]int),
+	}
+	if noise != nil {
+		if s.noisy, err = newNoisyThreshold(noise); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// add counts the given reports.  Like the shuffler, we drop a random fraction
+// of reports before thresholding.  We do so once, while counting, so that all
+// thresholds see the same subsample.
+func (s *shufflerSimulation) add(reports []Report) {
+	s.numReports += len(reports)
+	for _, r := range s.noisy.subsample(reports) {
+		rule := s.policy.ruleFor(r)
+		counts, exists := s.crowds[rule]
+		if !exists {
+			counts = make(map[CrowdID]int)
+			s.crowds[rule] = counts
+		}
+		counts[r.CrowdID(s.policy.strategy(r, s.strategy), s.key)]++
+	}
+}
+
+// tasks returns one task per threshold, all of which share the simulation's
+// crowd counts.  Every task gets its own noisy threshold: the thresholds are
+// unrelated runs, so their privacy budgets must not add up.
+func (s *shufflerSimulation) tasks(thresholds []int) []func() []result {
+	var tasks []func() []result
+	for _, k := range thresholds {
+		k := k
+		tasks = append(tasks, func() []result {
+			noisy := s.noisy.fresh()
+			numCrowds, numDumped, numForwarded := 0, 0, 0
+			for rule, counts := range s.crowds {
+				// Like the shuffler, we only let rules raise the threshold.
+				threshold := k
+				if rule != nil && rule.threshold > k {
+					threshold = rule.threshold
+				}
+				for _, n := range counts {
+					numCrowds++
+					if noisy.meets(n, threshold) {
+						numForwarded += n
+					} else {
+						numDumped++
+					}
+				}
+			}
+			noisy.account(numCrowds, numDumped, k)
+
+			r := &shufflerResult{
+				Strategy:      s.strategy.Name(),
+				Threshold:     k,
+				NumReports:    s.numReports,
+				NumForwarded:  numForwarded,
+				FracForwarded: frac(numForwarded, s.numReports),
+				Policy:        s.policy != nil,
+			}
+			if s.noise != nil {
+				r.Mechanism = s.noise.Mechanism
+				if s.noise.Mechanism != "" {
+					r.Epsilon, r.Delta = noisy.budget(k)
+				}
+				r.DropFraction = s.noise.DropFraction
+			}
+			return []result{r}
+		})
+	}
+	return tasks
+}
+
+// starSimulation simulates Nested STAR for a given crowd ID strategy,
+// attribute order, and (optional) threshold policy.
+type starSimulation struct {
+	strategy CrowdIDStrategy
+	order    int
+	policy   *thresholdPolicy
+	// groups contains a tree for the reports that no rule of our policy
+	// applies to, followed by one tree per rule.  A rule may use its own
+	// strategy and threshold, so its reports cannot share a tree with other
+	// reports.
+	groups []*starGroup
+	// groupOf maps the rules of our policy to their index in groups.
+	groupOf map[*thresholdRule]int
+}
+
+// starGroup is a tree of Nested STAR measurements that share a crowd ID
+// strategy and a threshold rule.
+type starGroup struct {
+	star     *NestedSTAR
+	strategy CrowdIDStrategy
+	rule     *thresholdRule
+	numAttrs int
+}
+
+func newSTARGroup(strategy CrowdIDStrategy, order int, rule *thresholdRule) *starGroup {
+	return &starGroup{
+		star:     NewNestedSTAR(order),
+		strategy: strategy,
+		rule:     rule,
+		numAttrs: len(P3AMeasurement{}.OrderHighEntropyFirst(strategy)),
+	}
+}
+
+// threshold returns the group's threshold if we simulate the given default
+// threshold.  Like the shuffler, we only let rules raise the threshold.
+func (g *starGroup) threshold(def int) int {
+	if g.rule != nil && g.rule.threshold > def {
+		return g.rule.threshold
+	}
+	return def
+}
+
+func newSTARSimulation(strategy CrowdIDStrategy, order int, policy *thresholdPolicy) *starSimulation {
+	s := &starSimulation{
+		strategy: strategy,
+		order:    order,
+		policy:   policy,
+		groups:   []*starGroup{newSTARGroup(strategy, order, nil)},
+		groupOf:  make(map[*thresholdRule]int),
+	}
+	if policy != nil {
+		for _, rule := range policy.rules {
+			ruleStrategy := strategy
+			if rule.strategy != nil {
+				ruleStrategy = rule.strategy
+			}
+			s.groupOf[rule] = len(s.groups)
+			s.groups = append(s.groups, newSTARGroup(ruleStrategy, order, rule))
+		}
+	}
+	return s
+}
+
+func (s *starSimulation) add(reports []Report) {
+	if s.policy == nil {
+		s.groups[0].star.AddReports(s.strategy, reports)
+		return
+	}
+	grouped := make([][]Report, len(s.groups))
+	for _, r := range reports {
+		i := 0
+		if rule := s.policy.ruleFor(r); rule != nil {
+			i = s.groupOf[rule]
+		}
+		grouped[i] = append(grouped[i], r)
+	}
+	for i, g := range s.groups {
+		if len(grouped[i]) > 0 {
+			g.star.AddReports(g.strategy, grouped[i])
+		}
+	}
+}
+
+// tasks returns one task per threshold, all of which share the simulation's
+// trees of nodes.
+func (s *starSimulation) tasks(thresholds []int) []func() []result {
+	var tasks []func() []result
+	for _, k := range thresholds {
+		k := k
+		tasks = append(tasks, func() []result {
+			a := newSTARAggregate()
+			for _, g := range s.groups {
+				a.add(g.star, g.numAttrs, g.threshold(k))
+			}
+			return a.results(s.strategy, s.order, k, s.policy != nil)
+		})
+	}
+	return tasks
+}
+
+// simulationRunner runs all of our simulations over a single pass over the
+// dataset, and evaluates them using a pool of workers.
+type simulationRunner struct {
+	cfg     *simulationConfig
+	workers int
+}
+
+func newSimulationRunner(cfg *simulationConfig) *simulationRunner {
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	return &simulationRunner{cfg: cfg, workers: workers}
+}
+
+// simulations returns the simulations that the runner's configuration asks
+// for.  The shuffler doesn't care about the order of attributes, so we only
+// simulate it once per strategy, threshold policy (if any), and noise
+// configuration (if any).
+func (r *simulationRunner) simulations() ([]simulation, error) {
+	policies := []*thresholdPolicy{nil}
+	if r.cfg.Policy != nil {
+		policies = append(policies, r.cfg.Policy)
+	}
+	noises := append([]*noiseConfig{nil}, r.cfg.Noise...)
+
+	var sims []simulation
+	for _, strategy := range r.cfg.Strategies {
+		for _, policy := range policies {
+			for _, noise := range noises {
+				if r.cfg.RunShuffler {
+					sim, err := newShufflerSimulation(strategy, policy, noise)
+					if err != nil {
+						return nil, err
+					}
+					sims = append(sims, sim)
+				}
+			}
+		}
+		if !r.cfg.RunSTAR {
+			continue
+		}
+		for _, order := range r.cfg.Orders {
+			for _, policy := range policies {
+				sims = append(sims, newSTARSimulation(strategy, order, policy))
+			}
+		}
+	}
+	return sims, nil
+}
+
+// needsVersions returns true if any of the strategies that we simulate,
+// including the strategies of our threshold policy, uses the recent_version
+// attribute.
+func (r *simulationRunner) needsVersions() bool {
+	strategies := append([]CrowdIDStrategy{}, r.cfg.Strategies...)
+	if r.cfg.Policy != nil {
+		for _, rule := range r.cfg.Policy.rules {
+			if rule.strategy != nil {
+				strategies = append(strategies, rule.strategy)
+			}
+		}
+	}
+	for _, s := range strategies {
+		for _, name := range s.AttributeNames() {
+			if name == "recent_version" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// learnVersions makes the given tracker learn the latest version of every
+// channel from the iterator's reports, and then freezes the tracker.  Our
+// simulations compute crowd IDs concurrently, and an unfrozen tracker learns
+// from every version it's asked about.  Whether a report is recent would then
+// depend on the order in which the simulations happen to see the reports.
+func learnVersions(it *reportIterator, t *VersionTracker) {
+	for it.Next() {
+		if m, ok := it.Report().(P3AMeasurement); ok {
+			_, _ = t.IsRecent(m.Channel, m.Version)
+		}
+	}
+	t.Freeze()
+}
+
+// build feeds every report of the given iterator to all simulations, each of
+// which consumes reports in its own goroutine.
+func (r *simulationRunner) build(it *reportIterator, sims []simulation) {
+	var wg sync.WaitGroup
+	inboxes := make([]chan []Report, len(sims))
+	for i, sim := range sims {
+		inboxes[i] = make(chan []Report, simulationBacklog)
+		wg.Add(1)
+		go func(sim simulation, inbox chan []Report) {
+			defer wg.Done()
+			for reports := range inbox {
+				sim.add(reports)
+			}
+		}(sim, inboxes[i])
+	}
+
+	send := func(reports []Report) {
+		for _, inbox := range inboxes {
+			inbox <- reports
+		}
+	}
+	numReports := 0
+	chunk := make([]Report, 0, reportChunkSize)
+	for it.Next() {
+		chunk = append(chunk, it.Report())
+		if len(chunk) == reportChunkSize {
+			send(chunk)
+			chunk = make([]Report, 0, reportChunkSize)
+		}
+		if numReports++; numReports%progressInterval == 0 {
+			elog.Printf("Read %d reports.", numReports)
+		}
+	}
+	if len(chunk) > 0 {
+		send(chunk)
+	}
+	for _, inbox := range inboxes {
+		close(inbox)
+	}
+	wg.Wait()
+	elog.Printf("Added %d reports to %d simulations.", numReports, len(sims))
+}
+
+// evaluate runs the tasks of all simulations using the runner's pool of
+// workers, and returns their results in a deterministic order.
+func (r *simulationRunner) evaluate(sims []simulation) []result {
+	var tasks []func() []result
+	for _, sim := range sims {
+		tasks = append(tasks, sim.tasks(r.cfg.Thresholds)...)
+	}
+
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		numFinished int
+	)
+	taskResults := make([][]result, len(tasks))
+	indices := make(chan int)
+	for i := 0; i < r.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				taskResults[i] = tasks[i]()
+
+				mu.Lock()
+				numFinished++
+				elog.Printf("Finished %d of %d simulation tasks.", numFinished, len(tasks))
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range tasks {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	var results []result
+	for _, rs := range taskResults {
+		results = append(results, rs...)
+	}
+	return results
+}
+
+// setUtilityCosts determines the utility cost of the given shuffler results
+// that used noisy thresholding by comparing them to their deterministic
+// counterparts.
+func setUtilityCosts(results []result) {
+	type run struct {
+		strategy  string
+		threshold int
+		policy    bool
+	}
+	deterministic := make(map[run]int)
+	for _, r := range results {
+		if r, ok := r.(*shufflerResult); ok && r.Mechanism == "" && r.DropFraction == 0 {
+			deterministic[run{r.Strategy, r.Threshold, r.Policy}] = r.NumForwarded
+		}
+	}
+	for _, r := range results {
+		if r, ok := r.(*shufflerResult); ok {
+			numForwarded := deterministic[run{r.Strategy, r.Threshold, r.Policy}]
+			if numForwarded > 0 {
+				r.UtilityCost = 1 - frac(r.NumForwarded, numForwarded)
+			}
+		}
+	}
+}
+
+// run runs our simulations over the given iterator and returns their results.
+func (r *simulationRunner) run(it *reportIterator) ([]result, error) {
+	sims, err := r.simulations()
+	if err != nil {
+		return nil, err
+	}
+	elog.Printf("Running %d simulations for %d thresholds using %d workers.",
+		len(sims), len(r.cfg.Thresholds), r.workers)
+	r.build(it, sims)
+	results := r.evaluate(sims)
+	setUtilityCosts(results)
+	return results, nil
+}
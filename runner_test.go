@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSimulationRunner(t *testing.T) {
+	other := strings.Replace(testMeasurement, `"country_code":"US"`, `"country_code":"CA"`, 1)
+	dir := writeDataset(t, map[string]string{
+		"a.jsonl": strings.Repeat(testMeasurement+"\n", 3),
+		"b.jsonl": other + "\n",
+	})
+	cfg := &simulationConfig{Workers: 4}
+	if err := cfg.setSweep("3,1,2", "", "all", "both", "both"); err != nil {
+		t.Fatalf("Failed to set sweep: %s", err)
+	}
+
+	results, err := newSimulationRunner(cfg).run(newDataset(dir).Reports())
+	if err != nil {
+		t.Fatalf("Failed to run simulations: %s", err)
+	}
+	numAttrs := len(P3AMeasurement{}.OrderHighEntropyFirst(strategyAll))
+	// One shuffler result per threshold, and per order and threshold, one
+	// STAR result and one result per attribute length.
+	if expected := 3 + 2*3*(1+numAttrs); len(results) != expected {
+		t.Fatalf("Expected %d results but got %d.", expected, len(results))
+	}
+
+	forwarded := make(map[int]int)
+	type run struct {
+		order string
+		k     int
+	}
+	full := make(map[run]int)
+	for _, r := range results {
+		switch r := r.(type) {
+		case *shufflerResult:
+			if r.NumReports != 4 {
+				t.Fatalf("Expected 4 reports but got %d.", r.NumReports)
+			}
+			forwarded[r.Threshold] = r.NumForwarded
+		case *starResult:
+			full[run{r.Order, r.Threshold}] = r.NumFull
+		}
+	}
+	if forwarded[1] != 4 || forwarded[2] != 3 || forwarded[3] != 3 {
+		t.Fatalf("Unexpected number of forwarded reports: %v", forwarded)
+	}
+	for _, order := range []string{"first", "last"} {
+		if full[run{order, 1}] != 4 || full[run{order, 2}] != 3 || full[run{order, 3}] != 3 {
+			t.Fatalf("Unexpected number of full STAR measurements: %v", full)
+		}
+	}
+}
+
+func TestUtilityCosts(t *testing.T) {
+	results := []result{
+		&shufflerResult{Strategy: "All", Threshold: 10, NumForwarded: 100},
+		&shufflerResult{Strategy: "All", Threshold: 10, NumForwarded: 75, Mechanism: noiseLaplace, Epsilon: 1},
+		&shufflerResult{Strategy: "All", Threshold: 10, NumForwarded: 50, Mechanism: noiseLaplace, Epsilon: 0.1},
+		&shufflerResult{Strategy: "All", Threshold: 20, NumForwarded: 0},
+		&shufflerResult{Strategy: "All", Threshold: 20, NumForwarded: 0, Mechanism: noiseLaplace, Epsilon: 1},
+	}
+	setUtilityCosts(results)
+	for i, expected := range []float64{0, 0.25, 0.5, 0, 0} {
+		if cost := results[i].(*shufflerResult).UtilityCost; cost != expected {
+			t.Fatalf("Expected utility cost %.2f for result %d but got %.2f.", expected, i, cost)
+		}
+	}
+}
+
+func TestLearnVersions(t *testing.T) {
+	older := strings.Replace(testMeasurement, `"version":"1.36.46"`, `"version":"1.35.1"`, 1)
+	dir := writeDataset(t, map[string]string{
+		"a.jsonl": testMeasurement + "\n",
+		"b.jsonl": older + "\n",
+	})
+	tracker := NewVersionTracker()
+	learnVersions(newDataset(dir).Reports(), tracker)
+
+	// Only the dataset's latest version is recent, and the tracker no longer
+	// learns.
+	for version, expected := range map[string]bool{"1.36.46": true, "1.35.1": false, "1.37.0": false} {
+		if recent, _ := tracker.IsRecent("nightly", version); recent != expected {
+			t.Fatalf("Expected recency of %s to be %t but got %t.", version, expected, recent)
+		}
+	}
+	if latest, _ := tracker.Latest("nightly"); latest != "1.36.46" {
+		t.Fatalf("Expected latest version 1.36.46 but got %s.", latest)
+	}
+
+	cfg := &simulationConfig{}
+	if err := cfg.setSweep("", "1", "minimal", "first", "shuffler"); err != nil {
+		t.Fatalf("Failed to set sweep: %s", err)
+	}
+	if !newSimulationRunner(cfg).needsVersions() {
+		t.Fatal("Expected runner to need versions for strategy with recent_version.")
+	}
+}
+
+func TestSTARSimulationPolicy(t *testing.T) {
+	other := strings.Replace(testMeasurement, `"country_code":"US"`, `"country_code":"CA"`, 1)
+	dir := writeDataset(t, map[string]string{
+		"a.jsonl": strings.Repeat(testMeasurement+"\n", 3),
+		"b.jsonl": other + "\n",
+	})
+	policy, err := newThresholdPolicy([]*thresholdRuleConfig{
+		{Pattern: "Brave.Foo", Threshold: 5, Strategy: "minimal"},
+	}, strategies)
+	if err != nil {
+		t.Fatalf("Failed to create threshold policy: %s", err)
+	}
+	cfg := &simulationConfig{Policy: policy}
+	if err := cfg.setSweep("2,6", "", "all", "first", "star"); err != nil {
+		t.Fatalf("Failed to set sweep: %s", err)
+	}
+	results, err := newSimulationRunner(cfg).run(newDataset(dir).Reports())
+	if err != nil {
+		t.Fatalf("Failed to run simulations: %s", err)
+	}
+
+	type run struct {
+		k      int
+		policy bool
+	}
+	full := make(map[run]int)
+	for _, r := range results {
+		if r, ok := r.(*starResult); ok {
+			if r.NumMeasurements != 4 {
+				t.Fatalf("Expected 4 measurements but got %d.", r.NumMeasurements)
+			}
+			full[run{r.Threshold, r.Policy}] = r.NumFull
+		}
+	}
+	// The policy raises the threshold of Brave.Foo to 5, which its three
+	// measurements don't meet.  Rules cannot lower the threshold, so k=6
+	// applies with and without the policy.
+	expected := map[run]int{{2, false}: 3, {2, true}: 0, {6, false}: 0, {6, true}: 0}
+	if fmt.Sprint(full) != fmt.Sprint(expected) {
+		t.Fatalf("Expected full STAR measurements %v but got %v.", expected, full)
+	}
+}
+
+func TestShufflerSimulationPolicy(t *testing.T) {
+	other := strings.Replace(testMeasurement, `"country_code":"US"`, `"country_code":"CA"`, 1)
+	dir := writeDataset(t, map[string]string{
+		"a.jsonl": strings.Repeat(testMeasurement+"\n", 3),
+		"b.jsonl": other + "\n",
+	})
+	policy, err := newThresholdPolicy([]*thresholdRuleConfig{
+		{Pattern: "Brave.Foo", Threshold: 4},
+	}, strategies)
+	if err != nil {
+		t.Fatalf("Failed to create threshold policy: %s", err)
+	}
+	cfg := &simulationConfig{Policy: policy}
+	if err := cfg.setSweep("1,3,5", "", "all", "first", "shuffler"); err != nil {
+		t.Fatalf("Failed to set sweep: %s", err)
+	}
+	results, err := newSimulationRunner(cfg).run(newDataset(dir).Reports())
+	if err != nil {
+		t.Fatalf("Failed to run simulations: %s", err)
+	}
+
+	type run struct {
+		k      int
+		policy bool
+	}
+	forwarded := make(map[run]int)
+	for _, r := range results {
+		if r, ok := r.(*shufflerResult); ok {
+			if r.NumReports != 4 {
+				t.Fatalf("Expected 4 reports but got %d.", r.NumReports)
+			}
+			forwarded[run{r.Threshold, r.Policy}] = r.NumForwarded
+		}
+	}
+	// The policy raises the threshold of Brave.Foo to 4, which neither of its
+	// crowds (of three and one measurements) meets.
+	expected := map[run]int{
+		{1, false}: 4, {1, true}: 0,
+		{3, false}: 3, {3, true}: 0,
+		{5, false}: 0, {5, true}: 0,
+	}
+	if fmt.Sprint(forwarded) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v forwarded reports but got %v.", expected, forwarded)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+// This file implements a sink that uploads every chunk as an object to an
+// S3-compatible object store, e.g. AWS S3 or MinIO.  Objects are uploaded via
+// path-style PUT requests to <endpoint>/<bucket>/<prefix><batch_id>/<index>,
+// so retries overwrite the same object.  Requests are authenticated using
+// AWS Signature Version 4, as implemented by the AWS SDK's signer.  We don't
+// use the SDK's S3 client, which would add a large dependency for a single
+// PUT request.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+const (
+	s3Service = "s3"
+)
+
+// s3Sink uploads chunks to an S3-compatible object store.
+type s3Sink struct {
+	name        string
+	endpoint    string
+	region      string
+	bucket      string
+	prefix      string
+	creds       *awsCredentials
+	contentType string
+	client      *http.Client
+	signer      *batchSigner
+	now         func() time.Time
+}
+
+// newS3Sink returns a new S3 sink that uploads chunks to the given bucket,
+// encoded using the given content type, via the given client.  Requests are
+// signed with the given credentials, including their session token, if any.
+func newS3Sink(endpoint, region, bucket, prefix string, creds *awsCredentials, contentType string, client *http.Client) *s3Sink {
+	return &s3Sink{
+		name:        sinkS3,
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		region:      region,
+		bucket:      bucket,
+		prefix:      prefix,
+		creds:       creds,
+		contentType: contentType,
+		client:      client,
+		now:         time.Now,
+	}
+}
+
+func (s *s3Sink) Name() string {
+	return s.name
+}
+
+func (s *s3Sink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// objectKey returns the key of the object that holds the given chunk.
+func (s *s3Sink) objectKey(chunk *Batch) string {
+	ext := "json"
+	if s.contentType == contentTypeCBOR {
+		ext = "cbor"
+	}
+	return fmt.Sprintf("%s%s/%d.%s", s.prefix, chunk.ID, chunk.ChunkIndex, ext)
+}
+
+// Send uploads the given chunk.  If we have a signer, the chunk's signature
+// is stored in the object's metadata.
+func (s *s3Sink) Send(chunk *Batch) error {
+	body, err := chunk.Marshal(s.contentType)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %w", err)
+	}
+	u := fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, s.objectKey(chunk))
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", s.contentType)
+	req.Header.Set("X-Amz-Meta-Chunk-Count", fmt.Sprint(chunk.ChunkCount))
+	if s.signer != nil {
+		req.Header.Set("X-Amz-Meta-Batch-Signature", base64.StdEncoding.EncodeToString(s.signer.sign(body)))
+		req.Header.Set("X-Amz-Meta-Batch-Key", base64.StdEncoding.EncodeToString(s.signer.pub))
+	}
+	if err := s.sign(req, body); err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload batch: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxAckBytes))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	// Drain the rest of the body, so the underlying connection can be reused.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received HTTP status code %d from object store: %q", resp.StatusCode, truncate(respBody))
+	}
+	return nil
+}
+
+// sign signs the given request, whose payload is the given body.  S3 expects
+// the payload's hash in a header of its own, and object keys that are only
+// escaped once.
+func (s *s3Sink) sign(req *http.Request, body []byte) error {
+	creds, err := s.creds.provider().Retrieve(req.Context())
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	signer := v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	return signer.SignHTTP(req.Context(), creds, req, hex.EncodeToString(payloadHash[:]), s3Service, s.region, s.now())
+}
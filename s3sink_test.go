@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// verifyV4 returns true if the given request that our stand-in for an object
+// store received is signed with the given credentials.  We re-sign a copy of
+// the request that only has the headers that the client signed, and compare
+// the signatures.
+func verifyV4(r *http.Request, body []byte, creds aws.Credentials) bool {
+	auth := r.Header.Get("Authorization")
+	i := strings.Index(auth, "SignedHeaders=")
+	if i < 0 {
+		return false
+	}
+	signedHeaders := strings.Split(strings.SplitN(auth[i+len("SignedHeaders="):], ",", 2)[0], ";")
+
+	signed := httptest.NewRequest(r.Method, "http://"+r.Host+r.URL.Path, nil)
+	signed.Host = r.Host
+	signed.ContentLength = r.ContentLength
+	for _, name := range signedHeaders {
+		if name != "host" && name != "content-length" {
+			signed.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	now, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	payloadHash := sha256.Sum256(body)
+	signer := v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	if err := signer.SignHTTP(context.Background(), creds, signed, hex.EncodeToString(payloadHash[:]),
+		s3Service, "us-east-1", now); err != nil {
+		return false
+	}
+	return auth == signed.Header.Get("Authorization") &&
+		r.Header.Get("X-Amz-Content-Sha256") == hex.EncodeToString(payloadHash[:])
+}
+
+func TestS3Sink(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		objects = make(map[string][]byte)
+	)
+	// Our stand-in for an S3-compatible object store only accepts requests
+	// that are signed with our temporary credentials, including the session
+	// token.
+	creds := aws.Credentials{AccessKeyID: "foo", SecretAccessKey: "bar", SessionToken: "token"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.Header.Get("X-Amz-Security-Token") != creds.SessionToken ||
+			!strings.Contains(r.Header.Get("Authorization"), "x-amz-security-token") ||
+			!verifyV4(r, body, creds) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		objects[r.URL.Path] = body
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	signer, _ := newBatchSigner()
+	cfg := &sinkConfig{
+		Type:            sinkS3,
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "shuffled",
+		Prefix:          "p3a/",
+		AccessKeyID:     "foo",
+		SecretAccessKey: "bar",
+		SessionToken:    "token",
+	}
+	sink, err := newSink(cfg, contentTypeCBOR, signer, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create sink: %s", err)
+	}
+	chunk := &Batch{ID: "foo", ChunkIndex: 1, ChunkCount: 2, Reports: []Report{P3AMeasurement{}}}
+	if err := sink.Send(chunk); err != nil {
+		t.Fatalf("Failed to send chunk: %s", err)
+	}
+	body, exists := objects["/shuffled/p3a/foo/1.cbor"]
+	if !exists {
+		t.Fatalf("Object store has unexpected objects: %v", objects)
+	}
+	if m, err := unmarshalBatchMessage(contentTypeCBOR, body); err != nil || m.ChunkIndex != 1 {
+		t.Fatalf("Object store has unexpected chunk: %v", err)
+	}
+
+	// Requests with the wrong credentials must fail, and so must requests
+	// that lack the session token.
+	for _, update := range []func(){
+		func() { cfg.SecretAccessKey = "baz" },
+		func() { cfg.SecretAccessKey, cfg.SessionToken = "bar", "" },
+	} {
+		update()
+		if sink, err = newSink(cfg, contentTypeCBOR, signer, http.DefaultClient); err != nil {
+			t.Fatalf("Failed to create sink: %s", err)
+		}
+		if err := sink.Send(chunk); err == nil {
+			t.Fatal("Object store accepted chunk with bad signature.")
+		}
+	}
+}
@@ -6,15 +6,19 @@ import (
 	"time"
 )
 
+const (
+	defaultInboxSize = 1024
+)
+
 // CrowdID represents the crowd ID of a given report.
 type CrowdID string
 
 // Report defines an interface that represents a report in our briefcase.  A
-// report must be able to return its crowd ID and payload; and it must be
-// marshal-able.
+// report must be able to return its crowd ID (keyed with the given key) and
+// payload; and it must be marshal-able.
 type Report interface {
-	CrowdID(method int) CrowdID
-	Payload() []byte
+	CrowdID(strategy CrowdIDStrategy, key crowdIDKey) CrowdID
+	Payload() ([]byte, error)
 }
 
 // Shuffler implements four tasks: anonymization, shuffling, thresholding, and
@@ -22,31 +26,187 @@ type Report interface {
 type Shuffler struct {
 	sync.WaitGroup
 	inbox              chan []Report
-	outbox             chan []Report
+	inboxSize          int
+	outbox             chan *Batch
 	done               chan bool
+	drain              chan time.Duration
 	anonymityThreshold int
 	BatchPeriod        time.Duration
 	briefcase          *Briefcase
+	batchStart         time.Time
+	snapshots          *snapshotter
+	snapshotInterval   time.Duration
+	nested             bool
+	policy             *thresholdPolicy
+	noise              *noisyThreshold
+	versions           *VersionTracker
+}
+
+// ShufflerOption configures optional aspects of a shuffler.
+type ShufflerOption func(*Shuffler)
+
+// WithInboxSize sets the number of report sets that the shuffler's inbox can
+// buffer before senders block.
+func WithInboxSize(size int) ShufflerOption {
+	return func(s *Shuffler) {
+		s.inboxSize = size
+	}
+}
+
+// WithSnapshots makes the shuffler write an encrypted snapshot of its
+// briefcase at the given interval, and restore the briefcase from the latest
+// snapshot when the shuffler is created.
+func WithSnapshots(snapshots *snapshotter, interval time.Duration) ShufflerOption {
+	return func(s *Shuffler) {
+		s.snapshots = snapshots
+		s.snapshotInterval = interval
+	}
+}
+
+// WithNestedAggregation makes the shuffler redact the attributes of P3A
+// measurements that don't meet our anonymity threshold (see
+// Briefcase.RedactFewerThan) instead of dumping entire crowds.
+func WithNestedAggregation() ShufflerOption {
+	return func(s *Shuffler) {
+		s.nested = true
+	}
+}
+
+// WithThresholdPolicy makes the shuffler use the given policy's anonymity
+// thresholds and crowd ID strategies for the metrics that the policy covers.
+func WithThresholdPolicy(policy *thresholdPolicy) ShufflerOption {
+	return func(s *Shuffler) {
+		s.policy = policy
+	}
+}
+
+// WithNoisyThreshold makes the shuffler add noise to the size of every crowd
+// before comparing it to our anonymity threshold (see Briefcase.DumpFewerThan).
+func WithNoisyThreshold(noise *noisyThreshold) ShufflerOption {
+	return func(s *Shuffler) {
+		s.noise = noise
+	}
+}
+
+// WithVersionTracker makes the shuffler apply the given tracker's staged
+// versions (see VersionTracker.StagePin) whenever a batch period ends.
+func WithVersionTracker(t *VersionTracker) ShufflerOption {
+	return func(s *Shuffler) {
+		s.versions = t
+	}
 }
 
 // NewShuffler returns a new shuffler that batches reports until the given
 // batch period.
-func NewShuffler(batchPeriod time.Duration, anonymityThreshold int, crowdIDMethod int) *Shuffler {
-	return &Shuffler{
-		inbox:              make(chan []Report),
-		outbox:             make(chan []Report),
+func NewShuffler(batchPeriod time.Duration, anonymityThreshold int, strategy CrowdIDStrategy, opts ...ShufflerOption) *Shuffler {
+	s := &Shuffler{
+		inboxSize:          defaultInboxSize,
+		outbox:             make(chan *Batch),
 		done:               make(chan bool),
+		drain:              make(chan time.Duration),
 		anonymityThreshold: anonymityThreshold,
 		BatchPeriod:        batchPeriod,
-		briefcase:          NewBriefcase(crowdIDMethod),
+		briefcase:          NewBriefcase(strategy),
+		batchStart:         time.Now(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.inbox = make(chan []Report, s.inboxSize)
+	s.briefcase.policy = s.policy
+	s.briefcase.noise = s.noise
+	return s
+}
+
+// openSnapshots obtains our snapshot key and counter.  Both may only be
+// reachable once the enclave's networking is up, so we keep trying for a
+// while.
+func (s *Shuffler) openSnapshots() error {
+	deadline := time.Now().Add(snapshotOpenTimeout)
+	backoff := time.Second
+	for {
+		err := s.snapshots.open()
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		elog.Printf("Failed to open snapshots: %s.  Retrying in %s.", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// restoreSnapshot restores the briefcase and the start of the current batch
+// period from the latest snapshot.  Snapshots that are stale, fail our
+// integrity checks, or aren't the latest snapshot are refused, and we then
+// start a new batch period, so that they can never be restored.  If we cannot
+// open our snapshots, snapshots are disabled.
+func (s *Shuffler) restoreSnapshot() {
+	if err := s.openSnapshots(); err != nil {
+		elog.Printf("Disabling snapshots: %s", err)
+		s.snapshots = nil
+		return
+	}
+	state, err := s.snapshots.read()
+	if err != nil {
+		if err != errNoSnapshot {
+			elog.Printf("Refusing to restore snapshot: %s", err)
+		}
+		s.advanceSnapshots()
+		return
+	}
+	s.briefcase.Add(state.Reports)
+	s.batchStart = state.BatchStart
+	elog.Printf("Restored %d reports from snapshot of batch period that started at %s.",
+		len(state.Reports), state.BatchStart)
+}
+
+// advanceSnapshots moves our snapshots on to the next batch period, so that
+// the snapshots of the batch period that just ended can never be restored.
+func (s *Shuffler) advanceSnapshots() {
+	if s.snapshots == nil {
+		return
+	}
+	if err := s.snapshots.nextBatch(); err != nil {
+		elog.Printf("Failed to advance snapshot counter: %s", err)
+	}
+}
+
+// snapshotsBehind returns true if our snapshot counter still refers to a
+// previous batch period.  Until we managed to advance the counter, we must
+// not forward the previous batch period's reports, because a snapshot that
+// contains them could still be restored.
+func (s *Shuffler) snapshotsBehind() bool {
+	return s.snapshots != nil && s.snapshots.behind()
+}
+
+// writeSnapshot writes a snapshot of the briefcase, if snapshots are enabled.
+func (s *Shuffler) writeSnapshot() {
+	if s.snapshots == nil {
+		return
+	}
+	state := &snapshotState{
+		BatchStart: s.batchStart,
+		Reports:    s.briefcase.AllReports(),
+	}
+	if err := s.snapshots.write(state); err != nil {
+		elog.Printf("Failed to write snapshot: %s", err)
 	}
 }
 
 // String returns a summary of the shuffler's internal state.
 func (s *Shuffler) String() string {
-	return fmt.Sprintf("Briefcase contains %d crowd IDs; %d reports.",
+	return fmt.Sprintf("Briefcase contains %d crowd IDs; %d reports; %d report sets queued in inbox.",
 		s.briefcase.NumCrowdIDs(),
-		s.briefcase.NumReports())
+		s.briefcase.NumReports(),
+		s.QueueDepth())
+}
+
+// QueueDepth returns the number of report sets that are waiting in the
+// shuffler's inbox.
+func (s *Shuffler) QueueDepth() int {
+	return len(s.inbox)
 }
 
 // Start starts the shuffler.
@@ -54,40 +214,159 @@ func (s *Shuffler) Start() {
 	s.Add(1)
 	go func() {
 		defer s.Done()
-		ticker := time.NewTicker(s.BatchPeriod)
+		if s.snapshots != nil {
+			s.restoreSnapshot()
+		}
+		// A restored batch period may already be partially over.
+		batchTimer := time.NewTimer(time.Until(s.batchStart.Add(s.BatchPeriod)))
+		defer batchTimer.Stop()
+		var snapshotTicks <-chan time.Time
+		if s.snapshots != nil {
+			snapshotTicker := time.NewTicker(s.snapshotInterval)
+			defer snapshotTicker.Stop()
+			snapshotTicks = snapshotTicker.C
+		}
+
+		// Batches that are waiting for the forwarder to pick them up.  We
+		// don't block on the outbox, so that a slow forwarder cannot stall the
+		// ingestion of new reports.
+		var pending []*Batch
 		for {
+			var outbox chan *Batch
+			var next *Batch
+			if len(pending) > 0 && !s.snapshotsBehind() {
+				outbox, next = s.outbox, pending[0]
+			}
+
 			select {
 			case <-s.done:
+				s.drainInbox()
+				s.writeSnapshot()
 				s.briefcase.Empty()
 				return
+			case timeout := <-s.drain:
+				s.drainInbox()
+				batch, err := s.endBatchPeriod()
+				if err != nil {
+					elog.Printf("Failed to end batch period while draining: %s", err)
+				} else if batch != nil && len(batch.Reports) > 0 {
+					pending = append(pending, batch)
+				}
+				s.advanceSnapshots()
+				if s.snapshotsBehind() {
+					elog.Printf("Withholding %d batches because we cannot advance our snapshot counter.", len(pending))
+				} else {
+					s.flush(pending, timeout)
+				}
+				s.writeSnapshot()
+				return
 			case rs := <-s.inbox:
 				s.briefcase.Add(rs)
-			case <-ticker.C:
-				if err := s.endBatchPeriod(); err != nil {
+			case outbox <- next:
+				elog.Printf("Sent %d reports to outbox.", len(next.Reports))
+				pending = pending[1:]
+			case <-batchTimer.C:
+				batch, err := s.endBatchPeriod()
+				if err != nil {
 					elog.Printf("Failed to end batch period because: %s", err)
+				} else if batch != nil && len(batch.Reports) > 0 {
+					pending = append(pending, batch)
 				}
+				s.advanceSnapshots()
+				if s.versions != nil {
+					s.versions.ApplyStagedPin()
+				}
+				s.batchStart = time.Now()
+				batchTimer.Reset(s.BatchPeriod)
+				s.writeSnapshot()
+			case <-snapshotTicks:
+				s.writeSnapshot()
 			}
 		}
 	}()
 }
 
+// drainInbox adds all reports that are waiting in the inbox to the briefcase.
+func (s *Shuffler) drainInbox() {
+	for {
+		select {
+		case rs := <-s.inbox:
+			s.briefcase.Add(rs)
+		default:
+			return
+		}
+	}
+}
+
 // endBatchPeriod does the housekeeping that's necessary once our batch period
-// ends, i.e. it enforces our k-anonymity guarantees on all reports, shuffles
+// ends, i.e. it enforces our k-anonymity guarantees on all reports (by either
+// dumping or redacting reports, depending on our aggregation mode), shuffles
 // the remaining reports, and empties our briefcase.  Whatever reports are left
-// are then sent to the shuffler's outbox.
-func (s *Shuffler) endBatchPeriod() error {
+// are returned as a batch, so they can be sent to the shuffler's outbox.
+func (s *Shuffler) endBatchPeriod() (*Batch, error) {
 	if s.briefcase.NumCrowdIDs() == 0 {
-		return nil
+		return nil, nil
+	}
+	defer metrics.batchDuration.ObserveSince(time.Now())
+	if s.nested {
+		s.briefcase.RedactFewerThan(s.anonymityThreshold)
+	} else {
+		s.briefcase.DumpFewerThan(s.anonymityThreshold)
 	}
-	s.briefcase.DumpFewerThan(s.anonymityThreshold)
 
 	reports, err := s.briefcase.ShuffleAndEmpty()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	id, err := newBatchID()
+	if err != nil {
+		return nil, err
+	}
+	aggregation := aggregationCrowd
+	if s.nested {
+		aggregation = aggregationNested
 	}
-	s.outbox <- reports
-	elog.Printf("Sent %d reports to outbox.", len(reports))
-	return nil
+	return &Batch{
+		ID:            id,
+		PeriodStart:   s.batchStart,
+		PeriodEnd:     time.Now(),
+		Threshold:     s.anonymityThreshold,
+		CrowdIDMethod: s.briefcase.strategy.Name(),
+		Aggregation:   aggregation,
+		Policy:        s.policy.batchRules(s.anonymityThreshold, s.briefcase.strategy),
+		Noise:         s.noise.batchNoise(s.anonymityThreshold),
+		Reports:       reports,
+	}, nil
+}
+
+// flush hands the given batches over to the forwarder.  Batches that the
+// forwarder doesn't pick up within the given timeout are lost.
+func (s *Shuffler) flush(batches []*Batch, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for i, batch := range batches {
+		select {
+		case s.outbox <- batch:
+			elog.Printf("Sent %d reports to outbox.", len(batch.Reports))
+		case <-timer.C:
+			numLost := 0
+			for _, batch := range batches[i:] {
+				numLost += len(batch.Reports)
+			}
+			elog.Printf("Forwarder didn't pick up remaining batches.  Lost %d reports.", numLost)
+			return
+		}
+	}
+}
+
+// Drain stops the shuffler gracefully: it ends the current batch period early
+// and hands all reports that meet our anonymity threshold over to the
+// forwarder, which must still be running.  Reports that don't meet our
+// anonymity threshold are discarded, as usual.
+func (s *Shuffler) Drain(timeout time.Duration) {
+	s.drain <- timeout
+	s.Wait()
 }
 
 // Stop stops the shuffler.
@@ -15,23 +15,100 @@ func BenchmarkRealWorldData(b *testing.B) {
 		return
 	}
 
-	s := NewShuffler(time.Hour, anonymityThreshold, defaultCrowdIDMethod)
+	s := NewShuffler(time.Hour, anonymityThreshold, defaultCrowdIDStrategy)
 	s.Start()
 
 	for n := 0; n < b.N; n++ {
-		reports, err := parseReportsFromDir(p3aDataDir)
-		if err != nil {
+		it := newDataset(p3aDataDir).Reports()
+		reports := it.All()
+		if err := it.Err(); err != nil {
 			b.Fatalf("Failed to load P3A reports from directory: %s", err)
 		}
 		s.inbox <- reports
 
-		go func() {
-			for {
-				<-s.outbox
-			}
-		}()
-		if err := s.endBatchPeriod(); err != nil {
+		if _, err := s.endBatchPeriod(); err != nil {
 			log.Fatal(err)
 		}
 	}
 }
+
+func TestSlowForwarder(t *testing.T) {
+	s := NewShuffler(time.Millisecond, 1, defaultCrowdIDStrategy, WithInboxSize(1))
+	s.Start()
+	defer s.Stop()
+
+	// Nobody is reading from the shuffler's outbox but the shuffler must keep
+	// accepting reports across several batch periods.
+	for i := 0; i < 10; i++ {
+		select {
+		case s.inbox <- []Report{&DummyReport{crowdID: CrowdID("foo")}}:
+		case <-time.After(time.Second):
+			t.Fatal("Shuffler stopped accepting reports.")
+		}
+		time.Sleep(time.Millisecond * 2)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := NewShuffler(time.Hour, 2, defaultCrowdIDStrategy)
+	s.Start()
+	s.inbox <- []Report{
+		&DummyReport{crowdID: CrowdID("foo")},
+		&DummyReport{crowdID: CrowdID("foo")},
+		&DummyReport{crowdID: CrowdID("bar")},
+	}
+
+	received := make(chan []Report)
+	go func() {
+		received <- (<-s.outbox).Reports
+	}()
+	s.Drain(time.Second)
+
+	// Only the two reports that meet our threshold must be forwarded.
+	select {
+	case reports := <-received:
+		if len(reports) != 2 {
+			t.Fatalf("Expected 2 drained reports but got %d.", len(reports))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shuffler didn't hand over reports while draining.")
+	}
+}
+
+func TestBatchHeader(t *testing.T) {
+	policy, err := newThresholdPolicy([]*thresholdRuleConfig{
+		{Pattern: "Brave.Core.*", Threshold: 20, Strategy: "minimal"},
+		{Pattern: "Brave.Welcome.*", Threshold: 5},
+	}, strategies)
+	if err != nil {
+		t.Fatalf("Failed to create threshold policy: %s", err)
+	}
+	noise, err := newNoisyThreshold(&noiseConfig{Mechanism: noiseLaplace, Epsilon: 1})
+	if err != nil {
+		t.Fatalf("Failed to create noisy threshold: %s", err)
+	}
+	s := NewShuffler(time.Hour, 10, strategyAll, WithNestedAggregation(),
+		WithThresholdPolicy(policy), WithNoisyThreshold(noise))
+	s.briefcase.Add([]Report{&DummyReport{crowdID: CrowdID("foo")}})
+
+	batch, err := s.endBatchPeriod()
+	if err != nil {
+		t.Fatalf("Failed to end batch period: %s", err)
+	}
+	if batch.Threshold != 10 || batch.CrowdIDMethod != strategyAll.Name() || batch.Aggregation != aggregationNested {
+		t.Fatalf("Unexpected batch header: %+v", batch)
+	}
+	// The header must contain the thresholds and strategies that we used, so
+	// the rule that would lower our threshold shows our threshold.
+	expected := []batchRule{
+		{Pattern: "Brave.Core.*", Threshold: 20, CrowdIDMethod: strategyMinimal.Name()},
+		{Pattern: "Brave.Welcome.*", Threshold: 10, CrowdIDMethod: strategyAll.Name()},
+	}
+	if len(batch.Policy) != len(expected) || batch.Policy[0] != expected[0] || batch.Policy[1] != expected[1] {
+		t.Fatalf("Expected policy %+v but got %+v.", expected, batch.Policy)
+	}
+	epsilon, delta := noise.budget(10)
+	if batch.Noise == nil || batch.Noise.Mechanism != noiseLaplace || batch.Noise.Epsilon != epsilon || batch.Noise.Delta != delta {
+		t.Fatalf("Expected Laplace noise (%g, %g) but got %+v.", epsilon, delta, batch.Noise)
+	}
+}
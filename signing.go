@@ -0,0 +1,202 @@
+package main
+
+// This file implements batch signing.  Inside the enclave, we generate an
+// Ed25519 key pair whose private key never leaves the enclave, and the
+// forwarder signs every batch with it.  Our attestation endpoint binds the
+// public key to the enclave image: it returns the public key alongside a Nitro
+// attestation document whose user_data field contains the key's SHA-256 hash.
+// nitriding's own attestation endpoint already uses user_data for the hash of
+// its HTTPS certificate, which is why we need a separate endpoint.  See the
+// batchverify package for how the analyzer verifies batches.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/brave-experiments/p3a-shuffler/batchverify"
+	"github.com/hf/nsm"
+	"github.com/hf/nsm/request"
+)
+
+const (
+	// attestationNonceLen is the length of the nonce that clients must send
+	// to our attestation endpoint, in bytes.  It matches nitriding's.
+	attestationNonceLen = 20
+)
+
+var errNoAttestation = errors.New("NSM device did not return an attestation")
+
+// attester returns a Nitro attestation document that contains the given nonce
+// and user data.
+type attester func(nonce, userData []byte) ([]byte, error)
+
+// batchSigner represents the Ed25519 key pair that the forwarder signs batches
+// with.
+type batchSigner struct {
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+}
+
+// newBatchSigner generates and returns a new batch signer.
+func newBatchSigner() (*batchSigner, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &batchSigner{priv: priv, pub: pub}, nil
+}
+
+// sign returns the signature over the given batch body.
+func (s *batchSigner) sign(body []byte) []byte {
+	return ed25519.Sign(s.priv, batchverify.SigningInput(body))
+}
+
+// setHeaders adds the signature over the given batch body and our public key
+// to the given request.  A nil signer adds nothing.
+func (s *batchSigner) setHeaders(req *http.Request, body []byte) {
+	if s == nil {
+		return
+	}
+	req.Header.Set(batchverify.SignatureHeader, base64.StdEncoding.EncodeToString(s.sign(body)))
+	req.Header.Set(batchverify.KeyHeader, base64.StdEncoding.EncodeToString(s.pub))
+}
+
+// nsmAttest asks the Nitro hypervisor for an attestation document.
+func nsmAttest(nonce, userData []byte) ([]byte, error) {
+	return nsmAttestation(nonce, userData, []byte{})
+}
+
+// nsmAttestation asks the Nitro hypervisor for an attestation document that
+// contains the given nonce, user data, and public key.
+func nsmAttestation(nonce, userData, publicKey []byte) ([]byte, error) {
+	s, err := nsm.OpenDefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	res, err := s.Send(&request.Attestation{
+		Nonce:     nonce,
+		UserData:  userData,
+		PublicKey: publicKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Attestation == nil || res.Attestation.Document == nil {
+		return nil, errNoAttestation
+	}
+	return res.Attestation.Document, nil
+}
+
+// createBatchAttestationHandler creates a handler that expects a hex-encoded
+// nonce in the "nonce" URL query parameter, and returns the JSON-encoded
+// public key of the given signer alongside an attestation document that
+// contains the nonce and the hash of the public key.
+func createBatchAttestationHandler(s *batchSigner, attest attester) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := hex.DecodeString(r.URL.Query().Get("nonce"))
+		if err != nil || len(nonce) != attestationNonceLen {
+			http.Error(w, "nonce must be a hex-encoded 20-byte string", http.StatusBadRequest)
+			return
+		}
+		doc, err := attest(nonce, batchverify.KeyHash(s.pub))
+		if err != nil {
+			elog.Printf("Failed to obtain attestation document: %s", err)
+			http.Error(w, "failed to obtain attestation document", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		resp := &batchverify.AttestationResponse{PublicKey: s.pub, Attestation: doc}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			elog.Printf("Failed to send attestation document: %s", err)
+		}
+	}
+}
+
+// verifyBatchCommand implements the verify-batch subcommand, which verifies a
+// batch that the analyzer received, given the batch's signature and the
+// response of our attestation endpoint.
+func verifyBatchCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("verify-batch", flag.ContinueOnError)
+	batchFile := fs.String("batch", "", "File containing the body of the batch.")
+	sigB64 := fs.String("signature", "", "Base64-encoded signature of the batch, i.e. the value of its "+batchverify.SignatureHeader+" header.")
+	attestationFile := fs.String("attestation", "", "File containing the JSON-encoded response of the shuffler's "+batchAttestationEndpoint+" endpoint.")
+	rootFile := fs.String("root-cert", "", "PEM-encoded root certificate of AWS's Nitro Enclaves PKI.")
+	nonceHex := fs.String("nonce", "", "Hex-encoded nonce that the attestation document must contain, i.e. the nonce that was sent to the "+batchAttestationEndpoint+" endpoint.")
+	pcrHex := map[uint]*string{
+		0: fs.String("pcr0", "", "Hex-encoded PCR0 that the attestation document must contain, i.e. the enclave image's hash."),
+		1: fs.String("pcr1", "", "Optional hex-encoded PCR1 that the attestation document must contain, i.e. the hash of the kernel and bootstrap process."),
+		2: fs.String("pcr2", "", "Optional hex-encoded PCR2 that the attestation document must contain, i.e. the hash of the application."),
+	}
+	contentType := fs.String("content-type", contentTypeJSON, "Content type of the batch.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *batchFile == "" || *sigB64 == "" || *attestationFile == "" || *rootFile == "" || *nonceHex == "" || *pcrHex[0] == "" {
+		return errors.New("must provide -batch, -signature, -attestation, -root-cert, -nonce, and -pcr0")
+	}
+
+	body, err := os.ReadFile(*batchFile)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(*sigB64)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+	nonce, err := hex.DecodeString(*nonceHex)
+	if err != nil {
+		return fmt.Errorf("failed to decode nonce: %w", err)
+	}
+	pcrs := make(map[uint][]byte)
+	for i, value := range pcrHex {
+		if *value == "" {
+			continue
+		}
+		if pcrs[i], err = hex.DecodeString(*value); err != nil {
+			return fmt.Errorf("failed to decode PCR%d: %w", i, err)
+		}
+	}
+	rawResp, err := os.ReadFile(*attestationFile)
+	if err != nil {
+		return err
+	}
+	var resp batchverify.AttestationResponse
+	if err := json.Unmarshal(rawResp, &resp); err != nil {
+		return fmt.Errorf("failed to decode attestation response: %w", err)
+	}
+	rootPEM, err := os.ReadFile(*rootFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootPEM) {
+		return errors.New("found no root certificate in " + *rootFile)
+	}
+
+	doc, err := batchverify.Verify(body, sig, &resp, roots, pcrs, nonce)
+	if err != nil {
+		return err
+	}
+	m, err := unmarshalBatchMessage(*contentType, body)
+	if err != nil {
+		return fmt.Errorf("failed to decode batch: %w", err)
+	}
+	fmt.Fprintf(stdout, "Chunk %d/%d of batch %s with %d payloads (%s to %s, threshold %d) was signed by enclave %s at %s.\n",
+		m.ChunkIndex+1, m.ChunkCount, m.BatchID, len(m.Payloads), m.PeriodStart.Format(time.RFC3339), m.PeriodEnd.Format(time.RFC3339),
+		m.Threshold, doc.ModuleID, doc.Time().UTC().Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brave-experiments/p3a-shuffler/batchverify"
+)
+
+func TestBatchAttestationHandler(t *testing.T) {
+	s, err := newBatchSigner()
+	if err != nil {
+		t.Fatalf("Failed to create batch signer: %s", err)
+	}
+	var gotNonce, gotUserData []byte
+	handler := createBatchAttestationHandler(s, func(nonce, userData []byte) ([]byte, error) {
+		gotNonce, gotUserData = nonce, userData
+		return []byte("document"), nil
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, batchAttestationEndpoint+"?nonce=foo", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected HTTP %d for bad nonce but got %d.", http.StatusBadRequest, w.Code)
+	}
+
+	nonce := strings.Repeat("ab", attestationNonceLen)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, batchAttestationEndpoint+"?nonce="+nonce, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP %d but got %d.", http.StatusOK, w.Code)
+	}
+	if !bytes.Equal(gotNonce, bytes.Repeat([]byte{0xab}, attestationNonceLen)) {
+		t.Fatalf("Attester received unexpected nonce %x.", gotNonce)
+	}
+	if !bytes.Equal(gotUserData, batchverify.KeyHash(s.pub)) {
+		t.Fatal("Attester didn't receive the hash of the signing key.")
+	}
+	var resp batchverify.AttestationResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	if !bytes.Equal(resp.PublicKey, s.pub) || string(resp.Attestation) != "document" {
+		t.Fatalf("Unexpected attestation response: %+v", resp)
+	}
+}
+
+func TestSignedForwarding(t *testing.T) {
+	s, err := newBatchSigner()
+	if err != nil {
+		t.Fatalf("Failed to create batch signer: %s", err)
+	}
+	verified := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sig, _ := base64.StdEncoding.DecodeString(r.Header.Get(batchverify.SignatureHeader))
+		key, _ := base64.StdEncoding.DecodeString(r.Header.Get(batchverify.KeyHeader))
+		verified <- batchverify.VerifySignature(key, body, sig)
+		ackChunk(w, r.Header.Get("Content-Type"), body)
+	}))
+	defer srv.Close()
+
+	sink := newHTTPSink(srv.URL, contentTypeJSON, http.DefaultClient)
+	sink.signer = s
+	if err := sink.Send(&Batch{Reports: []Report{P3AMeasurement{}}}); err != nil {
+		t.Fatalf("Failed to post batch: %s", err)
+	}
+	if err := <-verified; err != nil {
+		t.Fatalf("Failed to verify forwarded batch: %s", err)
+	}
+}
+
+func TestVerifyBatchCommandFlags(t *testing.T) {
+	args := []string{"-batch", "batch.json", "-signature", "sig", "-attestation", "attestation.json", "-root-cert", "root.pem"}
+	for _, extra := range [][]string{
+		nil,
+		{"-pcr0", "00"},
+		{"-nonce", "00"},
+	} {
+		err := verifyBatchCommand(append(append([]string{}, args...), extra...), io.Discard)
+		if err == nil || !strings.HasPrefix(err.Error(), "must provide") {
+			t.Fatalf("Expected missing flag error for %v but got: %v", extra, err)
+		}
+	}
+}
@@ -1,75 +1,227 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"math"
-	"os"
-	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
 )
 
+const (
+	// maxThresholds is the maximum number of thresholds that a threshold
+	// specification may expand to.
+	maxThresholds = 10000
+)
+
 var (
-	re = regexp.MustCompile(`'({[^']+})'`)
+	// defaultThresholds contains the k-anonymity thresholds that we simulate
+	// unless we're told otherwise.
+	defaultThresholds = []int{5, 10, 25, 50, 75, 100}
+	// orderNames maps the names of our STAR attribute orders to the orders.
+	orderNames = map[string][]int{
+		"first": {orderHighEntropyFirst},
+		"last":  {orderHighEntropyLast},
+		"both":  {orderHighEntropyFirst, orderHighEntropyLast},
+	}
 )
 
 type simulationConfig struct {
-	DataDir            string
-	AnonymityThreshold int
-	CrowdIDMethod      int
-	Order              int
-	AttributeCSV       bool
-	Entropy            bool
+	DataDir         string
+	AttributeCSV    bool
+	Entropy         bool
+	QuarantineFile  string
+	ParseReportFile string
+	OutputFile      string
+	OutputFormat    string
+	// Workers is the number of simulation tasks that we run concurrently.  If
+	// it's not positive, we use one worker per CPU.
+	Workers int
+	// Registry contains the crowd ID strategies that we can simulate.  If
+	// nil, we can only simulate our built-in strategies.
+	Registry *strategyRegistry
+	// Policy is an optional threshold policy.  If set, we simulate the
+	// shuffler both with and without the policy.
+	Policy *thresholdPolicy
+	// Noise contains the configurations of noisy thresholding that we
+	// simulate in addition to deterministic thresholding.
+	Noise []*noiseConfig
+
+	// The following fields determine the combinations that we simulate.
+	Thresholds  []int
+	Strategies  []CrowdIDStrategy
+	Orders      []int
+	RunShuffler bool
+	RunSTAR     bool
 }
 
-// parseJSONFile reads and parses a P3A measurement file as it can be found in
-// our S3 bucket.  Those files have the following (sanitized) format:
-//
-// <134>2022-01-01T00:00:00Z foo bar[quuz]: "-" "-" 2022-01-01:00:xx:xx
-// POST / HTTP/2 200 '{"channel":"nightly","country_code":"US","metric_name":
-// "...","metric_value":0,"platform":"linux-bc","refcode":"none",
-// "version":"1.36.46","woi":3,"wos":3,"yoi":2022,"yos":2022}'
-func parseJSONFile(filename string) ([]Report, error) {
-	content, err := os.ReadFile(filename)
+// setSweep determines the combinations that we simulate from the given
+// (string-encoded) settings.  Either a list of thresholds or a single
+// threshold may be given; if neither is given, we use our default thresholds.
+func (c *simulationConfig) setSweep(thresholds, threshold, crowdIDs, order, simulation string) error {
+	var err error
+	switch {
+	case thresholds != "" && threshold != "":
+		return fmt.Errorf("cannot use both a single threshold and a list of thresholds")
+	case thresholds != "":
+		c.Thresholds, err = parseThresholds(thresholds)
+	case threshold != "":
+		c.Thresholds, err = parseThresholds(threshold)
+		if err == nil && len(c.Thresholds) != 1 {
+			err = fmt.Errorf("expected a single threshold but got %q", threshold)
+		}
+	default:
+		c.Thresholds = defaultThresholds
+	}
 	if err != nil {
-		return nil, err
+		return err
+	}
+	registry := c.Registry
+	if registry == nil {
+		registry = strategies
+	}
+	if c.Strategies, err = parseStrategies(crowdIDs, registry); err != nil {
+		return err
 	}
+	if c.Orders, err = parseOrders(order); err != nil {
+		return err
+	}
+	c.RunShuffler, c.RunSTAR, err = parseSimulations(simulation)
+	return err
+}
+
+// setNoise determines the configurations of noisy thresholding that we
+// simulate from the given mechanism, comma-separated list of epsilons, delta,
+// and drop fraction.  Without epsilons, we only simulate dropping reports.
+func (c *simulationConfig) setNoise(mechanism, epsilons string, delta, dropFraction float64) error {
+	c.Noise = nil
+	if epsilons == "" {
+		if dropFraction == 0 {
+			return nil
+		}
+		cfg := &noiseConfig{DropFraction: dropFraction}
+		c.Noise = append(c.Noise, cfg)
+		return cfg.validate()
+	}
+	for _, elem := range strings.Split(epsilons, ",") {
+		epsilon, err := strconv.ParseFloat(strings.TrimSpace(elem), 64)
+		if err != nil {
+			return fmt.Errorf("bad epsilon %q", elem)
+		}
+		cfg := &noiseConfig{
+			Mechanism:    mechanism,
+			Epsilon:      epsilon,
+			Delta:        delta,
+			DropFraction: dropFraction,
+		}
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		c.Noise = append(c.Noise, cfg)
+	}
+	return nil
+}
 
-	var ms []Report
-	for _, line := range strings.Split(string(content), "\n") {
-		// This is (probably) the file's trailing newline but we continue, just
-		// in case.
-		if line == "" {
-			continue
+// parseThresholds parses a comma-separated list of k-anonymity thresholds.
+// Each element is either a single threshold (e.g. "10") or an inclusive range
+// with an optional step (e.g. "10-100" or "10-100:10").
+func parseThresholds(spec string) ([]int, error) {
+	var thresholds []int
+	seen := make(map[int]bool)
+	add := func(k int) error {
+		if k < 1 {
+			return fmt.Errorf("threshold must be at least 1 but is %d", k)
 		}
+		if !seen[k] {
+			seen[k] = true
+			thresholds = append(thresholds, k)
+		}
+		if len(thresholds) > maxThresholds {
+			return fmt.Errorf("more than %d thresholds", maxThresholds)
+		}
+		return nil
+	}
 
-		// Extract P3A measurement from the current line.
-		measurements := re.FindStringSubmatch(line)
-		if len(measurements) == 0 {
-			continue
+	for _, elem := range strings.Split(spec, ",") {
+		elem = strings.TrimSpace(elem)
+		rng, strStep := elem, "1"
+		if i := strings.Index(elem, ":"); i != -1 {
+			rng, strStep = elem[:i], elem[i+1:]
+		}
+		bounds := strings.SplitN(rng, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad threshold %q", elem)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("bad end of threshold range %q", elem)
+			}
+		} else if strStep != "1" {
+			return nil, fmt.Errorf("step without range in %q", elem)
+		}
+		step, err := strconv.Atoi(strStep)
+		if err != nil || step < 1 {
+			return nil, fmt.Errorf("bad step of threshold range %q", elem)
 		}
-		if len(measurements) != 2 {
-			return nil, fmt.Errorf("line does not contain exactly one measurement: %s", line)
+		if end < start {
+			return nil, fmt.Errorf("threshold range %q ends before it starts", elem)
 		}
+		for k := start; k <= end; k += step {
+			if err := add(k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return thresholds, nil
+}
 
-		var m P3AMeasurement
-		buf := bytes.NewBufferString(measurements[1])
-		if err = json.NewDecoder(buf).Decode(&m); err != nil {
+// parseStrategies parses a comma-separated list of crowd ID strategies, which
+// are looked up in the given registry.  An empty list refers to all of the
+// registry's strategies.
+func parseStrategies(spec string, registry *strategyRegistry) ([]CrowdIDStrategy, error) {
+	if spec == "" {
+		return registry.All(), nil
+	}
+	var result []CrowdIDStrategy
+	for _, name := range strings.Split(spec, ",") {
+		s, err := registry.Lookup(strings.TrimSpace(name))
+		if err != nil {
 			return nil, err
 		}
-		if !m.IsValid() {
-			continue
-		}
-		ms = append(ms, m)
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// parseOrders parses the name of a STAR attribute order, i.e. "first",
+// "last", or "both".
+func parseOrders(name string) ([]int, error) {
+	orders, exists := orderNames[name]
+	if !exists {
+		return nil, fmt.Errorf("order must be \"first\", \"last\", or \"both\" but is %q", name)
+	}
+	return orders, nil
+}
+
+// parseSimulations parses which simulations we run, i.e. "shuffler", "star",
+// or "both".
+func parseSimulations(name string) (runShuffler, runSTAR bool, err error) {
+	switch name {
+	case "shuffler":
+		return true, false, nil
+	case "star":
+		return false, true, nil
+	case "both":
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("simulation must be \"shuffler\", \"star\", or \"both\" but is %q", name)
 	}
-	return ms, nil
 }
 
 // empiricalEntropyByField determines the empirical entropy per measurement
 // attribute.
-func empiricalEntropyByField(rs []Report) {
+func empiricalEntropyByField(it *reportIterator) {
 	yos := make(map[string]int)
 	yoi := make(map[string]int)
 	wos := make(map[string]int)
@@ -82,8 +234,8 @@ func empiricalEntropyByField(rs []Report) {
 	channel := make(map[string]int)
 	refcode := make(map[string]int)
 
-	for _, r := range rs {
-		m := r.(P3AMeasurement)
+	for it.Next() {
+		m := it.Report().(P3AMeasurement)
 		incKey(fmt.Sprintf("%d", m.YearOfInstall), yoi)
 		incKey(fmt.Sprintf("%d", m.YearOfSurvey), yos)
 		incKey(fmt.Sprintf("%d", m.WeekOfInstall), woi)
@@ -141,111 +293,89 @@ func incKey(key string, m map[string]int) {
 	}
 }
 
-func simulateShuffler(cfg *simulationConfig, reports []Report) {
-	var origReports int
-
-	s := NewShuffler(batchPeriod, cfg.AnonymityThreshold, cfg.CrowdIDMethod)
-	s.Start()
-	s.inbox <- reports
-
-	elog.Printf("Before batch period: %s\n", s)
-	origReports = s.briefcase.NumReports()
-
-	elog.Printf("Ending batch period using anonymity threshold of %d.", cfg.AnonymityThreshold)
-	s.briefcase.DumpFewerThan(s.anonymityThreshold)
-	elog.Printf("After batch period: %s\n", s)
-
-	fmt.Printf("%s,%d,%d,%.3f,0,0,0,0\n",
-		anonymityAttrs[cfg.CrowdIDMethod],
-		cfg.Order,
-		cfg.AnonymityThreshold,
-		frac(s.briefcase.NumReports(),
-			origReports))
-}
-
-func simulateSTAR(cfg *simulationConfig, reports []Report) {
-	s := NewNestedSTAR(cfg)
-
-	numAttrs := len(P3AMeasurement{}.OrderHighEntropyFirst(cfg.CrowdIDMethod))
-
-	s.AddReports(cfg.CrowdIDMethod, reports)
-	elog.Printf("Aggregating %d measurements using k=%d, method=%d, attrs=%d.",
-		s.numMeasurements, cfg.AnonymityThreshold, cfg.CrowdIDMethod, numAttrs)
-	s.Aggregate(cfg.CrowdIDMethod, numAttrs)
-}
-
-// parseReportsFromDir parses and returns all P3A measurements from the files
-// that can be found in the given directory (and subdirectories).
-func parseReportsFromDir(dir string) ([]Report, error) {
-	var reports []Report
-	var numFiles int
-	defer func() {
-		elog.Printf("Parsed %d JSON files.", numFiles)
-	}()
-
-	err := filepath.Walk(dir,
-		func(filename string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			numFiles++
-			rs, err := parseJSONFile(filename)
-			if err != nil {
-				elog.Printf("Failed to parse %s because: %s", filename, err)
-			}
-			reports = append(reports, rs...)
-			return nil
-		})
-	if err != nil {
-		return nil, err
-	}
-	return reports, nil
-}
-
-func attributeCSV(cfg *simulationConfig, reports []Report) {
+func attributeCSV(cfg *simulationConfig, it *reportIterator) {
 	elog.Println("Printing per-attribute CSVs.")
 	fmt.Println(P3AMeasurement{}.CSVHeader())
-	for i, r := range reports {
+	for i := 0; it.Next(); i++ {
 		if i%1000 == 0 {
 			elog.Printf("Processed %d measurements.", i)
 		}
-		fmt.Println(r.(P3AMeasurement).CSV())
+		fmt.Println(it.Report().(P3AMeasurement).CSV())
 	}
 }
 
-func simulationMode(cfg *simulationConfig) {
-	elog.Printf("Starting to read reports from %s.", cfg.DataDir)
-	reports, err := parseReportsFromDir(cfg.DataDir)
-	if err != nil {
+// checkIterator terminates the simulation if the given iterator failed to
+// read the entire dataset.  After the first pass over the dataset, it also
+// reports how well the dataset parsed.
+func checkIterator(cfg *simulationConfig, it *reportIterator) {
+	if err := it.Err(); err != nil {
 		elog.Fatalf("Failed to parse measurements: %s", err)
 	}
-	elog.Printf("Read %d P3A measurements from disk.", len(reports))
+	if it.pass != 1 {
+		return
+	}
+	report := it.Stats()
+	elog.Printf("Parsed %d files: %s", len(report.Files), report.Total)
+	if cfg.ParseReportFile != "" {
+		if err := report.write(cfg.ParseReportFile); err != nil {
+			elog.Fatalf("Failed to write parse report: %s", err)
+		}
+	}
+}
+
+func simulationMode(cfg *simulationConfig) {
+	// Our data sets may not fit into memory, so we stream reports from disk
+	// and into all simulations at once.
+	elog.Printf("Reading reports from %s.", cfg.DataDir)
+	data := newDataset(cfg.DataDir)
+	if cfg.QuarantineFile != "" {
+		q, err := newQuarantine(cfg.QuarantineFile)
+		if err != nil {
+			elog.Fatalf("Failed to create quarantine file: %s", err)
+		}
+		defer q.Close()
+		data.quarantine = q
+	}
 
 	if cfg.AttributeCSV {
-		attributeCSV(cfg, reports)
+		it := data.Reports()
+		attributeCSV(cfg, it)
+		checkIterator(cfg, it)
 		return
 	}
 	if cfg.Entropy {
-		empiricalEntropyByField(reports)
+		it := data.Reports()
+		empiricalEntropyByField(it)
+		checkIterator(cfg, it)
 		return
 	}
-	cfg.Order = orderHighEntropyFirst
-
-	fmt.Println("method,order,threshold,reports,num_tags,num_leaf_tags,len_part_msmts,num_part_msmts")
 
-	// Iterate over our desired k-anonymity thresholds.
-	thresholds := []int{5, 10, 25, 50, 75, 100}
-	for _, k := range thresholds {
-		cfg.AnonymityThreshold = k
+	out, err := newResultWriter(cfg.OutputFormat, cfg.OutputFile)
+	if err != nil {
+		elog.Fatalf("Failed to create output: %s", err)
+	}
+	runner := newSimulationRunner(cfg)
+	if runner.needsVersions() {
+		// Crowd IDs depend on the latest versions, so we learn them in a
+		// separate pass before the simulations start.
+		elog.Println("Learning latest versions from dataset.")
+		it := data.Reports()
+		learnVersions(it, versions)
+		checkIterator(cfg, it)
+	}
+	it := data.Reports()
+	results, err := runner.run(it)
+	if err != nil {
+		elog.Fatalf("Failed to run simulations: %s", err)
+	}
+	checkIterator(cfg, it)
 
-		for method, name := range anonymityAttrs {
-			elog.Printf("Running simulation for k=%d, method=%s", k, name)
-			cfg.CrowdIDMethod = method
-			simulateShuffler(cfg, reports)
-			simulateSTAR(cfg, reports)
+	for _, r := range results {
+		if err := out.Write(r); err != nil {
+			elog.Fatalf("Failed to write result: %s", err)
 		}
 	}
+	if err := out.Close(); err != nil {
+		elog.Fatalf("Failed to write output: %s", err)
+	}
 }
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestEntropy(t *testing.T) {
 	highEntropy := map[string]int{
@@ -24,3 +27,85 @@ func TestEntropy(t *testing.T) {
 		t.Fatalf("expected minimum entropy but got %.2f.", e)
 	}
 }
+
+func TestParseThresholds(t *testing.T) {
+	for spec, expected := range map[string][]int{
+		"10":            {10},
+		"5,10, 25":      {5, 10, 25},
+		"1-3":           {1, 2, 3},
+		"10-50:20":      {10, 30, 50},
+		"5,10-20:5,10":  {5, 10, 15, 20},
+		"100-105:10,50": {100, 50},
+	} {
+		thresholds, err := parseThresholds(spec)
+		if err != nil {
+			t.Fatalf("Failed to parse thresholds %q: %s", spec, err)
+		}
+		if fmt.Sprint(thresholds) != fmt.Sprint(expected) {
+			t.Fatalf("Expected thresholds %v for %q but got %v.", expected, spec, thresholds)
+		}
+	}
+
+	for _, spec := range []string{"", "foo", "0", "5-1", "1-10:0", "10:2", "1-x", "1-1000000"} {
+		if _, err := parseThresholds(spec); err == nil {
+			t.Fatalf("Accepted bad thresholds %q.", spec)
+		}
+	}
+}
+
+func TestSetSweep(t *testing.T) {
+	cfg := &simulationConfig{}
+	if err := cfg.setSweep("", "", "", "first", "both"); err != nil {
+		t.Fatalf("Failed to set default sweep: %s", err)
+	}
+	if len(cfg.Thresholds) != len(defaultThresholds) || len(cfg.Strategies) != len(strategies.All()) ||
+		len(cfg.Orders) != 1 || !cfg.RunShuffler || !cfg.RunSTAR {
+		t.Fatalf("Unexpected default sweep: %+v", cfg)
+	}
+
+	if err := cfg.setSweep("", "7", "minimal,1", "both", "star"); err != nil {
+		t.Fatalf("Failed to set sweep: %s", err)
+	}
+	if len(cfg.Thresholds) != 1 || cfg.Thresholds[0] != 7 {
+		t.Fatalf("Unexpected thresholds %v.", cfg.Thresholds)
+	}
+	if len(cfg.Strategies) != 2 || cfg.Strategies[0] != strategyMinimal || cfg.Strategies[1] != strategyRefactored {
+		t.Fatalf("Unexpected strategies %v.", cfg.Strategies)
+	}
+	if len(cfg.Orders) != 2 || cfg.RunShuffler || !cfg.RunSTAR {
+		t.Fatalf("Unexpected sweep: %+v", cfg)
+	}
+
+	for _, args := range [][]string{
+		{"5,10", "7", "", "first", "both"},
+		{"", "5-10", "", "first", "both"},
+		{"", "", "foo", "first", "both"},
+		{"", "", "", "middle", "both"},
+		{"", "", "", "first", "neither"},
+	} {
+		if err := cfg.setSweep(args[0], args[1], args[2], args[3], args[4]); err == nil {
+			t.Fatalf("Accepted bad sweep %q.", args)
+		}
+	}
+}
+
+func TestSetNoise(t *testing.T) {
+	cfg := &simulationConfig{}
+	if err := cfg.setNoise(noiseLaplace, "", 0, 0); err != nil || len(cfg.Noise) != 0 {
+		t.Fatalf("Expected no noise but got %v (%v).", cfg.Noise, err)
+	}
+	if err := cfg.setNoise(noiseLaplace, "", 0, 0.1); err != nil || len(cfg.Noise) != 1 || cfg.Noise[0].Mechanism != "" {
+		t.Fatalf("Expected dropping without noise but got %v (%v).", cfg.Noise, err)
+	}
+	if err := cfg.setNoise(noiseGaussian, "0.1, 0.5", 1e-6, 0); err != nil || len(cfg.Noise) != 2 || cfg.Noise[1].Epsilon != 0.5 {
+		t.Fatalf("Expected two noise configurations but got %v (%v).", cfg.Noise, err)
+	}
+	for _, epsilons := range []string{"foo", "0", "1,-1"} {
+		if err := cfg.setNoise(noiseLaplace, epsilons, 0, 0); err == nil {
+			t.Fatalf("Accepted bad epsilons %q.", epsilons)
+		}
+	}
+	if err := cfg.setNoise(noiseGaussian, "0.5, 1", 1e-6, 0); err == nil {
+		t.Fatal("Accepted Gaussian noise with an epsilon of 1.")
+	}
+}
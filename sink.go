@@ -0,0 +1,397 @@
+package main
+
+// This file implements the sinks that the forwarder sends chunks of shuffled
+// reports to.  Besides the analyzer's HTTP(S) endpoint, chunks can be written
+// to rotating local files (see filesink.go), an S3-compatible object store
+// (see s3sink.go), and stdout, which is useful for shadow analyzers and
+// local integration tests.  Sinks are configured in our configuration file,
+// e.g.:
+//
+//   "sinks": [
+//     {"type": "http", "url": "https://analyzer.example.com", "timeout": "1m"},
+//     {"type": "file", "dir": "/var/lib/p3a-shuffler/batches"},
+//     {"type": "stdout"}
+//   ]
+//
+// If no sinks are configured, we only forward to analyzer_url.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	sinkHTTP   = "http"
+	sinkFile   = "file"
+	sinkS3     = "s3"
+	sinkStdout = "stdout"
+)
+
+var errSinkClosed = errors.New("sink is closed")
+
+// Sink represents a destination for chunks of shuffled reports.  Sinks must
+// be safe for concurrent use.
+type Sink interface {
+	// Name returns the sink's name, which we use in logs and metrics.
+	Name() string
+	// Send delivers the given chunk.  Send must only return nil once the
+	// sink accepted the chunk, so that the forwarder can retry all other
+	// chunks.  Sending the same chunk twice must be harmless.
+	Send(chunk *Batch) error
+	// Close releases the sink's resources.
+	Close() error
+}
+
+// sinkConfig represents the configuration of a single sink.  Which fields
+// apply depends on the sink's type.
+type sinkConfig struct {
+	// Type is "http", "file", "s3", or "stdout".
+	Type string `json:"type"`
+	// Name distinguishes sinks in logs and metrics.  It defaults to the
+	// sink's type.
+	Name string `json:"name,omitempty"`
+
+	// URL, Headers, the TLS settings, and Timeout apply to HTTP sinks.
+	// Timeout also applies to S3 sinks.
+	URL            string            `json:"url,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	ClientCertFile string            `json:"client_cert_file,omitempty"`
+	ClientKeyFile  string            `json:"client_key_file,omitempty"`
+	CAFile         string            `json:"ca_file,omitempty"`
+	Timeout        duration          `json:"timeout,omitempty"`
+
+	// Dir, Format, MaxFileBytes, and RotateInterval apply to file sinks.
+	Dir            string   `json:"dir,omitempty"`
+	Format         string   `json:"format,omitempty"`
+	MaxFileBytes   int64    `json:"max_file_bytes,omitempty"`
+	RotateInterval duration `json:"rotate_interval,omitempty"`
+
+	// The following fields apply to S3 sinks.  If the credentials are empty,
+	// we use the environment variables AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN.
+	Endpoint        string `json:"endpoint,omitempty"`
+	Region          string `json:"region,omitempty"`
+	Bucket          string `json:"bucket,omitempty"`
+	Prefix          string `json:"prefix,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+}
+
+// name returns the sink's name.
+func (c *sinkConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+// credentials returns the S3 sink's AWS credentials.
+func (c *sinkConfig) credentials() *awsCredentials {
+	if c.AccessKeyID != "" || c.SecretAccessKey != "" || c.SessionToken != "" {
+		return &awsCredentials{
+			AccessKeyID:     c.AccessKeyID,
+			SecretAccessKey: c.SecretAccessKey,
+			SessionToken:    c.SessionToken,
+		}
+	}
+	return envAWSCredentials()
+}
+
+// validate returns an error if the sink's configuration is invalid.
+func (c *sinkConfig) validate() error {
+	isHTTPURL := func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("sink %q has negative timeout", c.name())
+	}
+	switch c.Type {
+	case sinkHTTP:
+		if !isHTTPURL(c.URL) {
+			return fmt.Errorf("sink %q needs an absolute http(s) URL but has %q", c.name(), c.URL)
+		}
+		if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+			return fmt.Errorf("sink %q needs both a client certificate and key for mutual TLS", c.name())
+		}
+	case sinkFile:
+		if c.Dir == "" {
+			return fmt.Errorf("sink %q needs a directory", c.name())
+		}
+		if c.Format != "" && c.Format != fileFormatJSONL {
+			return fmt.Errorf("sink %q has unknown format %q", c.name(), c.Format)
+		}
+		if c.MaxFileBytes < 0 || c.RotateInterval < 0 {
+			return fmt.Errorf("sink %q has negative rotation settings", c.name())
+		}
+	case sinkS3:
+		if !isHTTPURL(c.Endpoint) {
+			return fmt.Errorf("sink %q needs an absolute http(s) endpoint but has %q", c.name(), c.Endpoint)
+		}
+		if c.Region == "" || c.Bucket == "" {
+			return fmt.Errorf("sink %q needs a region and a bucket", c.name())
+		}
+		if creds := c.credentials(); creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+			return fmt.Errorf("sink %q has no credentials", c.name())
+		}
+	case sinkStdout:
+	default:
+		return fmt.Errorf("sink %q has unknown type %q", c.name(), c.Type)
+	}
+	return nil
+}
+
+// tlsConfig returns the sink's TLS settings, or nil if the sink has none.
+func (c *sinkConfig) tlsConfig() (*tls.Config, error) {
+	if c.ClientCertFile == "" && c.CAFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if c.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		roots, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return tlsConfig, nil
+}
+
+// deriveClient returns a copy of the given client that uses the given TLS
+// settings and timeout, if any.  We can only apply TLS settings to clients
+// whose transport is an *http.Transport, so we fail for all others rather than
+// drop the settings.
+func deriveClient(base *http.Client, tlsConfig *tls.Config, timeout time.Duration) (*http.Client, error) {
+	c := *base
+	if timeout > 0 {
+		c.Timeout = timeout
+	}
+	if tlsConfig == nil {
+		return &c, nil
+	}
+
+	var transport *http.Transport
+	switch t := base.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("cannot apply TLS settings to HTTP transport of type %T", t)
+	}
+	merged := tlsConfig.Clone()
+	if merged.RootCAs == nil && transport.TLSClientConfig != nil {
+		merged.RootCAs = transport.TLSClientConfig.RootCAs
+	}
+	transport.TLSClientConfig = merged
+	c.Transport = transport
+	return &c, nil
+}
+
+// sinkClient returns the HTTP client of the sink with the given configuration,
+// which is derived from the given client that all sinks share.
+func (c *sinkConfig) sinkClient(base *http.Client) (*http.Client, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return deriveClient(base, tlsConfig, time.Duration(c.Timeout))
+}
+
+// newSink returns a new sink for the given configuration.  Sinks that
+// support content negotiation encode chunks using the given content type,
+// sinks that support signatures sign chunks using the given signer, and sinks
+// that use HTTP derive their client from the given client.
+func newSink(c *sinkConfig, contentType string, signer *batchSigner, client *http.Client) (Sink, error) {
+	switch c.Type {
+	case sinkHTTP:
+		client, err := c.sinkClient(client)
+		if err != nil {
+			return nil, err
+		}
+		s := newHTTPSink(c.URL, contentType, client)
+		s.name, s.headers, s.signer = c.name(), c.Headers, signer
+		return s, nil
+	case sinkFile:
+		s, err := newFileSink(c.Dir, c.MaxFileBytes, time.Duration(c.RotateInterval))
+		if err != nil {
+			return nil, err
+		}
+		s.name = c.name()
+		return s, nil
+	case sinkS3:
+		client, err := c.sinkClient(client)
+		if err != nil {
+			return nil, err
+		}
+		s := newS3Sink(c.Endpoint, c.Region, c.Bucket, c.Prefix, c.credentials(), contentType, client)
+		s.name, s.signer = c.name(), signer
+		return s, nil
+	case sinkStdout:
+		s := newStdoutSink(os.Stdout)
+		s.name = c.name()
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", c.Type)
+	}
+}
+
+// factory returns a factory for the sink with the given configuration, which
+// encodes and signs chunks like newSink.
+func (c *sinkConfig) factory(contentType string, signer *batchSigner) SinkFactory {
+	return func(client *http.Client) (Sink, error) {
+		s, err := newSink(c, contentType, signer, client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sink %q: %w", c.name(), err)
+		}
+		return s, nil
+	}
+}
+
+// httpSink POSTs chunks to the analyzer.  See batch.go for our wire format
+// and the analyzer's acknowledgements.
+type httpSink struct {
+	sync.Mutex
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+	signer  *batchSigner
+	// contentType is the content type that we negotiated with the analyzer.
+	contentType string
+}
+
+// newHTTPSink returns a new HTTP sink that POSTs chunks to the given URL,
+// encoded using the given content type, via the given client.
+func newHTTPSink(url, contentType string, client *http.Client) *httpSink {
+	return &httpSink{
+		name:        sinkHTTP,
+		url:         url,
+		client:      client,
+		contentType: contentType,
+	}
+}
+
+func (s *httpSink) Name() string {
+	return s.name
+}
+
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Send POSTs the given chunk.  If the server doesn't support our content
+// type, we switch to a content type that it supports, and try again.
+func (s *httpSink) Send(chunk *Batch) error {
+	s.Lock()
+	contentType := s.contentType
+	s.Unlock()
+
+	resp, body, err := s.post(chunk, contentType)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnsupportedMediaType {
+		negotiated, ok := negotiateContentType(resp.Header.Get("Accept"))
+		if !ok || negotiated == contentType {
+			return fmt.Errorf("server supports none of our content types: %q", truncate(body))
+		}
+		elog.Printf("Server doesn't support %s.  Switching to %s.", contentType, negotiated)
+		s.Lock()
+		s.contentType = negotiated
+		s.Unlock()
+		if resp, body, err = s.post(chunk, negotiated); err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received HTTP status code %d from server: %q", resp.StatusCode, truncate(body))
+	}
+	return chunk.verifyAck(body)
+}
+
+// post POSTs the given chunk to the server, encoded using the given content
+// type and signed by our signer.  The response's body is returned separately
+// and is already closed.
+func (s *httpSink) post(chunk *Batch, contentType string) (*http.Response, []byte, error) {
+	body, err := chunk.Marshal(contentType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal batch: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Idempotency-Key", chunk.idempotencyKey())
+	s.signer.setHeaders(req, body)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to POST batch to server: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxAckBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	// Drain the rest of the body, so the underlying connection can be reused.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp, respBody, nil
+}
+
+// stdoutSink writes every chunk as a line of JSON to stdout, for debugging.
+type stdoutSink struct {
+	sync.Mutex
+	name string
+	w    io.Writer
+}
+
+// newStdoutSink returns a new stdout sink that writes to the given writer,
+// which is stdout unless we're testing.
+func newStdoutSink(w io.Writer) *stdoutSink {
+	return &stdoutSink{name: sinkStdout, w: w}
+}
+
+func (s *stdoutSink) Name() string {
+	return s.name
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+func (s *stdoutSink) Send(chunk *Batch) error {
+	msg, err := chunk.message()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to the
+// given directory and returns the files' paths.
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "p3a-shuffler"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "p3a-shuffler"}}, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %s", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(priv)
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestHTTPSink(t *testing.T) {
+	var gotClientCert int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer foo" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if len(r.TLS.PeerCertificates) == 1 {
+			atomic.StoreInt32(&gotClientCert, 1)
+		}
+		ackHandler(w, r)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	_ = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	cfg := &sinkConfig{
+		Type:           sinkHTTP,
+		URL:            srv.URL,
+		Headers:        map[string]string{"Authorization": "Bearer foo"},
+		ClientCertFile: certFile,
+		ClientKeyFile:  keyFile,
+		CAFile:         caFile,
+		Timeout:        duration(time.Second * 5),
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Rejected valid sink configuration: %s", err)
+	}
+	sink, err := newSink(cfg, contentTypeJSON, nil, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create sink: %s", err)
+	}
+	defer sink.Close()
+	if err := sink.Send(&Batch{ID: "foo", Reports: []Report{P3AMeasurement{}}}); err != nil {
+		t.Fatalf("Failed to send chunk: %s", err)
+	}
+	if atomic.LoadInt32(&gotClientCert) != 1 {
+		t.Fatal("Server didn't receive client certificate.")
+	}
+
+	// Without the CA file, the sink must not trust the server's certificate.
+	cfg.CAFile = ""
+	if sink, err = newSink(cfg, contentTypeJSON, nil, http.DefaultClient); err != nil {
+		t.Fatalf("Failed to create sink: %s", err)
+	}
+	if err := sink.Send(&Batch{ID: "foo", Reports: []Report{P3AMeasurement{}}}); err == nil {
+		t.Fatal("Sink trusted server with unknown certificate.")
+	}
+	// A client whose transport we cannot configure must not silently drop
+	// the sink's TLS settings.
+	custom := &http.Client{Transport: http.NewFileTransport(http.Dir(dir))}
+	if _, err := newSink(cfg, contentTypeJSON, nil, custom); err == nil {
+		t.Fatal("Created sink that ignores its TLS settings.")
+	}
+}
+
+func TestContentTypeNegotiation(t *testing.T) {
+	var numRequests int32
+	received := make(chan *batchMessage, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		contentType := r.Header.Get("Content-Type")
+		if contentType != contentTypeCBOR {
+			w.Header().Set("Accept", "application/cbor;q=0.9, text/plain")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if m := ackChunk(w, contentType, body); m != nil {
+			received <- m
+		}
+	}))
+	defer srv.Close()
+
+	sink := newHTTPSink(srv.URL, contentTypeJSON, http.DefaultClient)
+
+	batch := &Batch{ID: "foo", Threshold: 10, Reports: []Report{P3AMeasurement{MetricName: "bar"}}}
+	if err := sink.Send(batch); err != nil {
+		t.Fatalf("Failed to post batch: %s", err)
+	}
+	m := <-received
+	if m.BatchID != "foo" || m.Threshold != 10 || len(m.Payloads) != 1 {
+		t.Fatalf("Server received unexpected batch: %+v", m)
+	}
+	if n := atomic.LoadInt32(&numRequests); n != 2 {
+		t.Fatalf("Expected 2 requests but got %d.", n)
+	}
+
+	// The sink should remember the negotiated content type.
+	if err := sink.Send(batch); err != nil {
+		t.Fatalf("Failed to post batch: %s", err)
+	}
+	<-received
+	if n := atomic.LoadInt32(&numRequests); n != 3 {
+		t.Fatalf("Expected 3 requests but got %d.", n)
+	}
+}
+
+func TestStdoutSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := newStdoutSink(buf)
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(&Batch{ID: "foo", ChunkIndex: i, ChunkCount: 2}); err != nil {
+			t.Fatalf("Failed to send chunk: %s", err)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines but got %d.", len(lines))
+	}
+	m, err := unmarshalBatchMessage(contentTypeJSON, []byte(lines[1]))
+	if err != nil || m.BatchID != "foo" || m.ChunkIndex != 1 {
+		t.Fatalf("Unexpected chunk %q: %v", lines[1], err)
+	}
+}
+
+// memorySink remembers the chunks that it receives, and whether it was
+// closed.
+type memorySink struct {
+	sync.Mutex
+	chunks []*Batch
+	closed bool
+}
+
+func (s *memorySink) Name() string { return "memory" }
+func (s *memorySink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return nil
+}
+func (s *memorySink) Send(chunk *Batch) error {
+	s.Lock()
+	defer s.Unlock()
+	s.chunks = append(s.chunks, chunk)
+	return nil
+}
+
+func TestFanOut(t *testing.T) {
+	sinks := []*memorySink{{}, {}}
+	c := make(chan *Batch)
+	f := mustNewForwarder(t, c, staticSinks(sinks[0], sinks[1]))
+	f.ChunkSize = 2
+	f.retryCheckInterval = time.Millisecond
+	f.Start()
+
+	c <- &Batch{ID: "foo", Reports: []Report{P3AMeasurement{}, P3AMeasurement{}, P3AMeasurement{}}}
+	f.Drain(time.Second * 5)
+	for i, s := range sinks {
+		if len(s.chunks) != 2 {
+			t.Fatalf("Expected 2 chunks in sink %d but got %d.", i, len(s.chunks))
+		}
+	}
+}
+
+func TestSinkConfig(t *testing.T) {
+	for _, c := range []*sinkConfig{
+		{Type: "foo"},
+		{Type: sinkHTTP, URL: "example.com"},
+		{Type: sinkHTTP, URL: "https://example.com", ClientCertFile: "cert.pem"},
+		{Type: sinkFile},
+		{Type: sinkFile, Dir: "/tmp", Format: "parquet"},
+		{Type: sinkS3, Endpoint: "https://s3.example.com", Bucket: "foo"},
+		{Type: sinkS3, Endpoint: "https://s3.example.com", Region: "us-east-1", Bucket: "foo", AccessKeyID: "foo"},
+	} {
+		if err := c.validate(); err == nil {
+			t.Fatalf("Accepted invalid sink configuration: %+v", c)
+		}
+	}
+	for _, c := range []*sinkConfig{
+		{Type: sinkStdout},
+		{Type: sinkFile, Dir: "/tmp", Format: fileFormatJSONL},
+		{Type: sinkS3, Endpoint: "https://s3.example.com", Region: "us-east-1", Bucket: "foo", AccessKeyID: "foo", SecretAccessKey: "bar"},
+	} {
+		if err := c.validate(); err != nil {
+			t.Fatalf("Rejected valid sink configuration: %s", err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+// This file implements encrypted snapshots of the shuffler's briefcase, which
+// allow the shuffler to survive restarts without losing the reports that it
+// has collected in the current batch period.  A snapshot has the following
+// format:
+//
+//   magic (4 bytes) || version (1 byte) || creation time (8 bytes) ||
+//   batch number (8 bytes) || snapshot number (8 bytes) ||
+//   nonce (12 bytes) || AES-256-GCM ciphertext
+//
+// The header is authenticated as additional data, so an attacker can neither
+// tamper with a snapshot nor make a stale snapshot look fresh.  The batch and
+// snapshot numbers bind the snapshot to our monotonic counter (see
+// counter.go), which lets us refuse every snapshot but the latest one.
+// Otherwise, the host could restore a snapshot whose reports we already
+// forwarded, and make us release them a second time.  The key must never
+// leave the enclave.  In production, KMS releases it to the enclave after
+// checking the enclave's attestation document (see kms.go).
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotMagic   = "P3AS"
+	snapshotVersion = 2
+	snapshotKeyLen  = 32
+	// defaultSnapshotInterval determines how often we write a snapshot.
+	defaultSnapshotInterval = time.Minute * 5
+	// snapshotHeaderLen is the length of the authenticated header, i.e. the
+	// magic, the version, the creation time, and the snapshot's position.
+	snapshotHeaderLen = len(snapshotMagic) + 1 + 8 + 8 + 8
+	// snapshotOpenTimeout determines how long we keep trying to obtain the
+	// snapshot key and counter when the shuffler starts.
+	snapshotOpenTimeout = time.Minute * 5
+)
+
+var (
+	errNoSnapshot         = errors.New("snapshot does not exist")
+	errBadSnapshotMagic   = errors.New("file is not a briefcase snapshot")
+	errBadSnapshotVersion = errors.New("unsupported snapshot version")
+	errStaleSnapshot      = errors.New("snapshot is stale")
+	errTamperedSnapshot   = errors.New("snapshot failed integrity check")
+	errRolledBackSnapshot = errors.New("snapshot is not the latest one")
+	errSnapshotsNotOpen   = errors.New("snapshots were not opened")
+)
+
+func init() {
+	// gob must know all concrete Report types that may end up in a snapshot.
+	gob.Register(P3AMeasurement{})
+	gob.Register(&ShufflerReport{})
+}
+
+// snapshotState is the content of a snapshot.
+type snapshotState struct {
+	BatchStart time.Time
+	Reports    []Report
+}
+
+// snapshotter writes and reads encrypted snapshots of a briefcase.
+type snapshotter struct {
+	path    string
+	key     func() ([]byte, error)
+	counter counterStore
+	maxAge  time.Duration
+	// The following fields are set by open.  cur is the position that our
+	// counter stores, and batch is the number of our current batch period.
+	aead  cipher.AEAD
+	cur   snapshotSeq
+	batch uint64
+}
+
+// newSnapshotter returns a new snapshotter that stores snapshots at the given
+// path, encrypted with the 32-byte key that the given function returns, and
+// keeps track of the latest snapshot in the given counter.  Snapshots that
+// are older than the given maximum age are refused.
+func newSnapshotter(path string, key func() ([]byte, error), counter counterStore, maxAge time.Duration) *snapshotter {
+	return &snapshotter{path: path, key: key, counter: counter, maxAge: maxAge}
+}
+
+// open obtains the snapshot key and the position of the latest snapshot.
+// Snapshots can only be read and written once open succeeded.
+func (s *snapshotter) open() error {
+	key, err := s.key()
+	if err != nil {
+		return fmt.Errorf("failed to obtain snapshot key: %w", err)
+	}
+	if len(key) != snapshotKeyLen {
+		return fmt.Errorf("snapshot key must be %d bytes but is %d", snapshotKeyLen, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	cur, err := s.counter.load()
+	if err != nil {
+		return fmt.Errorf("failed to load snapshot counter: %w", err)
+	}
+	s.aead, s.cur, s.batch = aead, cur, cur.Batch
+	return nil
+}
+
+// nextBatch moves on to the next batch period, so that no snapshot of the
+// current batch period can be restored anymore.  If we fail to update the
+// counter, the next call to write tries again, and behind returns true until
+// then.
+func (s *snapshotter) nextBatch() error {
+	if s.aead == nil {
+		return errSnapshotsNotOpen
+	}
+	s.batch++
+	next := snapshotSeq{Batch: s.batch}
+	if err := s.counter.swap(s.cur, next); err != nil {
+		return err
+	}
+	s.cur = next
+	return nil
+}
+
+// behind returns true if our counter still refers to a previous batch period.
+func (s *snapshotter) behind() bool {
+	return s.aead != nil && s.cur.Batch != s.batch
+}
+
+// readSnapshotKey reads a hex-encoded snapshot key from the given file.
+func readSnapshotKey(filename string) ([]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("snapshot key is not hex-encoded: %w", err)
+	}
+	return key, nil
+}
+
+// header returns the authenticated header for a snapshot that was created at
+// the given time and has the given position.
+func (s *snapshotter) header(created time.Time, seq snapshotSeq) []byte {
+	header := make([]byte, snapshotHeaderLen)
+	copy(header, snapshotMagic)
+	header[len(snapshotMagic)] = snapshotVersion
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+1:], uint64(created.UnixNano()))
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+9:], seq.Batch)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+17:], seq.Snapshot)
+	return header
+}
+
+// write encrypts the given state and atomically replaces the current snapshot
+// with it.  We advance our counter before we write the snapshot, so if we
+// crash in between, we refuse the previous snapshot rather than accept an
+// outdated one.
+func (s *snapshotter) write(state *snapshotState) error {
+	if s.aead == nil {
+		return errSnapshotsNotOpen
+	}
+	next := snapshotSeq{Batch: s.batch, Snapshot: 1}
+	if s.cur.Batch == s.batch {
+		next.Snapshot = s.cur.Snapshot + 1
+	}
+	if err := s.counter.swap(s.cur, next); err != nil {
+		return fmt.Errorf("failed to advance snapshot counter: %w", err)
+	}
+	s.cur = next
+
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(state); err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	header := s.header(time.Now(), next)
+	blob := append(append(header, nonce...), s.aead.Seal(nil, nonce, plaintext.Bytes(), header)...)
+
+	// Write to a temporary file first, so we never end up with a half-written
+	// snapshot.
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// read reads, authenticates, and decrypts the current snapshot, which must be
+// the latest snapshot that we wrote.
+func (s *snapshotter) read() (*snapshotState, error) {
+	if s.aead == nil {
+		return nil, errSnapshotsNotOpen
+	}
+	blob, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blob) < snapshotHeaderLen+s.aead.NonceSize() || string(blob[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errBadSnapshotMagic
+	}
+	if blob[len(snapshotMagic)] != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", errBadSnapshotVersion, blob[len(snapshotMagic)])
+	}
+	header := blob[:snapshotHeaderLen]
+	nonce := blob[snapshotHeaderLen : snapshotHeaderLen+s.aead.NonceSize()]
+	plaintext, err := s.aead.Open(nil, nonce, blob[snapshotHeaderLen+s.aead.NonceSize():], header)
+	if err != nil {
+		return nil, errTamperedSnapshot
+	}
+
+	// Now that we know that the header is authentic, we can trust the
+	// creation time and position.
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(header[len(snapshotMagic)+1:])))
+	if age := time.Since(created); age > s.maxAge {
+		return nil, fmt.Errorf("%w: created %s ago", errStaleSnapshot, age.Round(time.Second))
+	}
+	seq := snapshotSeq{
+		Batch:    binary.BigEndian.Uint64(header[len(snapshotMagic)+9:]),
+		Snapshot: binary.BigEndian.Uint64(header[len(snapshotMagic)+17:]),
+	}
+	if seq != s.cur {
+		return nil, fmt.Errorf("%w: snapshot is %s but latest is %s", errRolledBackSnapshot, seq, s.cur)
+	}
+
+	var state snapshotState
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return &state, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSnapshotter returns a snapshotter that stores its snapshot and
+// counter in the given directory.
+func newTestSnapshotter(dir string, maxAge time.Duration) *snapshotter {
+	key := func() ([]byte, error) { return make([]byte, snapshotKeyLen), nil }
+	path := filepath.Join(dir, "snapshot")
+	return newSnapshotter(path, key, &fileCounter{path: path + ".counter"}, maxAge)
+}
+
+// openTestSnapshotter returns a new, opened snapshotter.
+func openTestSnapshotter(t *testing.T, maxAge time.Duration) *snapshotter {
+	s := newTestSnapshotter(t.TempDir(), maxAge)
+	if err := s.open(); err != nil {
+		t.Fatalf("Failed to open snapshotter: %s", err)
+	}
+	return s
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	s := openTestSnapshotter(t, time.Hour)
+	if _, err := s.read(); err != errNoSnapshot {
+		t.Fatalf("Expected error %q but got %v.", errNoSnapshot, err)
+	}
+
+	batchStart := time.Now().Add(-time.Minute).Round(0)
+	orig := &snapshotState{
+		BatchStart: batchStart,
+		Reports:    []Report{m, &ShufflerReport{ID: CrowdID("foo"), Data: []byte("bar")}},
+	}
+	if err := s.write(orig); err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+	state, err := s.read()
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+	if !state.BatchStart.Equal(batchStart) {
+		t.Fatalf("Expected batch start %s but got %s.", batchStart, state.BatchStart)
+	}
+	if len(state.Reports) != 2 || state.Reports[0].(P3AMeasurement) != m {
+		t.Fatalf("Restored reports don't match original reports: %v", state.Reports)
+	}
+}
+
+func TestSnapshotIntegrity(t *testing.T) {
+	s := openTestSnapshotter(t, time.Hour)
+	if err := s.write(&snapshotState{Reports: []Report{m}}); err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+	blob, _ := os.ReadFile(s.path)
+
+	// Tamper with the ciphertext.
+	tampered := append([]byte{}, blob...)
+	tampered[len(tampered)-1] ^= 1
+	_ = os.WriteFile(s.path, tampered, 0600)
+	if _, err := s.read(); err != errTamperedSnapshot {
+		t.Fatalf("Expected error %q but got %v.", errTamperedSnapshot, err)
+	}
+
+	// Tamper with the authenticated snapshot number.
+	tampered = append([]byte{}, blob...)
+	tampered[snapshotHeaderLen-1] ^= 1
+	_ = os.WriteFile(s.path, tampered, 0600)
+	if _, err := s.read(); err != errTamperedSnapshot {
+		t.Fatalf("Expected error %q but got %v.", errTamperedSnapshot, err)
+	}
+
+	// Use an unsupported version.
+	tampered = append([]byte{}, blob...)
+	tampered[len(snapshotMagic)] = snapshotVersion + 1
+	_ = os.WriteFile(s.path, tampered, 0600)
+	if _, err := s.read(); !errors.Is(err, errBadSnapshotVersion) {
+		t.Fatalf("Expected error %q but got %v.", errBadSnapshotVersion, err)
+	}
+
+	// A stale snapshot must be refused.
+	_ = os.WriteFile(s.path, blob, 0600)
+	s.maxAge = 0
+	if _, err := s.read(); !errors.Is(err, errStaleSnapshot) {
+		t.Fatalf("Expected error %q but got %v.", errStaleSnapshot, err)
+	}
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	s := openTestSnapshotter(t, time.Hour)
+	if err := s.write(&snapshotState{Reports: []Report{m}}); err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+	old, _ := os.ReadFile(s.path)
+	if err := s.write(&snapshotState{Reports: []Report{m, m}}); err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+
+	// An older snapshot of the same batch period must be refused.
+	_ = os.WriteFile(s.path, old, 0600)
+	if _, err := s.read(); !errors.Is(err, errRolledBackSnapshot) {
+		t.Fatalf("Expected error %q but got %v.", errRolledBackSnapshot, err)
+	}
+
+	// So must the latest snapshot once its batch period ended.
+	if err := s.write(&snapshotState{Reports: []Report{m}}); err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+	latest, _ := os.ReadFile(s.path)
+	if err := s.nextBatch(); err != nil {
+		t.Fatalf("Failed to advance to next batch period: %s", err)
+	}
+	_ = os.WriteFile(s.path, latest, 0600)
+	if _, err := s.read(); !errors.Is(err, errRolledBackSnapshot) {
+		t.Fatalf("Expected error %q but got %v.", errRolledBackSnapshot, err)
+	}
+}
+
+func TestShufflerRestoresSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	s1 := NewShuffler(time.Hour, 1, defaultCrowdIDStrategy, WithSnapshots(newTestSnapshotter(dir, time.Hour), time.Hour))
+	s1.Start()
+	s1.inbox <- []Report{m, m}
+	// Stopping the shuffler writes a final snapshot.
+	s1.Stop()
+
+	s2 := NewShuffler(time.Hour, 1, defaultCrowdIDStrategy, WithSnapshots(newTestSnapshotter(dir, time.Hour), time.Hour))
+	s2.restoreSnapshot()
+	if s2.briefcase.NumReports() != 2 {
+		t.Fatalf("Expected 2 restored reports but got %d.", s2.briefcase.NumReports())
+	}
+	if !s2.batchStart.Equal(s1.batchStart) {
+		t.Fatalf("Expected batch start %s but got %s.", s1.batchStart, s2.batchStart)
+	}
+}
+
+// flakyCounter is a counter whose swaps fail while broken is set.
+type flakyCounter struct {
+	fileCounter
+	broken bool
+}
+
+func (c *flakyCounter) swap(old, next snapshotSeq) error {
+	if c.broken {
+		return errors.New("counter unavailable")
+	}
+	return c.fileCounter.swap(old, next)
+}
+
+func TestShufflerWithholdsBatchesWhileBehind(t *testing.T) {
+	dir := t.TempDir()
+	counter := &flakyCounter{fileCounter: fileCounter{path: filepath.Join(dir, "counter")}, broken: true}
+	key := func() ([]byte, error) { return make([]byte, snapshotKeyLen), nil }
+	s := NewShuffler(time.Hour, 1, defaultCrowdIDStrategy,
+		WithSnapshots(newSnapshotter(filepath.Join(dir, "snapshot"), key, counter, time.Hour), time.Hour))
+
+	// Without a snapshot, we move on to a new batch period, which fails.
+	s.restoreSnapshot()
+	if !s.snapshotsBehind() {
+		t.Fatal("Expected snapshot counter to be behind.")
+	}
+	// The next snapshot catches up with the counter.
+	counter.broken = false
+	s.writeSnapshot()
+	if s.snapshotsBehind() {
+		t.Fatal("Expected snapshot counter to have caught up.")
+	}
+}
@@ -19,32 +19,31 @@ type NestedSTAR struct {
 	sync.WaitGroup
 	inbox           chan []Report
 	root            *Node
-	threshold       int
 	order           int
 	numMeasurements int
 }
 
-// NewNestedSTAR returns a new NestedSTAR object.
-func NewNestedSTAR(cfg *simulationConfig) *NestedSTAR {
+// NewNestedSTAR returns a new NestedSTAR object that nests attributes in the
+// given order.
+func NewNestedSTAR(order int) *NestedSTAR {
 	return &NestedSTAR{
-		inbox:     make(chan []Report),
-		root:      &Node{make(map[string]*NodeInfo)},
-		threshold: cfg.AnonymityThreshold,
-		order:     cfg.Order,
+		inbox: make(chan []Report),
+		root:  &Node{make(map[string]*NodeInfo)},
+		order: order,
 	}
 }
 
-// AddReports adds the given reports to Nested STAR.  The argument 'method'
-// refers to the subset of attributes that we consider.
-func (s *NestedSTAR) AddReports(method int, reports []Report) {
+// AddReports adds the given reports to Nested STAR.  The argument 'strategy'
+// determines the subset of attributes that we consider.
+func (s *NestedSTAR) AddReports(strategy CrowdIDStrategy, reports []Report) {
 	s.numMeasurements += len(reports)
 	var m P3AMeasurement
 	for _, r := range reports {
 		m = r.(P3AMeasurement)
 		if s.order == orderHighEntropyFirst {
-			s.root.Add(m.OrderHighEntropyFirst(method))
+			s.root.Add(m.OrderHighEntropyFirst(strategy))
 		} else {
-			s.root.Add(m.OrderHighEntropyLast(method))
+			s.root.Add(m.OrderHighEntropyLast(strategy))
 		}
 	}
 }
@@ -56,42 +55,85 @@ func frac(a, b int) float64 {
 	return float64(a) / float64(b)
 }
 
-// Aggregate aggregates Nested STAR's measurements.  The argument 'method'
-// refers to the subset of attributes we consider and 'numAttrs' refers to the
-// number of attributes.
-func (s *NestedSTAR) Aggregate(method int, numAttrs int) {
-	state := s.root.Aggregate(numAttrs, s.threshold, []string{})
+// Aggregate aggregates Nested STAR's measurements using the given k-anonymity
+// threshold and returns the results.  The argument 'strategy' determines the
+// subset of attributes we consider and 'numAttrs' refers to the number of
+// attributes.  Aggregation doesn't modify the tree of nodes, so it's safe to
+// aggregate concurrently using different thresholds.
+func (s *NestedSTAR) Aggregate(strategy CrowdIDStrategy, numAttrs, threshold int) []result {
+	a := newSTARAggregate()
+	a.add(s, numAttrs, threshold)
+	return a.results(strategy, s.order, threshold, false)
+}
+
+// starAggregate combines the aggregation states of one or more Nested STAR
+// trees, e.g. one tree per rule of a threshold policy.
+type starAggregate struct {
+	state           *AggregationState
+	numAttrs        int
+	numMeasurements int
+	numTags         int
+	numLeafTags     int
+}
+
+func newSTARAggregate() *starAggregate {
+	return &starAggregate{state: NewAggregationState()}
+}
+
+// add aggregates the given tree, whose measurements have the given number of
+// attributes, using the given threshold.
+func (a *starAggregate) add(s *NestedSTAR, numAttrs, threshold int) {
+	a.state.Augment(s.root.Aggregate(numAttrs, threshold, []string{}))
+	if numAttrs > a.numAttrs {
+		a.numAttrs = numAttrs
+	}
+	a.numMeasurements += s.numMeasurements
+	a.numTags += s.root.NumTags()
+	a.numLeafTags += s.root.NumLeafTags()
+}
+
+// results returns the results of the aggregate.
+func (a *starAggregate) results(strategy CrowdIDStrategy, order, threshold int, policy bool) []result {
+	var results []result
+	state := a.state
 	if !state.AddsUp() {
 		elog.Printf("Number of partial measurements don't add up.")
 	}
-	for key := 1; key <= numAttrs; key++ {
-		num, exists := state.LenPartialMsmts[key]
-		if !exists {
-			num = 0
-		}
-		fmt.Printf("LenPartMsmt%s,%d,%d,0,0,0,%d,%d\n",
-			anonymityAttrs[method],
-			s.order,
-			s.threshold,
-			key,
-			num)
-	}
-	fracFull := frac(state.FullMsmts, s.numMeasurements) * 100
-	fracPart := frac(state.PartialMsmts, s.numMeasurements) * 100
-	elog.Printf("%d (%.1f%%) full, %d (%.1f%%) partial out of %d; %.1f%% lost\n",
+	for key := 1; key <= a.numAttrs; key++ {
+		results = append(results, &starLengthResult{
+			Strategy:   strategy.Name(),
+			Order:      orderName(order),
+			Threshold:  threshold,
+			Policy:     policy,
+			Length:     key,
+			NumPartial: state.LenPartialMsmts[key],
+		})
+	}
+	fracFull := frac(state.FullMsmts, a.numMeasurements) * 100
+	fracPart := frac(state.PartialMsmts, a.numMeasurements) * 100
+	elog.Printf("k=%d, strategy=%s, order=%s, policy=%t: %d (%.1f%%) full, %d (%.1f%%) partial out of %d; %.1f%% lost\n",
+		threshold,
+		strategy.Name(),
+		orderName(order),
+		policy,
 		state.FullMsmts,
 		fracFull,
 		state.PartialMsmts,
 		fracPart,
-		s.numMeasurements,
+		a.numMeasurements,
 		100-fracFull-fracPart)
-	fmt.Printf("Partial%s,%d,%d,%.3f,%d,%d,0,0\n",
-		anonymityAttrs[method],
-		s.order,
-		s.threshold,
-		frac(state.PartialMsmts, s.numMeasurements),
-		s.root.NumTags(),
-		s.root.NumLeafTags())
+	return append(results, &starResult{
+		Strategy:        strategy.Name(),
+		Order:           orderName(order),
+		Threshold:       threshold,
+		Policy:          policy,
+		NumMeasurements: a.numMeasurements,
+		NumFull:         state.FullMsmts,
+		NumPartial:      state.PartialMsmts,
+		FracPartial:     frac(state.PartialMsmts, a.numMeasurements),
+		NumTags:         a.numTags,
+		NumLeafTags:     a.numLeafTags,
+	})
 }
 
 type NodeInfo struct {
@@ -210,6 +252,21 @@ func (n *Node) Add(orderedMsmt []string) {
 	}
 }
 
+// PrefixLen returns the length of the longest prefix of the given ordered
+// measurement that occurs at least 'threshold' times in the tree, i.e., the
+// number of attributes that Nested STAR would unlock.
+func (n *Node) PrefixLen(orderedMsmt []string, threshold int) int {
+	length := 0
+	for node := n; node != nil && length < len(orderedMsmt); length++ {
+		info, exists := node.ValueToInfo[orderedMsmt[length]]
+		if !exists || info.Num < threshold {
+			break
+		}
+		node = info.Next
+	}
+	return length
+}
+
 func (n *Node) NumTags() int {
 	var num = len(n.ValueToInfo)
 
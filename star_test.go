@@ -3,7 +3,7 @@ package main
 import "testing"
 
 func initFakeSTAR() *NestedSTAR {
-	star := NewNestedSTAR(&simulationConfig{})
+	star := NewNestedSTAR(orderHighEntropyFirst)
 
 	star.root.Add([]string{"baz"})
 	star.root.Add([]string{"bar"})
@@ -17,7 +17,7 @@ func initFakeSTAR() *NestedSTAR {
 }
 
 func initSTAR() (*NestedSTAR, int, int) {
-	star := NewNestedSTAR(&simulationConfig{})
+	star := NewNestedSTAR(orderHighEntropyFirst)
 
 	maxTags, threshold := 3, 5
 	// Six full measurements.
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errBadVersion     = errors.New("version is not of the form MAJOR.MINOR.PATCH")
+	errUnknownChannel = errors.New("unknown channel")
+
+	// knownChannels contains the channels that we track versions for.
+	knownChannels = []string{"nightly", "release", "beta", "canary", "dev", "developer", "unknown", ""}
+
+	// versions keeps track of the latest version per channel for the
+	// "recent_version" attribute.
+	versions = NewVersionTracker()
+)
+
+// version represents a Brave Browser version, which is based on semantic
+// versioning, e.g. "1.36.68", "1.36.68-beta.1", or "1.36.68+build".
+type version struct {
+	major int
+	minor int
+	patch int
+	// pre contains the version's dot-separated pre-release identifiers, if
+	// any.  Build metadata doesn't affect a version's precedence, so we don't
+	// keep it.
+	pre []string
+}
+
+// parseVersion parses the given version string.
+func parseVersion(strVersion string) (*version, error) {
+	s := strVersion
+	if i := strings.Index(s, "+"); i != -1 {
+		s = s[:i]
+	}
+	var pre string
+	if i := strings.Index(s, "-"); i != -1 {
+		s, pre = s[:i], s[i+1:]
+		if pre == "" {
+			return nil, fmt.Errorf("%w: %q has empty pre-release", errBadVersion, strVersion)
+		}
+	}
+
+	attrs := strings.Split(s, ".")
+	if len(attrs) != 3 {
+		return nil, fmt.Errorf("%w: %q", errBadVersion, strVersion)
+	}
+	nums := make([]int, len(attrs))
+	for i, attr := range attrs {
+		num, err := strconv.Atoi(attr)
+		if err != nil || num < 0 {
+			return nil, fmt.Errorf("%w: %q", errBadVersion, strVersion)
+		}
+		nums[i] = num
+	}
+
+	v := &version{major: nums[0], minor: nums[1], patch: nums[2]}
+	if pre != "" {
+		v.pre = strings.Split(pre, ".")
+	}
+	return v, nil
+}
+
+// compareInts returns -1, 0, or 1 if a is smaller than, equal to, or greater
+// than b.
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// comparePre compares two lists of pre-release identifiers as per semantic
+// versioning: numeric identifiers are compared numerically and have lower
+// precedence than alphanumeric identifiers, which are compared lexically.  A
+// version without pre-release identifiers has higher precedence than one with.
+func comparePre(pre1, pre2 []string) int {
+	if len(pre1) == 0 || len(pre2) == 0 {
+		return -compareInts(len(pre1), len(pre2))
+	}
+	for i := 0; i < len(pre1) && i < len(pre2); i++ {
+		n1, err1 := strconv.Atoi(pre1[i])
+		n2, err2 := strconv.Atoi(pre2[i])
+		var c int
+		switch {
+		case err1 == nil && err2 == nil:
+			c = compareInts(n1, n2)
+		case err1 == nil:
+			c = -1
+		case err2 == nil:
+			c = 1
+		default:
+			c = strings.Compare(pre1[i], pre2[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(pre1), len(pre2))
+}
+
+// compare returns -1, 0, or 1 if the object's version is older than,
+// identical to, or newer than the given version.
+func (v1 *version) compare(v2 *version) int {
+	if c := compareInts(v1.major, v2.major); c != 0 {
+		return c
+	}
+	if c := compareInts(v1.minor, v2.minor); c != 0 {
+		return c
+	}
+	if c := compareInts(v1.patch, v2.patch); c != 0 {
+		return c
+	}
+	return comparePre(v1.pre, v2.pre)
+}
+
+// newerThan returns true if the object's version is newer than the given
+// version.
+func (v1 *version) newerThan(v2 *version) bool {
+	return v1.compare(v2) > 0
+}
+
+// isEqual returns true if the given version is identical to the object's
+// version.
+func (v1 *version) isEqual(v2 *version) bool {
+	return v1.compare(v2) == 0
+}
+
+// String returns the version's string representation.
+func (v1 *version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v1.major, v1.minor, v1.patch)
+	if len(v1.pre) > 0 {
+		s += "-" + strings.Join(v1.pre, ".")
+	}
+	return s
+}
+
+// VersionTracker keeps track of the latest version that we know of for each
+// channel.  It's safe for concurrent use.
+type VersionTracker struct {
+	sync.Mutex
+	latest map[string]*version
+	// pinned is true if the latest versions come from a release manifest,
+	// in which case we no longer learn versions from measurements.
+	pinned bool
+	// staged contains the versions that StagePin staged, if any.
+	staged map[string]*version
+}
+
+// NewVersionTracker returns a new version tracker whose latest version is
+// 0.0.0 for all known channels.
+func NewVersionTracker() *VersionTracker {
+	t := &VersionTracker{latest: make(map[string]*version)}
+	for _, channel := range knownChannels {
+		t.latest[channel] = &version{}
+	}
+	return t
+}
+
+// Seed sets the latest version of the given channel, e.g. to a version that
+// we know from a release announcement.  Seeding also adds channels that the
+// tracker doesn't know yet.
+func (t *VersionTracker) Seed(channel, strVersion string) error {
+	v, err := parseVersion(strVersion)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.latest[channel] = v
+	return nil
+}
+
+// Pin replaces the tracker's latest versions with the given versions, e.g.
+// from a release manifest.  From then on, the tracker no longer learns from
+// the versions it's asked about, so versions that are newer than the pinned
+// version and channels without a pinned version are not recent.
+func (t *VersionTracker) Pin(latest map[string]*version) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.latest = latest
+	t.pinned = true
+}
+
+// Freeze pins the tracker to the latest versions that it has learned so far.
+func (t *VersionTracker) Freeze() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.pinned = true
+}
+
+// StagePin stages the given versions, which replace the tracker's latest
+// versions once ApplyStagedPin is called.  The shuffler computes crowd IDs as
+// reports arrive, so it only applies staged versions between batch periods.
+// Otherwise, the crowd IDs of a batch period would change halfway through it.
+func (t *VersionTracker) StagePin(latest map[string]*version) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.staged = latest
+}
+
+// ApplyStagedPin pins the versions that were staged via StagePin, if any.
+func (t *VersionTracker) ApplyStagedPin() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.staged == nil {
+		return
+	}
+	t.latest = t.staged
+	t.pinned = true
+	t.staged = nil
+}
+
+// Latest returns the latest version that we know of for the given channel.
+func (t *VersionTracker) Latest(channel string) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	v, exists := t.latest[channel]
+	if !exists {
+		return "", fmt.Errorf("%w: %q", errUnknownChannel, channel)
+	}
+	return v.String(), nil
+}
+
+// IsRecent returns true if the given version is identical to or newer than
+// the latest version we've seen so far for the given channel.  Note that the
+// tracker updates the latest versions as it's seeing newer versions.  The fact
+// that we update the latest version as we're going through measurements means
+// that we will have a small number of false positives but that doesn't matter
+// considering that we're processing millions of measurements.  If the tracker
+// is pinned, only the pinned version is recent.
+func (t *VersionTracker) IsRecent(channel, strVersion string) (bool, error) {
+	v, err := parseVersion(strVersion)
+	if err != nil {
+		return false, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	latest, exists := t.latest[channel]
+	if !exists {
+		return false, fmt.Errorf("%w: %q", errUnknownChannel, channel)
+	}
+	if t.pinned {
+		return v.isEqual(latest), nil
+	}
+	if v.newerThan(latest) {
+		elog.Printf("Updating latest version for %s to %s.", channel, v)
+		t.latest[channel] = v
+		return true, nil
+	}
+	return v.isEqual(latest), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func mustParseVersion(t *testing.T, s string) *version {
+	v, err := parseVersion(s)
+	if err != nil {
+		t.Fatalf("Failed to parse version %q: %s", s, err)
+	}
+	return v
+}
+
+func TestVersions(t *testing.T) {
+	// Each version is newer than the one before it.
+	ordered := []string{
+		"0.0.0",
+		"0.0.1",
+		"0.1.1",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.2.2",
+		"1.2.3",
+	}
+	for i := 1; i < len(ordered); i++ {
+		older, newer := mustParseVersion(t, ordered[i-1]), mustParseVersion(t, ordered[i])
+		if !newer.newerThan(older) || older.newerThan(newer) {
+			t.Fatalf("Expected %s to be newer than %s.", newer, older)
+		}
+	}
+
+	if !mustParseVersion(t, "1.0.0+build.5").isEqual(mustParseVersion(t, "1.0.0")) {
+		t.Fatal("Build metadata must not affect precedence.")
+	}
+	if mustParseVersion(t, "1.0.0").isEqual(mustParseVersion(t, "2.0.0")) {
+		t.Fatal("Different versions considered identical.")
+	}
+
+	for _, s := range []string{"", "1.36", "1.36.68.1", "a.b.c", "1.-1.0", "1.36.68-"} {
+		if _, err := parseVersion(s); !errors.Is(err, errBadVersion) {
+			t.Fatalf("Expected error %q for version %q but got %v.", errBadVersion, s, err)
+		}
+	}
+}
+
+func TestVersionTracker(t *testing.T) {
+	tracker := NewVersionTracker()
+	for _, test := range []struct {
+		version string
+		recent  bool
+	}{
+		{"0.0.1", true},
+		{"0.0.2", true},
+		{"1.0.0", true},
+		{"0.9.0", false},
+		{"1.0.0", true},
+		{"1.0.0-beta", false},
+	} {
+		recent, err := tracker.IsRecent("release", test.version)
+		if err != nil {
+			t.Fatalf("Failed to check version %q: %s", test.version, err)
+		}
+		if recent != test.recent {
+			t.Fatalf("Expected recentness of %q to be %v.", test.version, test.recent)
+		}
+	}
+
+	if _, err := tracker.IsRecent("release", "1.36"); !errors.Is(err, errBadVersion) {
+		t.Fatalf("Expected error %q but got %v.", errBadVersion, err)
+	}
+	if _, err := tracker.IsRecent("foo", "1.0.0"); !errors.Is(err, errUnknownChannel) {
+		t.Fatalf("Expected error %q but got %v.", errUnknownChannel, err)
+	}
+
+	if err := tracker.Seed("foo", "1.36.68"); err != nil {
+		t.Fatalf("Failed to seed tracker: %s", err)
+	}
+	if recent, _ := tracker.IsRecent("foo", "1.36.67"); recent {
+		t.Fatal("Version older than seeded version considered recent.")
+	}
+	if err := tracker.Seed("foo", "1.36"); err == nil {
+		t.Fatal("Seeded tracker with malformed version.")
+	}
+}
+
+func TestVersionTrackerConcurrency(t *testing.T) {
+	tracker := NewVersionTracker()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, _ = tracker.IsRecent("release", "1.0.0")
+				_, _ = tracker.IsRecent("release", (&version{major: 1, minor: i, patch: j}).String())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if latest, _ := tracker.Latest("release"); latest != "1.9.99" {
+		t.Fatalf("Expected latest version 1.9.99 but got %s.", latest)
+	}
+}
@@ -1,37 +1,227 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
+const (
+	defaultMaxBodyBytes    = 1 << 20
+	defaultMaxMeasurements = 1000
+	defaultInboxTimeout    = time.Second
+	defaultRetryAfter      = time.Minute
+	errInboxFull           = "shuffler is overloaded; try again later"
+	errShuttingDown        = "shuffler is shutting down; try again later"
+)
+
+// handlerConfig determines the limits that our Web API handlers enforce on
+// incoming requests.
+type handlerConfig struct {
+	// MaxBodyBytes is the maximum size of a request body.
+	MaxBodyBytes int64
+	// MaxMeasurements is the maximum number of measurements per request.
+	MaxMeasurements int
+	// InboxTimeout is how long we wait for the shuffler's inbox to accept new
+	// reports before we give up and respond with HTTP 503.
+	InboxTimeout time.Duration
+	// RetryAfter is what we tell clients via the Retry-After header when the
+	// shuffler's inbox is full.
+	RetryAfter time.Duration
+}
+
+var defaultHandlerConfig = &handlerConfig{
+	MaxBodyBytes:    defaultMaxBodyBytes,
+	MaxMeasurements: defaultMaxMeasurements,
+	InboxTimeout:    defaultInboxTimeout,
+	RetryAfter:      defaultRetryAfter,
+}
+
+// rejectedMeasurement explains why we rejected the measurement at the given
+// index of a request.
+type rejectedMeasurement struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// p3aResponse is the JSON-encoded response to a P3A request.
+type p3aResponse struct {
+	Accepted int                   `json:"accepted"`
+	Rejected int                   `json:"rejected"`
+	Errors   []rejectedMeasurement `json:"errors,omitempty"`
+}
+
+// readBody reads and returns the request body.  If the body exceeds the given
+// maximum size, readBody writes an HTTP error and returns nil.
+func readBody(w http.ResponseWriter, r *http.Request, maxBytes int64) []byte {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if int64(len(body)) > maxBytes {
+		http.Error(w, fmt.Sprintf("request body exceeds %d bytes", maxBytes),
+			http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	return body
+}
+
+// drainGate keeps track of the requests that our report handlers are serving,
+// and rejects new requests once we start draining.  nitriding doesn't let us
+// shut down its HTTP server, so the gate takes its place: reports that arrive
+// while we drain must not be acknowledged, because the shuffler would discard
+// them and clients wouldn't resend them.
+type drainGate struct {
+	sync.RWMutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// enter returns true if the caller may serve its request, in which case it
+// must call leave once it's done.
+func (g *drainGate) enter() bool {
+	g.RLock()
+	defer g.RUnlock()
+	if g.closed {
+		return false
+	}
+	g.inFlight.Add(1)
+	return true
+}
+
+// leave marks a request as served.
+func (g *drainGate) leave() {
+	g.inFlight.Done()
+}
+
+// close rejects all new requests and waits until all in-flight requests are
+// served.
+func (g *drainGate) close() {
+	g.Lock()
+	g.closed = true
+	g.Unlock()
+	g.inFlight.Wait()
+}
+
+// wrap returns a handler that serves requests via the given handler until the
+// gate is closed, and responds with HTTP 503 afterwards.
+func (g *drainGate) wrap(handler http.HandlerFunc, cfg *handlerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !g.enter() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(cfg.RetryAfter.Seconds())))
+			http.Error(w, errShuttingDown, http.StatusServiceUnavailable)
+			return
+		}
+		defer g.leave()
+		handler(w, r)
+	}
+}
+
+// sendToInbox sends the given reports to the shuffler's inbox.  If the inbox
+// doesn't accept the reports within our timeout, sendToInbox responds with
+// HTTP 503 and returns false.
+func sendToInbox(w http.ResponseWriter, inbox chan []Report, rs []Report, cfg *handlerConfig) bool {
+	timer := time.NewTimer(cfg.InboxTimeout)
+	defer timer.Stop()
+
+	select {
+	case inbox <- rs:
+		return true
+	case <-timer.C:
+		elog.Printf("Inbox is full.  Rejecting %d reports.", len(rs))
+		metrics.reportsRejected.Add("inbox_full", len(rs))
+		w.Header().Set("Retry-After", strconv.Itoa(int(cfg.RetryAfter.Seconds())))
+		http.Error(w, errInboxFull, http.StatusServiceUnavailable)
+		return false
+	}
+}
+
 // createP3AHandler creates a handler that receives a set of JSON-encoded P3A
-// measurements.
-func createP3AHandler(inbox chan []Report) http.HandlerFunc {
+// measurements.  Invalid measurements are filtered and the response tells the
+// client how many measurements we accepted and why we rejected the others.
+func createP3AHandler(inbox chan []Report, cfg *handlerConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var ms []P3AMeasurement
 
-		err := json.NewDecoder(r.Body).Decode(&ms)
-		if err != nil {
+		body := readBody(w, r, cfg.MaxBodyBytes)
+		if body == nil {
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&ms); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		metrics.reportsReceived.Add(len(ms))
+		if len(ms) > cfg.MaxMeasurements {
+			metrics.reportsRejected.Add("too_many", len(ms))
+			http.Error(w, fmt.Sprintf("request contains more than %d measurements", cfg.MaxMeasurements),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
 
+		resp := p3aResponse{}
 		rs := []Report{}
-		for _, m := range ms {
+		for i, m := range ms {
+			if err := m.Validate(); err != nil {
+				resp.Errors = append(resp.Errors, rejectedMeasurement{Index: i, Reason: err.Error()})
+				metrics.reportsRejected.Add("invalid", 1)
+				continue
+			}
 			rs = append(rs, m)
 		}
+		resp.Accepted, resp.Rejected = len(rs), len(resp.Errors)
 
-		inbox <- rs
-		elog.Printf("Sent %d P3A measurement to shuffler.", len(ms))
+		if len(rs) > 0 {
+			if !sendToInbox(w, inbox, rs, cfg) {
+				return
+			}
+			elog.Printf("Sent %d P3A measurement to shuffler.", len(rs))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(rs) == 0 && resp.Rejected > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			elog.Printf("Failed to send response: %s", err)
+		}
 	}
 }
 
 // createShufflerHandler creates a handler that receives an encrypted blob
-// that, when encrypted, contains a JSON-encoded structure consisting of a
+// that, when decrypted, contains a JSON-encoded structure consisting of a
 // crowd ID and an encrypted payload that is opaque to the shuffler.
-func createShufflerHandler(inbox chan []Report) http.HandlerFunc {
+func createShufflerHandler(inbox chan []Report, key *shufflerKey, cfg *handlerConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Decrypt report and forward it to the shuffler's inbox.
+		var m ShufflerMeasurement
+
+		body := readBody(w, r, cfg.MaxBodyBytes)
+		if body == nil {
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		metrics.reportsReceived.Inc()
+		report, err := key.decryptReport(m)
+		if err != nil {
+			metrics.reportsRejected.Add("undecryptable", 1)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sendToInbox(w, inbox, []Report{report}, cfg)
 	}
 }
@@ -2,7 +2,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestShufflerMeasurement(t *testing.T) {
@@ -12,8 +18,8 @@ func TestShufflerMeasurement(t *testing.T) {
 func TestP3AMeasurement(t *testing.T) {
 	m1 := P3AMeasurement{YearOfSurvey: 2022}
 	m2 := P3AMeasurement{YearOfSurvey: 2021}
-	m1CrowdID := m1.CrowdID(defaultCrowdIDMethod)
-	m2CrowdID := m2.CrowdID(defaultCrowdIDMethod)
+	m1CrowdID := m1.CrowdID(defaultCrowdIDStrategy, testCrowdIDKey)
+	m2CrowdID := m2.CrowdID(defaultCrowdIDStrategy, testCrowdIDKey)
 
 	if m1CrowdID == m2CrowdID {
 		t.Error("Crowd ID of two distinct measurements must not be identical.")
@@ -21,11 +27,142 @@ func TestP3AMeasurement(t *testing.T) {
 	if m1.String() == m2.String() {
 		t.Error("String representation of two distinct measurements must not be identical.")
 	}
-	if bytes.Equal(m1.Payload(), m2.Payload()) {
+	p1, err1 := m1.Payload()
+	p2, err2 := m2.Payload()
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Failed to get payloads: %v, %v", err1, err2)
+	}
+	if bytes.Equal(p1, p2) {
 		t.Error("Payload of two distinct measurements must not be identical.")
 	}
 
-	if m1CrowdID != m1.CrowdID(defaultCrowdIDMethod) {
+	if m1CrowdID != m1.CrowdID(defaultCrowdIDStrategy, testCrowdIDKey) {
 		t.Error("Crowd ID of two identical measurements must not differ.")
 	}
 }
+
+func postP3A(handler http.HandlerFunc, body string) (*httptest.ResponseRecorder, *p3aResponse) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, p3aEndpoint, strings.NewReader(body)))
+	var resp p3aResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		return w, nil
+	}
+	return w, &resp
+}
+
+func TestP3AHandler(t *testing.T) {
+	inbox := make(chan []Report, 1)
+	handler := createP3AHandler(inbox, &handlerConfig{
+		MaxBodyBytes:    1024,
+		MaxMeasurements: 2,
+		InboxTimeout:    time.Second,
+		RetryAfter:      time.Minute,
+	})
+
+	valid, _ := json.Marshal(m)
+	invalid := m
+	invalid.Channel = ""
+	invalidJSON, _ := json.Marshal(invalid)
+
+	// One valid and one invalid measurement.
+	w, resp := postP3A(handler, fmt.Sprintf("[%s,%s]", valid, invalidJSON))
+	if w.Code != http.StatusOK || resp == nil {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	if resp.Accepted != 1 || resp.Rejected != 1 {
+		t.Fatalf("Expected 1 accepted and 1 rejected measurement but got %+v.", resp)
+	}
+	if resp.Errors[0].Index != 1 || resp.Errors[0].Reason != errNoChannel.Error() {
+		t.Fatalf("Unexpected rejection reason: %+v", resp.Errors[0])
+	}
+	if rs := <-inbox; len(rs) != 1 {
+		t.Fatalf("Expected 1 report in inbox but got %d.", len(rs))
+	}
+
+	// Only invalid measurements.
+	w, resp = postP3A(handler, fmt.Sprintf("[%s]", invalidJSON))
+	if w.Code != http.StatusBadRequest || resp == nil || resp.Rejected != 1 {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusBadRequest, w.Code)
+	}
+
+	// Too many measurements.
+	w, _ = postP3A(handler, fmt.Sprintf("[%s,%s,%s]", valid, valid, valid))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	// Body is too large.
+	w, _ = postP3A(handler, "["+strings.Repeat(" ", 1024)+"]")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	// Unknown JSON field.
+	w, _ = postP3A(handler, `[{"foo":"bar"}]`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestFullInbox(t *testing.T) {
+	// Nobody is reading from our inbox, so it's going to be full.
+	inbox := make(chan []Report)
+	handler := createP3AHandler(inbox, &handlerConfig{
+		MaxBodyBytes:    defaultMaxBodyBytes,
+		MaxMeasurements: defaultMaxMeasurements,
+		InboxTimeout:    time.Millisecond,
+		RetryAfter:      time.Minute,
+	})
+
+	valid, _ := json.Marshal(m)
+	w, _ := postP3A(handler, fmt.Sprintf("[%s]", valid))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("Expected Retry-After of 60 but got %q.", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestDrainGate(t *testing.T) {
+	gate := &drainGate{}
+	cfg := &handlerConfig{RetryAfter: time.Minute}
+	release := make(chan bool)
+	entered := make(chan bool)
+	handler := gate.wrap(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+	}, cfg)
+
+	// An in-flight request must be served before close returns.
+	served := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, p3aEndpoint, nil))
+		served <- w.Code
+	}()
+	<-entered
+	closed := make(chan bool)
+	go func() {
+		gate.close()
+		closed <- true
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Gate closed while a request was in flight.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	if code := <-served; code != http.StatusOK {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusOK, code)
+	}
+	<-closed
+
+	// New requests must be rejected.
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, p3aEndpoint, nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("Expected HTTP 503 with Retry-After but got %d.", w.Code)
+	}
+}